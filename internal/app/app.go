@@ -10,7 +10,13 @@ import (
 	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/db"
 	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/internal/mailer"
 	"github.com/robboworld/mosquitto-broker/internal/mosquitto"
+	"github.com/robboworld/mosquitto-broker/internal/mqtt"
+	"github.com/robboworld/mosquitto-broker/internal/oidc"
+	"github.com/robboworld/mosquitto-broker/internal/passwordpolicy"
+	"github.com/robboworld/mosquitto-broker/internal/ratelimit"
 	"github.com/robboworld/mosquitto-broker/internal/server"
 	"github.com/robboworld/mosquitto-broker/internal/services"
 	"github.com/robboworld/mosquitto-broker/internal/transports/http"
@@ -25,7 +31,13 @@ func InvokeWith(m consts.Mode, options ...fx.Option) *fx.App {
 		fx.Provide(func() consts.Mode { return m }),
 		fx.Provide(logger.New),
 		fx.Provide(mosquitto.New),
+		fx.Provide(keys.New),
 		fx.Provide(db.NewPostgresDB),
+		fx.Provide(ratelimit.New),
+		fx.Provide(mailer.New),
+		fx.Provide(passwordpolicy.New),
+		fx.Provide(oidc.New),
+		fx.Provide(mqtt.New),
 		fx.Provide(gateways.New),
 		fx.Provide(services.New),
 		fx.Provide(http.NewHandlers),
@@ -36,11 +48,21 @@ func InvokeWith(m consts.Mode, options ...fx.Option) *fx.App {
 	return fx.New(di...)
 }
 
+// RunApp starts the server, or runs a cli command when one follows the mode
 func RunApp() {
-	if len(os.Args) == 2 && (consts.Mode(os.Args[1]) == consts.Development ||
-		consts.Mode(os.Args[1]) == consts.Production) {
-		InvokeWith(consts.Mode(os.Args[1]), fx.Invoke(server.NewServer)).Run()
-	} else {
-		InvokeWith(consts.Development, fx.Invoke(server.NewServer)).Run()
+	m := consts.Development
+	args := os.Args[1:]
+	if len(args) > 0 && (consts.Mode(args[0]) == consts.Development ||
+		consts.Mode(args[0]) == consts.Production) {
+		m = consts.Mode(args[0])
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		InvokeWith(m, fx.Invoke(server.NewServer)).Run()
+		return
+	}
+	if err := RunCommand(m, args); err != nil {
+		log.Fatalf("%s", err.Error())
 	}
 }
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"go.uber.org/fx"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/services"
+)
+
+// command runs with the fx graph of the server, but without starting it
+type command struct {
+	usage string
+	run   func(m consts.Mode, args []string) error
+}
+
+var commands = map[string]command{
+	"admin create-superadmin": {
+		usage: "--email EMAIL [--full-name NAME] [--password PASSWORD], the password is read from stdin when omitted",
+		run:   createSuperAdmin,
+	},
+	"user set-role": {
+		usage: "--email EMAIL --role ROLE",
+		run:   setRole,
+	},
+	"broker reconcile": {
+		usage: "[--dry-run] [--prune], rewrites the acl from the db and drops passwordfile entries of inactive users, --prune drops entries unknown to the db too",
+		run:   reconcile,
+	},
+	"broker adopt": {
+		usage: "[--passwd FILE] [--acl FILE] [--role ROLE] [--dry-run], takes users and topics over from a broker maintained by hand, the files of the broker by default",
+		run:   adopt,
+	},
+	"acl export": {
+		usage: "[--output FILE], prints the acl the db describes",
+		run:   exportAcl,
+	},
+}
+
+// RunCommand runs a subcommand given as "group name [flags]"
+func RunCommand(m consts.Mode, args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage())
+	}
+	name := args[0] + " " + args[1]
+	cmd, found := commands[name]
+	if !found {
+		return fmt.Errorf("unknown command %q\n%s", name, usage())
+	}
+	return cmd.run(m, args[2:])
+}
+
+func usage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("usage: app [development|production] [command]\ncommands:\n")
+	for _, name := range names {
+		b.WriteString("  " + name + " " + commands[name].usage + "\n")
+	}
+	return b.String()
+}
+
+// invoke builds the graph and calls function, whose error is returned
+func invoke(m consts.Mode, function interface{}) error {
+	return InvokeWith(m, fx.Invoke(function), fx.NopLogger).Err()
+}
+
+func createSuperAdmin(m consts.Mode, args []string) error {
+	flags := flag.NewFlagSet("admin create-superadmin", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the new user")
+	fullName := flags.String("full-name", "", "full name of the new user")
+	password := flags.String("password", "", "password of the new user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return errors.New("--email is required")
+	}
+	if *password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	return invoke(m, func(auth services.AuthService) error {
+		user, err := auth.CreateUser(models.UserCore{
+			Email:    *email,
+			Password: *password,
+			FullName: *fullName,
+			Role:     models.RoleSuperAdmin,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created SuperAdmin %s with id %d, two-factor enrolment is required on the first sign in\n", user.Email, user.ID)
+		return nil
+	})
+}
+
+func setRole(m consts.Mode, args []string) error {
+	flags := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	role := flags.String("role", "", "new role")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || *role == "" {
+		return errors.New("--email and --role are required")
+	}
+
+	return invoke(m, func(userService services.UserService) error {
+		user, err := userService.GetByEmail(*email)
+		if err != nil {
+			return err
+		}
+		// the cli acts as nobody with every permission, so the self management
+		// check does not apply and SuperAdmin may be granted
+		if err = userService.SetRole(user.ID, models.Role(*role), 0, models.RoleSuperAdmin); err != nil {
+			return err
+		}
+		fmt.Printf("%s is %s now\n", user.Email, *role)
+		return nil
+	})
+}
+
+func reconcile(m consts.Mode, args []string) error {
+	flags := flag.NewFlagSet("broker reconcile", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the differences")
+	prune := flags.Bool("prune", false, "remove passwordfile entries unknown to the db")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return invoke(m, func(mosquittoService services.MosquittoService) error {
+		report, err := mosquittoService.Reconcile(*prune, *dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("acl user blocks: %d\n", report.AclUsers)
+		printUsernames("passwordfile entries of inactive users removed", report.RemovedPasswd)
+		printUsernames("passwordfile entries unknown to the db", report.OrphanPasswd)
+		printUsernames("active users without passwordfile entry, a password reset restores it", report.MissingPasswd)
+		if *dryRun {
+			fmt.Println("dry run, nothing was written")
+		}
+		return nil
+	})
+}
+
+func adopt(m consts.Mode, args []string) error {
+	flags := flag.NewFlagSet("broker adopt", flag.ContinueOnError)
+	passwdFile := flags.String("passwd", "", "passwordfile to read")
+	aclFile := flags.String("acl", "", "acl file to read")
+	role := flags.String("role", string(models.RoleUser), "role of the new users")
+	dryRun := flags.Bool("dry-run", false, "only report what would be created")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return invoke(m, func(bundleService services.BundleService) error {
+		report, err := bundleService.Adopt(*passwdFile, *aclFile, models.Role(*role), *dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("users: %d, they must reset the password to sign in\n", report.Users)
+		fmt.Printf("topics: %d\n", report.Topics)
+		fmt.Printf("lines left out: %d\n", len(report.Problems))
+		for _, problem := range report.Problems {
+			fmt.Printf("  %s:%d: %s: %s\n", problem.File, problem.Line, problem.Reason, problem.Text)
+		}
+		if *dryRun {
+			fmt.Println("dry run, nothing was written")
+		}
+		return nil
+	})
+}
+
+func exportAcl(m consts.Mode, args []string) error {
+	flags := flag.NewFlagSet("acl export", flag.ContinueOnError)
+	output := flags.String("output", "", "file to write, stdout if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return invoke(m, func(mosquittoService services.MosquittoService) error {
+		lines, err := mosquittoService.ExportAcl()
+		if err != nil {
+			return err
+		}
+		data := strings.Join(lines, "\n") + "\n"
+		if *output == "" {
+			_, err = os.Stdout.WriteString(data)
+			return err
+		}
+		return os.WriteFile(*output, []byte(data), 0644)
+	})
+}
+
+func printUsernames(title string, usernames []string) {
+	fmt.Printf("%s: %d\n", title, len(usernames))
+	for _, username := range usernames {
+		fmt.Println("  " + username)
+	}
+}
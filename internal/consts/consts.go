@@ -10,4 +10,9 @@ const (
 const (
 	KeyId   = "keyId"
 	KeyRole = "keyRole"
+	// KeyScopes is set only for api key requests
+	KeyScopes = "keyScopes"
+	// KeyExpiresAt is the expiry of the access token or the api key, unset
+	// when it does not expire
+	KeyExpiresAt = "keyExpiresAt"
 )
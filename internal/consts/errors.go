@@ -8,16 +8,100 @@ const (
 	ErrIncorrectPasswordOrEmail = "incorrect password or email"
 	ErrUserWithEmailNotFound    = "user with this email not found"
 	ErrNotFoundInDB             = "not found"
-	ErrShortPassword            = "please input password, at least 8 symbols"
+	ErrWeakPassword             = "password does not meet the policy"
+	ErrUnknownScope             = "unknown scope"
+	ErrEmptyScopes              = "at least one scope is required"
+	ErrUnknownRole              = "unknown role"
+	ErrUnknownPermission        = "unknown permission"
+	ErrSuperAdminRolesManage    = "SuperAdmin must keep roles:manage permission"
+	ErrInvalidTwoFactorCode     = "invalid two-factor code"
+	ErrTwoFactorAlreadyEnabled  = "two-factor authentication is already enabled"
+	ErrTwoFactorNotEnrolled     = "two-factor authentication is not enrolled"
+	ErrInvalidEmailToken        = "invalid or expired token"
+	ErrIncorrectPassword        = "incorrect current password"
+	ErrInvalidOidcState         = "invalid or expired sso state"
+	ErrOidcNoEmail              = "identity provider returned no email"
+	ErrUserAlreadyDisabled      = "user is already disabled"
+	ErrUserNotDisabled          = "user is not disabled"
+	ErrInvalidEmail             = "invalid email"
+	ErrSameEmail                = "new email is the same as the current one"
+	ErrInvalidQuota             = "quota limits must not be negative"
+	ErrInvalidSlug              = "slug must be lowercase letters, digits, - or _"
+	ErrSlugAlreadyInUse         = "slug already in use"
+	ErrUserHasTopics            = "user has topics, delete them first"
+	ErrSuperAdminInOrganization = "users of an organization cannot be SuperAdmin"
+	ErrTopicReservedLevel       = "topic first level is reserved by an organization"
+	ErrInvalidTopicName         = "topic name is not a valid mqtt topic filter"
+	ErrUnknownSort              = "unknown sort field"
+	ErrInvalidOrder             = "order must be asc or desc"
+	ErrInvalidPermissionFilter  = "permission must be read, write or none"
+	ErrInvalidCursor            = "invalid cursor, it must come from the same sort and order"
+	ErrPageSizeRequired         = "pageSize is required with cursor"
+	ErrInvalidTime              = "time must be in RFC 3339 format"
+	ErrUnknownOrganization      = "unknown organization"
+	ErrUnknownBundleFormat      = "format must be json or csv"
+	ErrInvalidContentType       = "content type must be json, text, binary or protobuf"
+	ErrInvalidQos               = "qos must be 0, 1 or 2"
+	ErrInvalidTag               = "tags must be up to 32 lowercase letters, digits, _, . or -"
+	ErrTooManyTags              = "a topic can have up to 16 tags"
+	ErrTopicMetadataTooLong     = "description is limited to 2000 characters and contact to 255"
+	ErrInvalidSchema            = "schema is not a valid json schema"
+	ErrSchemaTooLarge           = "schema is limited to 64 KiB"
+	ErrMessageTopicRequired     = "topic name has wildcards, a topic without them is required"
+	ErrMessageTopicMismatch     = "topic does not match the topic name"
+	ErrPayloadTooLarge          = "payload is limited to 1 MiB"
+	ErrInvalidUserProperty      = "up to 32 user properties with a non-empty utf-8 key are allowed"
+	ErrInvalidPrefix            = "prefix must be a topic without wildcards"
 )
 
 // http code 401
 const (
 	ErrTokenExpired     = "token expired"
 	ErrNotStandardToken = "token claims are not of type *StandardClaims"
+	ErrInvalidApiKey    = "invalid api key"
+	ErrApiKeyExpired    = "api key expired"
+	ErrInvalidChallenge = "invalid or expired two-factor challenge"
+	ErrSessionRevoked   = "session revoked, sign in again"
+	ErrOidcFailed       = "single sign-on failed"
 )
 
 // http code 403
 const (
-	ErrAccessDenied = "access denied"
+	ErrAccessDenied      = "access denied"
+	ErrTwoFactorRequired = "two-factor authentication is required for this role"
+	ErrEmailNotVerified  = "email is not verified"
+	ErrUserDisabled      = "user is disabled"
+	ErrSelfManage        = "you cannot change your own account this way"
+	ErrPrivilegedRole    = "granting SuperAdmin or managing a SuperAdmin needs roles:manage"
+	ErrTopicNotWritable  = "topic does not allow write"
+	ErrTopicNotReadable  = "topic does not allow read"
+
+	ErrTopicQuotaExceeded      = "topic quota exceeded"
+	ErrCredentialQuotaExceeded = "credential quota exceeded"
+	ErrGrantQuotaExceeded      = "grant quota exceeded"
+)
+
+// http code 404
+const (
+	ErrOidcDisabled        = "single sign-on is not configured"
+	ErrTopicSchemaNotFound = "topic has no schema"
+	ErrMqttDisabled        = "the internal mqtt client is not configured"
+	ErrRetainedNotFound    = "no retained message on this topic"
+	ErrTopicRenamed        = "the topic was renamed, open the stream again"
+)
+
+// http code 422
+const (
+	ErrTopicTooDeep = "topic has more levels than the quota allows"
+)
+
+// http code 429
+const (
+	ErrTooManyRequests = "too many attempts, try again later"
+	ErrTooManyStreams  = "too many open streams, close one first"
+)
+
+// http code 503
+const (
+	ErrBrokerUnavailable = "broker is not reachable, try again later"
 )
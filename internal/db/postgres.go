@@ -73,11 +73,69 @@ func NewPostgresDB(m consts.Mode, loggers logger.Loggers) (PostgresDB, error) {
 
 func (c *PostgresDB) Migrate() (err error) {
 	err = c.DB.AutoMigrate(
+		&models.OrganizationCore{},
 		&models.UserCore{},
 		&models.TopicCore{},
+		&models.TopicTagCore{},
+		&models.TopicContractCore{},
+		&models.TopicViolationCore{},
+		&models.ServiceAccountCore{},
+		&models.ApiKeyCore{},
+		&models.RolePermissionCore{},
+		&models.RateLimitBucketCore{},
+		&models.RecoveryCodeCore{},
+		&models.EmailTokenCore{},
+		&models.QuotaOverrideCore{},
 	)
 	if err != nil {
 		return err
 	}
+	return c.seedRolePermissions()
+}
+
+// seedRolePermissions fills the defaults only for roles without any rows,
+// so permissions removed by an admin are not restored on restart. A permission
+// without any rows at all is new in this version and is granted by the defaults.
+// SuperAdmin is topped up with every permission on each start
+func (c *PostgresDB) seedRolePermissions() error {
+	var known []models.Permission
+	if err := c.DB.Model(&models.RolePermissionCore{}).Distinct().Pluck("permission", &known).Error; err != nil {
+		return err
+	}
+	isKnown := make(map[models.Permission]bool)
+	for _, permission := range known {
+		isKnown[permission] = true
+	}
+
+	for role, permissions := range models.DefaultRolePermissions {
+		var granted []models.Permission
+		if err := c.DB.Model(&models.RolePermissionCore{}).Where("role = ?", role).Pluck("permission", &granted).Error; err != nil {
+			return err
+		}
+		isGranted := make(map[models.Permission]bool)
+		for _, permission := range granted {
+			isGranted[permission] = true
+		}
+		var rolePermissions []models.RolePermissionCore
+		for _, permission := range permissions {
+			if isGranted[permission] {
+				continue
+			}
+			if len(granted) > 0 && isKnown[permission] && role != models.RoleSuperAdmin {
+				continue
+			}
+			rolePermissions = append(rolePermissions, models.RolePermissionCore{
+				Role:       role,
+				Permission: permission,
+			})
+		}
+		if len(rolePermissions) == 0 {
+			continue
+		}
+		if err := c.DB.Create(&rolePermissions).Error; err != nil {
+			return err
+		}
+		c.InfoLogger.Printf("seeded %d permissions for role %s", len(rolePermissions), role)
+	}
 	return nil
 }
@@ -0,0 +1,60 @@
+package gateways
+
+import (
+	"net/http"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type bundleGateway struct {
+	db *gorm.DB
+}
+
+func NewBundleGateway(db *gorm.DB) *bundleGateway {
+	return &bundleGateway{db: db}
+}
+
+// Import creates the users and then the topics in one transaction. The owner of
+// a topic is topic.User.Email, a new user of the same import or an existing one
+func (b *bundleGateway) Import(users []models.UserCore, topics []models.TopicCore) error {
+	err := b.db.Transaction(func(tx *gorm.DB) error {
+		ids := make(map[string]uint, len(users))
+		for i := range users {
+			if err := tx.Omit(clause.Associations).Create(&users[i]).Error; err != nil {
+				return err
+			}
+			ids[users[i].Email] = users[i].ID
+		}
+
+		for i := range topics {
+			email := topics[i].User.Email
+			id, found := ids[email]
+			if !found {
+				var owner models.UserCore
+				if err := tx.Where("email = ?", email).Take(&owner).Error; err != nil {
+					return err
+				}
+				id = owner.ID
+				ids[email] = id
+			}
+			topics[i].UserId = id
+			topics[i].User = models.UserCore{}
+			// the tags are created with the topic
+			if err := tx.Omit("User").Create(&topics[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package gateways
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type contractGateway struct {
+	db *gorm.DB
+}
+
+func NewContractGateway(db *gorm.DB) *contractGateway {
+	return &contractGateway{db: db}
+}
+
+// Set creates or replaces the schema of the topic, the counters and samples of
+// the previous schema are dropped
+func (c *contractGateway) Set(topicId uint, schema string) (models.TopicContractCore, error) {
+	var contract models.TopicContractCore
+
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("topic_id = ?", topicId).Delete(&models.TopicViolationCore{}).Error; err != nil {
+			return err
+		}
+		err := tx.Where("topic_id = ?", topicId).Take(&contract).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			contract = models.TopicContractCore{TopicId: topicId, Schema: schema}
+			return tx.Create(&contract).Error
+		}
+		if err != nil {
+			return err
+		}
+		contract.Schema = schema
+		contract.Messages = 0
+		contract.Violations = 0
+		contract.LastViolationAt = nil
+		return tx.Select("*").Omit("Topic").Save(&contract).Error
+	})
+	if err != nil {
+		return models.TopicContractCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return contract, nil
+}
+
+func (c *contractGateway) Get(topicId uint) (models.TopicContractCore, error) {
+	var contract models.TopicContractCore
+
+	if err := c.db.Where("topic_id = ?", topicId).Take(&contract).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.TopicContractCore{}, utils.ResponseError{
+				Code:    http.StatusNotFound,
+				Message: consts.ErrTopicSchemaNotFound,
+			}
+		}
+		return models.TopicContractCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return contract, nil
+}
+
+// GetAll returns the contracts with their topic, contracts of deleted topics are left out
+func (c *contractGateway) GetAll() ([]models.TopicContractCore, error) {
+	var contracts []models.TopicContractCore
+
+	if err := c.db.InnerJoins("Topic").Find(&contracts).Error; err != nil {
+		return []models.TopicContractCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return contracts, nil
+}
+
+func (c *contractGateway) Delete(topicId uint) error {
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("topic_id = ?", topicId).Delete(&models.TopicViolationCore{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("topic_id = ?", topicId).Delete(&models.TopicContractCore{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return utils.ResponseError{
+				Code:    http.StatusNotFound,
+				Message: consts.ErrTopicSchemaNotFound,
+			}
+		}
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// AddStats adds the counters and samples validated against the schema of
+// updatedAt, they are dropped when the schema was replaced since. Only the
+// latest keep samples of the topic stay
+func (c *contractGateway) AddStats(topicId uint, updatedAt time.Time, messages, violations int64,
+	lastViolationAt *time.Time, samples []models.TopicViolationCore, keep int) error {
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{
+			"messages":   gorm.Expr("messages + ?", messages),
+			"violations": gorm.Expr("violations + ?", violations),
+		}
+		if lastViolationAt != nil {
+			updates["last_violation_at"] = lastViolationAt
+		}
+		result := tx.Model(&models.TopicContractCore{}).
+			Where("topic_id = ? AND updated_at = ?", topicId, updatedAt).
+			UpdateColumns(updates)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if len(samples) == 0 {
+			return nil
+		}
+		if err := tx.Create(&samples).Error; err != nil {
+			return err
+		}
+		return tx.Where("topic_id = ? AND id NOT IN (?)", topicId,
+			tx.Model(&models.TopicViolationCore{}).Select("id").
+				Where("topic_id = ?", topicId).Order("id DESC").Limit(keep)).
+			Delete(&models.TopicViolationCore{}).Error
+	})
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// GetViolations returns the samples of the topic, newest first
+func (c *contractGateway) GetViolations(topicId uint, offset, limit int) ([]models.TopicViolationCore, uint, error) {
+	var violations []models.TopicViolationCore
+	var count int64
+
+	query := c.db.Model(&models.TopicViolationCore{}).Where("topic_id = ?", topicId)
+	if err := query.Count(&count).Error; err != nil {
+		return []models.TopicViolationCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if err := query.Order("id DESC").Offset(offset).Limit(limit).Find(&violations).Error; err != nil {
+		return []models.TopicViolationCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return violations, uint(count), nil
+}
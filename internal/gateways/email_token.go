@@ -0,0 +1,89 @@
+package gateways
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type emailTokenGateway struct {
+	db *gorm.DB
+}
+
+func NewEmailTokenGateway(db *gorm.DB) *emailTokenGateway {
+	return &emailTokenGateway{db: db}
+}
+
+func (e *emailTokenGateway) Create(emailToken models.EmailTokenCore) error {
+	if err := e.db.Create(&emailToken).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (e *emailTokenGateway) Get(purpose models.EmailTokenPurpose, tokenHash string) (models.EmailTokenCore, error) {
+	var emailToken models.EmailTokenCore
+
+	if err := e.db.Where("purpose = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?", purpose, tokenHash, time.Now()).
+		Take(&emailToken).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.EmailTokenCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrInvalidEmailToken,
+			}
+		}
+		return models.EmailTokenCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return emailToken, nil
+}
+
+// Consume marks the token used, so of two concurrent requests only one succeeds
+func (e *emailTokenGateway) Consume(purpose models.EmailTokenPurpose, tokenHash string) (models.EmailTokenCore, error) {
+	var emailToken models.EmailTokenCore
+
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("purpose = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?", purpose, tokenHash, time.Now()).
+			Take(&emailToken).Error; err != nil {
+			return err
+		}
+		return tx.Model(&emailToken).UpdateColumn("used_at", time.Now()).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.EmailTokenCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrInvalidEmailToken,
+			}
+		}
+		return models.EmailTokenCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return emailToken, nil
+}
+
+func (e *emailTokenGateway) DeleteByUserId(userId uint, purpose models.EmailTokenPurpose) error {
+	if err := e.db.Where("user_id = ? AND purpose = ?", userId, purpose).
+		Delete(&models.EmailTokenCore{}).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package gateways
 
 import (
+	"time"
+
 	"github.com/robboworld/mosquitto-broker/internal/models"
 	"go.uber.org/fx"
 
@@ -9,38 +11,139 @@ import (
 )
 
 type UserGateway interface {
-	Create(user models.UserCore) error
+	Create(user models.UserCore) (models.UserCore, error)
 	GetById(id uint) (models.UserCore, error)
 	GetByEmail(email string) (models.UserCore, error)
 	DoesExistEmail(id uint, email string) (bool, error)
 	SetMosquittoOn(id uint, mosquittoOn bool) error
+	SetSignInFailures(id uint, failedSignIns int, lockedUntil *time.Time) error
+	AddSignInFailure(id uint) (int, error)
+	SetLockedUntil(id uint, lockedUntil *time.Time) error
+	SetTotp(id uint, secret string, enabled bool) error
+	UseTotpStep(id uint, step int64) (bool, error)
+	SetVerified(id uint) error
+	SetPassword(id uint, passwordHash string) error
+	SetEmail(id uint, email string) error
+	SetFullName(id uint, fullName string) error
+	RevokeSessions(id uint, revokedAt time.Time) error
+	GetByOidcSubject(subject string) (models.UserCore, error)
+	SetOidcSubject(id uint, subject string) error
+	SetRole(id uint, role models.Role) error
+	GetAll(offset, limit int, search string, organizationId *uint) ([]models.UserCore, uint, error)
+	SetOrganization(id uint, organizationId *uint) error
+	SetDisabled(id uint, disabled bool, brokerPasswordHash string) error
+	Delete(id uint) error
+	PurgeDeleted(deletedBefore time.Time) (int, error)
 }
 
 type MosquittoGateway interface {
 	WriteMosquittoPasswd(email, password string)
+	HashMosquittoPassword(password string) (string, error)
+	WriteMosquittoPasswdHash(email, passwordHash string) error
+	WriteMosquittoPasswdHashes(passwordHashes map[string]string) error
+	GetMosquittoPasswdHash(email string) (string, bool, error)
+	DeleteMosquittoPasswd(email string) error
+	RenameMosquittoUser(oldEmail, newEmail string) error
+	GetMosquittoUsernames() ([]string, error)
+	RenderAcl(users []mosquitto.AclUser) ([]string, error)
+	WriteAcl(users []mosquitto.AclUser) error
+	ReadMosquittoInstallation(passwdFile, aclFile string) (mosquitto.Installation, error)
 	WriteNewUserToAcl(email string)
+	DeleteUserFromAcl(email string)
 	WriteNewTopicToAcl(email, name string, canRead, canWrite bool)
 	WriteUpdatedTopicToAcl(email, name string, canRead, canWrite bool)
+	RenameTopicInAcl(email, oldName, newName string) error
 	DeleteTopicFromAcl(username, name string)
 	MosquittoLaunch(mosquittoOn bool)
 	MosquittoStop()
+	MosquittoReload()
 }
 
 type TopicGateway interface {
 	Create(topic models.TopicCore) (models.TopicCore, error)
 	GetById(id uint) (models.TopicCore, error)
 	GetByUserId(userId uint, offset, limit int) (topics []models.TopicCore, countRows uint, err error)
-	GetAll(offset, limit int) (topics []models.TopicCore, countRows uint, err error)
+	GetAll(offset, limit int, organizationId *uint) (topics []models.TopicCore, countRows uint, err error)
+	List(topicQuery models.TopicQuery) (topics []models.TopicCore, countRows uint, err error)
 	UpdatePermissions(topic models.TopicCore) (models.TopicCore, error)
+	Rename(id uint, name string) (models.TopicCore, error)
+	UpdateMetadata(topic models.TopicCore) (models.TopicCore, error)
+	GetTags(userId, organizationId *uint) ([]models.TopicTagCountCore, error)
 	Delete(id uint) error
 	DoesExist(id, userId uint, name string) (bool, error)
+	DoesExistFirstLevel(level string) (bool, error)
+}
+
+type ServiceAccountGateway interface {
+	Create(serviceAccount models.ServiceAccountCore) (models.ServiceAccountCore, error)
+	GetById(id uint) (models.ServiceAccountCore, error)
+	GetByUserId(userId uint) ([]models.ServiceAccountCore, error)
+	GetAll() ([]models.ServiceAccountCore, error)
+	Delete(id uint) error
+	CreateKey(apiKey models.ApiKeyCore) (models.ApiKeyCore, error)
+	GetKeyByPrefix(prefix string) (models.ApiKeyCore, error)
+	GetKeysByServiceAccountId(serviceAccountId uint) ([]models.ApiKeyCore, error)
+	DeleteKey(serviceAccountId, id uint) error
+	SetKeyLastUsed(id uint, lastUsedAt time.Time) error
+}
+
+type RoleGateway interface {
+	GetAll() ([]models.RolePermissionCore, error)
+	SetPermissions(role models.Role, permissions []models.Permission) error
+}
+
+type RecoveryCodeGateway interface {
+	Replace(userId uint, codeHashes []string) error
+	Use(userId uint, codeHash string) (bool, error)
+}
+
+type EmailTokenGateway interface {
+	Create(emailToken models.EmailTokenCore) error
+	Get(purpose models.EmailTokenPurpose, tokenHash string) (models.EmailTokenCore, error)
+	Consume(purpose models.EmailTokenPurpose, tokenHash string) (models.EmailTokenCore, error)
+	DeleteByUserId(userId uint, purpose models.EmailTokenPurpose) error
+}
+
+type QuotaGateway interface {
+	GetOverride(userId uint) (override models.QuotaOverrideCore, found bool, err error)
+	SetOverride(override models.QuotaOverrideCore) error
+	GetUsage(userId uint) (models.QuotaUsage, error)
+}
+
+type OrganizationGateway interface {
+	Create(organization models.OrganizationCore) (models.OrganizationCore, error)
+	GetById(id uint) (models.OrganizationCore, error)
+	GetAll() ([]models.OrganizationCore, error)
+	DoesExistSlug(slug string) (bool, error)
+}
+
+type BundleGateway interface {
+	Import(users []models.UserCore, topics []models.TopicCore) error
+}
+
+type ContractGateway interface {
+	Set(topicId uint, schema string) (models.TopicContractCore, error)
+	Get(topicId uint) (models.TopicContractCore, error)
+	GetAll() ([]models.TopicContractCore, error)
+	Delete(topicId uint) error
+	AddStats(topicId uint, updatedAt time.Time, messages, violations int64,
+		lastViolationAt *time.Time, samples []models.TopicViolationCore, keep int) error
+	GetViolations(topicId uint, offset, limit int) (violations []models.TopicViolationCore, countRows uint, err error)
 }
 
 type Gateways struct {
 	fx.Out
-	UserGateway      UserGateway
-	MosquittoGateway MosquittoGateway
-	TopicGateway     TopicGateway
+	UserGateway           UserGateway
+	MosquittoGateway      MosquittoGateway
+	TopicGateway          TopicGateway
+	ServiceAccountGateway ServiceAccountGateway
+	RoleGateway           RoleGateway
+	RecoveryCodeGateway   RecoveryCodeGateway
+	EmailTokenGateway     EmailTokenGateway
+	QuotaGateway          QuotaGateway
+	OrganizationGateway   OrganizationGateway
+	BundleGateway         BundleGateway
+	ContractGateway       ContractGateway
 }
 
 func New(
@@ -48,8 +151,16 @@ func New(
 	mosquitto mosquitto.Mosquitto,
 ) Gateways {
 	return Gateways{
-		UserGateway:      NewUserGateway(postgres.DB),
-		MosquittoGateway: NewMosquittoGateway(mosquitto),
-		TopicGateway:     NewTopicGateway(postgres.DB),
+		UserGateway:           NewUserGateway(postgres.DB),
+		MosquittoGateway:      NewMosquittoGateway(mosquitto),
+		TopicGateway:          NewTopicGateway(postgres.DB),
+		ServiceAccountGateway: NewServiceAccountGateway(postgres.DB),
+		RoleGateway:           NewRoleGateway(postgres.DB),
+		RecoveryCodeGateway:   NewRecoveryCodeGateway(postgres.DB),
+		EmailTokenGateway:     NewEmailTokenGateway(postgres.DB),
+		QuotaGateway:          NewQuotaGateway(postgres.DB),
+		OrganizationGateway:   NewOrganizationGateway(postgres.DB),
+		BundleGateway:         NewBundleGateway(postgres.DB),
+		ContractGateway:       NewContractGateway(postgres.DB),
 	}
 }
@@ -29,10 +29,54 @@ func (m *mosquittoGateway) WriteMosquittoPasswd(email, password string) {
 	}
 }
 
+func (m *mosquittoGateway) HashMosquittoPassword(password string) (string, error) {
+	return mosquitto.HashPassword(password)
+}
+
+func (m *mosquittoGateway) WriteMosquittoPasswdHash(email, passwordHash string) error {
+	return m.mosquitto.WritePasswdHash(email, passwordHash)
+}
+
+func (m *mosquittoGateway) WriteMosquittoPasswdHashes(passwordHashes map[string]string) error {
+	return m.mosquitto.WritePasswdHashes(passwordHashes)
+}
+
+func (m *mosquittoGateway) GetMosquittoPasswdHash(email string) (string, bool, error) {
+	return m.mosquitto.ReadPasswdHash(email)
+}
+
+func (m *mosquittoGateway) DeleteMosquittoPasswd(email string) error {
+	return m.mosquitto.DeletePasswd(email)
+}
+
+func (m *mosquittoGateway) RenameMosquittoUser(oldEmail, newEmail string) error {
+	return m.mosquitto.RenameUser(oldEmail, newEmail)
+}
+
+func (m *mosquittoGateway) GetMosquittoUsernames() ([]string, error) {
+	return m.mosquitto.PasswdUsernames()
+}
+
+func (m *mosquittoGateway) RenderAcl(users []mosquitto.AclUser) ([]string, error) {
+	return m.mosquitto.RenderAcl(users)
+}
+
+func (m *mosquittoGateway) WriteAcl(users []mosquitto.AclUser) error {
+	return m.mosquitto.WriteAcl(users)
+}
+
+func (m *mosquittoGateway) ReadMosquittoInstallation(passwdFile, aclFile string) (mosquitto.Installation, error) {
+	return m.mosquitto.ReadInstallation(passwdFile, aclFile)
+}
+
 func (m *mosquittoGateway) WriteNewUserToAcl(email string) {
 	m.mosquitto.WriteNewUserToAcl(email)
 }
 
+func (m *mosquittoGateway) DeleteUserFromAcl(email string) {
+	m.mosquitto.DeleteUserFromAcl(email)
+}
+
 func (m *mosquittoGateway) WriteNewTopicToAcl(email, name string, canRead, canWrite bool) {
 	m.mosquitto.WriteNewTopicToAcl(email, name, canRead, canWrite)
 }
@@ -41,6 +85,10 @@ func (m *mosquittoGateway) WriteUpdatedTopicToAcl(email, name string, canRead, c
 	m.mosquitto.WriteUpdatedTopicToAcl(email, name, canRead, canWrite)
 }
 
+func (m *mosquittoGateway) RenameTopicInAcl(email, oldName, newName string) error {
+	return m.mosquitto.RenameTopicInAcl(email, oldName, newName)
+}
+
 func (m *mosquittoGateway) DeleteTopicFromAcl(username, name string) {
 	m.mosquitto.DeleteTopicFromAcl(username, name)
 }
@@ -79,3 +127,8 @@ func (m *mosquittoGateway) MosquittoStop() {
 
 	m.mosquitto.RunCommand(command, args...)
 }
+
+// MosquittoReload makes a running broker reread the passwordfile and acl
+func (m *mosquittoGateway) MosquittoReload() {
+	m.mosquitto.Reload()
+}
@@ -0,0 +1,77 @@
+package gateways
+
+import (
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type organizationGateway struct {
+	db *gorm.DB
+}
+
+func NewOrganizationGateway(db *gorm.DB) *organizationGateway {
+	return &organizationGateway{db: db}
+}
+
+func (o *organizationGateway) Create(organization models.OrganizationCore) (models.OrganizationCore, error) {
+	if err := o.db.Create(&organization).Clauses(clause.Returning{}).Error; err != nil {
+		return models.OrganizationCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return organization, nil
+}
+
+func (o *organizationGateway) GetById(id uint) (models.OrganizationCore, error) {
+	var organization models.OrganizationCore
+
+	if err := o.db.First(&organization, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.OrganizationCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrNotFoundInDB,
+			}
+		}
+		return models.OrganizationCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return organization, nil
+}
+
+func (o *organizationGateway) GetAll() ([]models.OrganizationCore, error) {
+	var organizations []models.OrganizationCore
+
+	if err := o.db.Order("id").Find(&organizations).Error; err != nil {
+		return []models.OrganizationCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return organizations, nil
+}
+
+// DoesExistSlug looks at deleted organizations as well, the slug of a deleted
+// organization could still be the prefix of topics in the acl
+func (o *organizationGateway) DoesExistSlug(slug string) (bool, error) {
+	if err := o.db.Unscoped().Where("slug = ?", slug).
+		Take(&models.OrganizationCore{}).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package gateways
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type quotaGateway struct {
+	db *gorm.DB
+}
+
+func NewQuotaGateway(db *gorm.DB) *quotaGateway {
+	return &quotaGateway{db: db}
+}
+
+func (q *quotaGateway) GetOverride(userId uint) (models.QuotaOverrideCore, bool, error) {
+	var override models.QuotaOverrideCore
+
+	if err := q.db.Where("user_id = ?", userId).Take(&override).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.QuotaOverrideCore{}, false, nil
+		}
+		return models.QuotaOverrideCore{}, false, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return override, true, nil
+}
+
+// SetOverride replaces every limit of the user override, nil fields included
+func (q *quotaGateway) SetOverride(override models.QuotaOverrideCore) error {
+	if err := q.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "max_topics", "max_credentials", "max_grants", "max_topic_depth"}),
+	}).Create(&override).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (q *quotaGateway) GetUsage(userId uint) (models.QuotaUsage, error) {
+	var topics, grants, credentials int64
+
+	err := q.db.Model(&models.TopicCore{}).Where("user_id = ?", userId).Count(&topics).Error
+	if err == nil {
+		err = q.db.Model(&models.TopicCore{}).
+			Where("user_id = ? AND (can_read OR can_write)", userId).Count(&grants).Error
+	}
+	if err == nil {
+		// expired keys cannot be used and do not count
+		err = q.db.Model(&models.ApiKeyCore{}).
+			Joins("JOIN service_account_cores ON service_account_cores.id = api_key_cores.service_account_id AND service_account_cores.deleted_at IS NULL").
+			Where("service_account_cores.user_id = ? AND (api_key_cores.expires_at IS NULL OR api_key_cores.expires_at > ?)", userId, time.Now()).
+			Count(&credentials).Error
+	}
+	if err != nil {
+		return models.QuotaUsage{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return models.QuotaUsage{
+		Topics:      int(topics),
+		Credentials: int(credentials),
+		Grants:      int(grants),
+	}, nil
+}
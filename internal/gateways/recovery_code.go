@@ -0,0 +1,58 @@
+package gateways
+
+import (
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type recoveryCodeGateway struct {
+	db *gorm.DB
+}
+
+func NewRecoveryCodeGateway(db *gorm.DB) *recoveryCodeGateway {
+	return &recoveryCodeGateway{db: db}
+}
+
+func (r *recoveryCodeGateway) Replace(userId uint, codeHashes []string) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userId).Delete(&models.RecoveryCodeCore{}).Error; err != nil {
+			return err
+		}
+		if len(codeHashes) == 0 {
+			return nil
+		}
+		var recoveryCodes []models.RecoveryCodeCore
+		for _, codeHash := range codeHashes {
+			recoveryCodes = append(recoveryCodes, models.RecoveryCodeCore{
+				UserId:   userId,
+				CodeHash: codeHash,
+			})
+		}
+		return tx.Create(&recoveryCodes).Error
+	})
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (r *recoveryCodeGateway) Use(userId uint, codeHash string) (bool, error) {
+	result := r.db.Model(&models.RecoveryCodeCore{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, codeHash).
+		UpdateColumn("used_at", time.Now())
+	if result.Error != nil {
+		return false, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: result.Error.Error(),
+		}
+	}
+	return result.RowsAffected > 0, nil
+}
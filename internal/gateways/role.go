@@ -0,0 +1,56 @@
+package gateways
+
+import (
+	"net/http"
+
+	"gorm.io/gorm"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type roleGateway struct {
+	db *gorm.DB
+}
+
+func NewRoleGateway(db *gorm.DB) *roleGateway {
+	return &roleGateway{db: db}
+}
+
+func (r *roleGateway) GetAll() ([]models.RolePermissionCore, error) {
+	var rolePermissions []models.RolePermissionCore
+
+	if err := r.db.Order("role, permission").Find(&rolePermissions).Error; err != nil {
+		return []models.RolePermissionCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return rolePermissions, nil
+}
+
+func (r *roleGateway) SetPermissions(role models.Role, permissions []models.Permission) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role = ?", role).Delete(&models.RolePermissionCore{}).Error; err != nil {
+			return err
+		}
+		if len(permissions) == 0 {
+			return nil
+		}
+		var rolePermissions []models.RolePermissionCore
+		for _, permission := range permissions {
+			rolePermissions = append(rolePermissions, models.RolePermissionCore{
+				Role:       role,
+				Permission: permission,
+			})
+		}
+		return tx.Create(&rolePermissions).Error
+	})
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
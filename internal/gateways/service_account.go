@@ -0,0 +1,158 @@
+package gateways
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type serviceAccountGateway struct {
+	db *gorm.DB
+}
+
+func NewServiceAccountGateway(db *gorm.DB) *serviceAccountGateway {
+	return &serviceAccountGateway{db: db}
+}
+
+func (s *serviceAccountGateway) Create(serviceAccount models.ServiceAccountCore) (models.ServiceAccountCore, error) {
+	if err := s.db.Create(&serviceAccount).Clauses(clause.Returning{}).Error; err != nil {
+		return models.ServiceAccountCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return serviceAccount, nil
+}
+
+func (s *serviceAccountGateway) GetById(id uint) (models.ServiceAccountCore, error) {
+	var serviceAccount models.ServiceAccountCore
+
+	if err := s.db.First(&serviceAccount, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.ServiceAccountCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrNotFoundInDB,
+			}
+		}
+		return models.ServiceAccountCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return serviceAccount, nil
+}
+
+func (s *serviceAccountGateway) GetByUserId(userId uint) ([]models.ServiceAccountCore, error) {
+	var serviceAccounts []models.ServiceAccountCore
+
+	if err := s.db.Where("user_id = ?", userId).Find(&serviceAccounts).Error; err != nil {
+		return []models.ServiceAccountCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return serviceAccounts, nil
+}
+
+func (s *serviceAccountGateway) GetAll() ([]models.ServiceAccountCore, error) {
+	var serviceAccounts []models.ServiceAccountCore
+
+	if err := s.db.Find(&serviceAccounts).Error; err != nil {
+		return []models.ServiceAccountCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return serviceAccounts, nil
+}
+
+func (s *serviceAccountGateway) Delete(id uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("service_account_id = ?", id).Delete(&models.ApiKeyCore{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.ServiceAccountCore{}, id).Error
+	})
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (s *serviceAccountGateway) CreateKey(apiKey models.ApiKeyCore) (models.ApiKeyCore, error) {
+	if err := s.db.Create(&apiKey).Clauses(clause.Returning{}).Error; err != nil {
+		return models.ApiKeyCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return apiKey, nil
+}
+
+func (s *serviceAccountGateway) GetKeyByPrefix(prefix string) (models.ApiKeyCore, error) {
+	var apiKey models.ApiKeyCore
+
+	if err := s.db.Preload("ServiceAccount").Where("prefix = ?", prefix).Take(&apiKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.ApiKeyCore{}, utils.ResponseError{
+				Code:    http.StatusUnauthorized,
+				Message: consts.ErrInvalidApiKey,
+			}
+		}
+		return models.ApiKeyCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return apiKey, nil
+}
+
+func (s *serviceAccountGateway) GetKeysByServiceAccountId(serviceAccountId uint) ([]models.ApiKeyCore, error) {
+	var apiKeys []models.ApiKeyCore
+
+	if err := s.db.Where("service_account_id = ?", serviceAccountId).Find(&apiKeys).Error; err != nil {
+		return []models.ApiKeyCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return apiKeys, nil
+}
+
+func (s *serviceAccountGateway) DeleteKey(serviceAccountId, id uint) error {
+	result := s.db.Where("service_account_id = ?", serviceAccountId).Delete(&models.ApiKeyCore{}, id)
+	if result.Error != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: result.Error.Error(),
+		}
+	}
+	if result.RowsAffected == 0 {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrNotFoundInDB,
+		}
+	}
+	return nil
+}
+
+func (s *serviceAccountGateway) SetKeyLastUsed(id uint, lastUsedAt time.Time) error {
+	if err := s.db.Model(&models.ApiKeyCore{}).Where("id = ?", id).
+		UpdateColumn("last_used_at", lastUsedAt).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package gateways
 import (
 	"errors"
 	"net/http"
+	"strings"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -33,7 +34,7 @@ func (t *topicGateway) Create(topic models.TopicCore) (models.TopicCore, error)
 func (t *topicGateway) GetById(id uint) (models.TopicCore, error) {
 	var topic models.TopicCore
 
-	if err := t.db.First(&topic, id).Error; err != nil {
+	if err := t.db.Preload("Tags").First(&topic, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return models.TopicCore{}, utils.ResponseError{
 				Code:    http.StatusBadRequest,
@@ -52,35 +53,135 @@ func (t *topicGateway) GetByUserId(userId uint, offset, limit int) ([]models.Top
 	var topics []models.TopicCore
 	var count int64
 
-	result := t.db.Limit(limit).Offset(offset).Where("user_id = ?", userId).Find(&topics)
-	if result.Error != nil {
+	query := t.db.Model(&models.TopicCore{}).Where("user_id = ?", userId)
+	if err := query.Count(&count).Error; err != nil {
 		return []models.TopicCore{}, 0, utils.ResponseError{
 			Code:    http.StatusInternalServerError,
-			Message: result.Error.Error(),
+			Message: err.Error(),
+		}
+	}
+	if err := query.Preload("Tags").Order("id").Limit(limit).Offset(offset).Find(&topics).Error; err != nil {
+		return []models.TopicCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return topics, uint(count), nil
+}
+
+// GetAll returns the topics of the organization, or of every organization when organizationId is nil
+func (t *topicGateway) GetAll(offset, limit int, organizationId *uint) ([]models.TopicCore, uint, error) {
+	var topics []models.TopicCore
+	var count int64
+
+	query := t.db.Model(&models.TopicCore{})
+	if organizationId != nil {
+		query = query.Where("organization_id = ?", *organizationId)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return []models.TopicCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if err := query.Preload("Tags").Order("id").Limit(limit).Offset(offset).Find(&topics).Error; err != nil {
+		return []models.TopicCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
 		}
 	}
-	result.Count(&count)
 	return topics, uint(count), nil
 }
 
-func (t *topicGateway) GetAll(offset, limit int) ([]models.TopicCore, uint, error) {
+// List returns a page of the filtered topics and the count of all of them.
+// Rows are ordered by the sort column and then by id, so the keyset of
+// (column, id) is unique and After continues right behind the previous page
+func (t *topicGateway) List(topicQuery models.TopicQuery) ([]models.TopicCore, uint, error) {
 	var topics []models.TopicCore
 	var count int64
 
-	result := t.db.Limit(limit).Offset(offset).Find(&topics)
-	if result.Error != nil {
+	filter := topicQuery.Filter
+	query := t.db.Model(&models.TopicCore{})
+	if filter.OrganizationId != nil {
+		query = query.Where("organization_id = ?", *filter.OrganizationId)
+	}
+	if filter.UserId != nil {
+		query = query.Where("user_id = ?", *filter.UserId)
+	}
+	escaper := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	if filter.NamePrefix != "" {
+		query = query.Where("name LIKE ?", escaper.Replace(filter.NamePrefix)+"%")
+	}
+	if filter.NameContains != "" {
+		pattern := "%" + escaper.Replace(filter.NameContains) + "%"
+		query = query.Where("(name ILIKE ? OR description ILIKE ?)", pattern, pattern)
+	}
+	if len(filter.Tags) > 0 {
+		query = query.Where("id IN (?)", t.db.Model(&models.TopicTagCore{}).Select("topic_id").
+			Where("tag IN ?", filter.Tags).Group("topic_id").Having("COUNT(*) = ?", len(filter.Tags)))
+	}
+	if filter.ContentType != "" {
+		query = query.Where("content_type = ?", filter.ContentType)
+	}
+	switch filter.Permission {
+	case models.TopicPermissionRead:
+		query = query.Where("can_read = ?", true)
+	case models.TopicPermissionWrite:
+		query = query.Where("can_write = ?", true)
+	case models.TopicPermissionNone:
+		query = query.Where("can_read = ? AND can_write = ?", false, false)
+	}
+	if filter.CreatedFrom != nil {
+		query = query.Where("created_at >= ?", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		query = query.Where("created_at < ?", *filter.CreatedTo)
+	}
+
+	if err := query.Count(&count).Error; err != nil {
+		return []models.TopicCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+
+	direction, compare := "ASC", ">"
+	if topicQuery.Desc {
+		direction, compare = "DESC", "<"
+	}
+	column := topicQuery.Sort
+	if column == "" {
+		column = models.TopicSortId
+	}
+	offset := topicQuery.Offset
+	if after := topicQuery.After; after != nil {
+		offset = 0
+		switch column {
+		case models.TopicSortName:
+			query = query.Where("(name, id) "+compare+" (?, ?)", after.Name, after.ID)
+		case models.TopicSortCreatedAt:
+			query = query.Where("(created_at, id) "+compare+" (?, ?)", after.CreatedAt, after.ID)
+		default:
+			query = query.Where("id "+compare+" ?", after.ID)
+		}
+	}
+	if column != models.TopicSortId {
+		query = query.Order(column + " " + direction)
+	}
+	query = query.Order("id " + direction)
+
+	if err := query.Preload("Tags").Limit(topicQuery.Limit).Offset(offset).Find(&topics).Error; err != nil {
 		return []models.TopicCore{}, 0, utils.ResponseError{
 			Code:    http.StatusInternalServerError,
-			Message: result.Error.Error(),
+			Message: err.Error(),
 		}
 	}
-	result.Count(&count)
 	return topics, uint(count), nil
 }
 
 func (t *topicGateway) UpdatePermissions(topic models.TopicCore) (models.TopicCore, error) {
 	var existingTopic models.TopicCore
-	if err := t.db.First(&existingTopic, topic.ID).Error; err != nil {
+	if err := t.db.Preload("Tags").First(&existingTopic, topic.ID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return models.TopicCore{}, utils.ResponseError{
 				Code:    http.StatusBadRequest,
@@ -107,8 +208,110 @@ func (t *topicGateway) UpdatePermissions(topic models.TopicCore) (models.TopicCo
 	return existingTopic, nil
 }
 
+// Rename updates only the name, tags, contracts and violations refer to the
+// topic by id and the contract validator resubscribes when the name changes.
+// The transaction returns the row as it was written
+func (t *topicGateway) Rename(id uint, name string) (models.TopicCore, error) {
+	var topic models.TopicCore
+
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.TopicCore{}).Where("id = ?", id).
+			Update("name", name).Error; err != nil {
+			return err
+		}
+		return tx.Preload("Tags").First(&topic, id).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.TopicCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrNotFoundInDB,
+			}
+		}
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return topic, nil
+}
+
+// UpdateMetadata replaces the metadata and the tags of the topic
+func (t *topicGateway) UpdateMetadata(topic models.TopicCore) (models.TopicCore, error) {
+	var updatedTopic models.TopicCore
+
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.TopicCore{}).Where("id = ?", topic.ID).
+			Updates(map[string]interface{}{
+				"description":  topic.Description,
+				"content_type": topic.ContentType,
+				"qos":          topic.Qos,
+				"retained":     topic.Retained,
+				"contact":      topic.Contact,
+			}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("topic_id = ?", topic.ID).Delete(&models.TopicTagCore{}).Error; err != nil {
+			return err
+		}
+		if len(topic.Tags) > 0 {
+			if err := tx.Create(&topic.Tags).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Preload("Tags").First(&updatedTopic, topic.ID).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.TopicCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrNotFoundInDB,
+			}
+		}
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return updatedTopic, nil
+}
+
+// GetTags counts the tags of the topics of the user, or of the organization, or
+// of every topic when both are nil
+func (t *topicGateway) GetTags(userId, organizationId *uint) ([]models.TopicTagCountCore, error) {
+	var tags []models.TopicTagCountCore
+
+	query := t.db.Model(&models.TopicTagCore{}).
+		Select("topic_tag_cores.tag AS tag, COUNT(*) AS topics").
+		Joins("JOIN topic_cores ON topic_cores.id = topic_tag_cores.topic_id AND topic_cores.deleted_at IS NULL")
+	if userId != nil {
+		query = query.Where("topic_cores.user_id = ?", *userId)
+	}
+	if organizationId != nil {
+		query = query.Where("topic_cores.organization_id = ?", *organizationId)
+	}
+	if err := query.Group("topic_tag_cores.tag").Order("topic_tag_cores.tag").
+		Scan(&tags).Error; err != nil {
+		return []models.TopicTagCountCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return tags, nil
+}
+
+// Delete soft deletes the topic, its contract and samples go for good
 func (t *topicGateway) Delete(id uint) error {
-	if err := t.db.Delete(&models.TopicCore{}, id).Error; err != nil {
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("topic_id = ?", id).Delete(&models.TopicViolationCore{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("topic_id = ?", id).Delete(&models.TopicContractCore{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.TopicCore{}, id).Error
+	})
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return utils.ResponseError{
 				Code:    http.StatusBadRequest,
@@ -136,3 +339,19 @@ func (t *topicGateway) DoesExist(id, userId uint, name string) (bool, error) {
 	}
 	return true, nil
 }
+
+// DoesExistFirstLevel reports whether a topic is named level or starts with level/
+func (t *topicGateway) DoesExistFirstLevel(level string) (bool, error) {
+	pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(level) + "/%"
+	if err := t.db.Where("name = ? OR name LIKE ?", level, pattern).
+		Take(&models.TopicCore{}).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return true, nil
+}
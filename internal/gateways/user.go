@@ -3,14 +3,17 @@ package gateways
 import (
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/models"
 	"github.com/robboworld/mosquitto-broker/pkg/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-type userGatewayImpl struct {
+type userGateway struct {
 	db *gorm.DB
 }
 
@@ -18,14 +21,14 @@ func NewUserGateway(db *gorm.DB) *userGateway {
 	return &userGateway{db: db}
 }
 
-func (u *userGateway) Create(user models.UserCore) error {
+func (u *userGateway) Create(user models.UserCore) (models.UserCore, error) {
 	if err := u.db.Create(&user).Error; err != nil {
-		return utils.ResponseError{
+		return models.UserCore{}, utils.ResponseError{
 			Code:    http.StatusInternalServerError,
 			Message: err.Error(),
 		}
 	}
-	return nil
+	return user, nil
 }
 
 func (u *userGateway) GetById(id uint) (models.UserCore, error) {
@@ -105,3 +108,324 @@ func (u *userGateway) SetMosquittoOn(id uint, mosquittoOn bool) error {
 	}
 	return nil
 }
+
+func (u *userGateway) SetSignInFailures(id uint, failedSignIns int, lockedUntil *time.Time) error {
+	updateStruct := map[string]interface{}{
+		"failed_sign_ins": failedSignIns,
+		"locked_until":    lockedUntil,
+	}
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).Updates(updateStruct).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// AddSignInFailure increments in the db, so failures of parallel requests are
+// all counted, and returns the new count
+func (u *userGateway) AddSignInFailure(id uint) (int, error) {
+	user := models.UserCore{ID: id}
+	if err := u.db.Model(&user).Clauses(clause.Returning{Columns: []clause.Column{{Name: "failed_sign_ins"}}}).
+		UpdateColumn("failed_sign_ins", gorm.Expr("failed_sign_ins + 1")).Error; err != nil {
+		return 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return user.FailedSignIns, nil
+}
+
+func (u *userGateway) SetLockedUntil(id uint, lockedUntil *time.Time) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		UpdateColumn("locked_until", lockedUntil).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) SetTotp(id uint, secret string, enabled bool) error {
+	updateStruct := map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_enabled":   enabled,
+		"totp_last_step": 0,
+	}
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).Updates(updateStruct).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// UseTotpStep stores the step of an accepted code, false means the step
+// was already used and the code is a replay
+func (u *userGateway) UseTotpStep(id uint, step int64) (bool, error) {
+	result := u.db.Model(&models.UserCore{}).
+		Where("id = ? AND totp_last_step < ?", id, step).
+		UpdateColumn("totp_last_step", step)
+	if result.Error != nil {
+		return false, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: result.Error.Error(),
+		}
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (u *userGateway) SetVerified(id uint) error {
+	updateStruct := map[string]interface{}{
+		"pending_verification": false,
+		"broker_password_hash": "",
+	}
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).Updates(updateStruct).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// SetPassword also lifts a lockout, the new password was proven by other means
+func (u *userGateway) SetPassword(id uint, passwordHash string) error {
+	updateStruct := map[string]interface{}{
+		"password":                passwordHash,
+		"failed_sign_ins":         0,
+		"locked_until":            nil,
+		"password_reset_required": false,
+	}
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).Updates(updateStruct).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) SetEmail(id uint, email string) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		Update("email", email).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) SetFullName(id uint, fullName string) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		Update("full_name", fullName).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) RevokeSessions(id uint, revokedAt time.Time) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		UpdateColumn("sessions_revoked_at", revokedAt).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) GetByOidcSubject(subject string) (models.UserCore, error) {
+	var user models.UserCore
+
+	if err := u.db.Where("oidc_subject = ?", subject).Take(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.UserCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrNotFoundInDB,
+			}
+		}
+		return models.UserCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return user, nil
+}
+
+func (u *userGateway) SetOidcSubject(id uint, subject string) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		UpdateColumn("oidc_subject", subject).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) SetRole(id uint, role models.Role) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		UpdateColumn("role", role).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// GetAll searches by a part of the email or the full name in the organization,
+// or in every organization when organizationId is nil, the count ignores the page
+func (u *userGateway) GetAll(offset, limit int, search string, organizationId *uint) ([]models.UserCore, uint, error) {
+	var users []models.UserCore
+	var count int64
+
+	query := u.db.Model(&models.UserCore{})
+	if organizationId != nil {
+		query = query.Where("organization_id = ?", *organizationId)
+	}
+	if search != "" {
+		pattern := "%" + strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(search) + "%"
+		query = query.Where("email ILIKE ? OR full_name ILIKE ?", pattern, pattern)
+	}
+
+	if err := query.Count(&count).Error; err != nil {
+		return []models.UserCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if err := query.Order("id").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+		return []models.UserCore{}, 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return users, uint(count), nil
+}
+
+func (u *userGateway) SetOrganization(id uint, organizationId *uint) error {
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).
+		Update("organization_id", organizationId).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (u *userGateway) SetDisabled(id uint, disabled bool, brokerPasswordHash string) error {
+	updateStruct := map[string]interface{}{
+		"disabled":             disabled,
+		"broker_password_hash": brokerPasswordHash,
+	}
+	if err := u.db.Model(&models.UserCore{}).Where("id = ?", id).Updates(updateStruct).Error; err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// Delete soft deletes the user together with the topics and service accounts.
+// The sso link is dropped, so the same account can sign up again
+func (u *userGateway) Delete(id uint) error {
+	err := u.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.UserCore{}).Where("id = ?", id).
+			UpdateColumn("oidc_subject", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.TopicCore{}).Error; err != nil {
+			return err
+		}
+		var serviceAccountIds []uint
+		if err := tx.Model(&models.ServiceAccountCore{}).Where("user_id = ?", id).
+			Pluck("id", &serviceAccountIds).Error; err != nil {
+			return err
+		}
+		if len(serviceAccountIds) > 0 {
+			if err := tx.Where("service_account_id IN ?", serviceAccountIds).Delete(&models.ApiKeyCore{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&models.ServiceAccountCore{}, serviceAccountIds).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&models.UserCore{}, id).Error
+	})
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+// PurgeDeleted removes for good the users soft deleted before deletedBefore
+// and every row that belongs to them
+func (u *userGateway) PurgeDeleted(deletedBefore time.Time) (int, error) {
+	var ids []uint
+	err := u.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.UserCore{}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", deletedBefore).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		var serviceAccountIds []uint
+		if err := tx.Unscoped().Model(&models.ServiceAccountCore{}).Where("user_id IN ?", ids).
+			Pluck("id", &serviceAccountIds).Error; err != nil {
+			return err
+		}
+		if len(serviceAccountIds) > 0 {
+			if err := tx.Unscoped().Where("service_account_id IN ?", serviceAccountIds).
+				Delete(&models.ApiKeyCore{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, model := range []interface{}{
+			&models.TopicTagCore{},
+			&models.TopicViolationCore{},
+			&models.TopicContractCore{},
+		} {
+			if err := tx.Where("topic_id IN (?)", tx.Unscoped().Model(&models.TopicCore{}).
+				Select("id").Where("user_id IN ?", ids)).
+				Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		for _, model := range []interface{}{
+			&models.ServiceAccountCore{},
+			&models.TopicCore{},
+			&models.RecoveryCodeCore{},
+			&models.EmailTokenCore{},
+			&models.QuotaOverrideCore{},
+		} {
+			if err := tx.Unscoped().Where("user_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(&models.UserCore{}, ids).Error
+	})
+	if err != nil {
+		return 0, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return len(ids), nil
+}
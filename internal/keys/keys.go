@@ -0,0 +1,195 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+const generatedKeyBits = 2048
+
+// Key is a single signing key, its kid is the pem file name without extension
+type Key struct {
+	Kid     string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeySet holds every key found in auth.keys_dir. Only the active key signs,
+// the others stay valid for verification until their files are removed
+type KeySet interface {
+	Signing() Key
+	Keyfunc(token *jwt.Token) (interface{}, error)
+	JWKS() JWKS
+}
+
+type keySet struct {
+	active Key
+	keys   map[string]Key
+}
+
+func New(m consts.Mode, loggers logger.Loggers) KeySet {
+	dir := viper.GetString("auth.keys_dir")
+
+	keys, err := loadDir(dir)
+	if err != nil {
+		loggers.Err.Fatalf("cannot load signing keys: %v", err)
+	}
+
+	if len(keys) == 0 {
+		if m != consts.Development {
+			loggers.Err.Fatalf("no signing keys found in %s", dir)
+		}
+		key, err := generate(dir)
+		if err != nil {
+			loggers.Err.Fatalf("cannot generate signing key: %v", err)
+		}
+		loggers.Info.Printf("generated development signing key %s", key.Kid)
+		keys[key.Kid] = key
+	}
+
+	activeKid := viper.GetString("auth_active_kid")
+	if activeKid == "" {
+		// without explicit choice the newest kid (kids are sortable dates) signs
+		var kids []string
+		for kid := range keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		activeKid = kids[len(kids)-1]
+	}
+
+	active, ok := keys[activeKid]
+	if !ok {
+		loggers.Err.Fatalf("active signing key %s not found in %s", activeKid, dir)
+	}
+	loggers.Info.Printf("signing tokens with key %s (%s), %d key(s) loaded", active.Kid, active.Method.Alg(), len(keys))
+
+	return &keySet{
+		active: active,
+		keys:   keys,
+	}
+}
+
+func (k *keySet) Signing() Key {
+	return k.active
+}
+
+func (k *keySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no kid header")
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %s", kid)
+	}
+	// the alg must match the key, otherwise a token could pick a weaker method
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %s, expected: %s", token.Method.Alg(), key.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+func loadDir(dir string) (map[string]Key, error) {
+	keys := make(map[string]Key)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keys, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(entry.Name(), ".pem")
+		key, err := parse(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+func parse(kid string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no pem block")
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		return Key{Kid: kid, Method: jwt.SigningMethodRS256, Private: private, Public: &private.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return Key{}, errors.New("only P-256 ecdsa keys are supported")
+		}
+		return Key{Kid: kid, Method: jwt.SigningMethodES256, Private: private, Public: &private.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return Key{Kid: kid, Method: SigningMethodEdDSA, Private: private, Public: private.Public()}, nil
+	}
+	return Key{}, fmt.Errorf("unsupported key type %T", private)
+}
+
+func generate(dir string) (Key, error) {
+	private, err := rsa.GenerateKey(rand.Reader, generatedKeyBits)
+	if err != nil {
+		return Key{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return Key{}, err
+	}
+	kid := time.Now().Format("20060102150405")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600); err != nil {
+		return Key{}, err
+	}
+	return Key{Kid: kid, Method: jwt.SigningMethodRS256, Private: private, Public: &private.PublicKey}, nil
+}
@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+// logMailer does not send anything, letters go to the info log and,
+// when mailer.log_file is set, are appended to that file
+type logMailer struct {
+	loggers logger.Loggers
+	path    string
+	mu      sync.Mutex
+}
+
+func newLogMailer(loggers logger.Loggers, path string) *logMailer {
+	return &logMailer{
+		loggers: loggers,
+		path:    path,
+	}
+}
+
+func (l *logMailer) Send(to, subject, body string) error {
+	letter := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", to, subject, body)
+	l.loggers.Info.Printf("mail:\n%s", letter)
+
+	if l.path == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "=== %s\n%s\n", time.Now().Format(time.DateTime), letter)
+	return err
+}
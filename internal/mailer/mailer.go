@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// New selects the implementation by mailer.driver,
+// development defaults to log and production to smtp
+func New(m consts.Mode, loggers logger.Loggers) Mailer {
+	driver := viper.GetString("mailer.driver")
+	if driver == "" {
+		driver = "smtp"
+		if m == consts.Development {
+			driver = "log"
+		}
+	}
+
+	switch driver {
+	case "smtp":
+		return newSmtpMailer()
+	case "log":
+		return newLogMailer(loggers, viper.GetString("mailer.log_file"))
+	default:
+		loggers.Err.Fatalf("unknown mailer driver %q", driver)
+		return nil
+	}
+}
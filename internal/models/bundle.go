@@ -0,0 +1,168 @@
+package models
+
+// BundleHTTP is the format of the admin import and export. Topics refer to
+// their owner by email and are named without the organization prefix
+type BundleHTTP struct {
+	Users  []BundleUserHTTP  `json:"users"`
+	Topics []BundleTopicHTTP `json:"topics"`
+}
+
+type BundleUserHTTP struct {
+	Email    string `json:"email"`
+	FullName string `json:"full_name"`
+	Role     Role   `json:"role"`
+	// Organization is the slug, empty for users outside of organizations
+	Organization string `json:"organization,omitempty"`
+	// Password is never exported, users imported without it set one through the password reset
+	Password string `json:"password,omitempty"`
+}
+
+type BundleTopicHTTP struct {
+	Owner       string   `json:"owner"`
+	Name        string   `json:"name"`
+	CanRead     bool     `json:"can_read"`
+	CanWrite    bool     `json:"can_write"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Qos         *int     `json:"qos,omitempty"`
+	Retained    *bool    `json:"retained,omitempty"`
+	Contact     string   `json:"contact,omitempty"`
+}
+
+type BundleCore struct {
+	Users  []BundleUserCore
+	Topics []BundleTopicCore
+}
+
+// BundleUserCore and BundleTopicCore keep the row of the source, for csv the line
+// number, for json the position in its list, so errors point at the input
+type BundleUserCore struct {
+	Row          int
+	Email        string
+	FullName     string
+	Role         Role
+	Organization string
+	Password     string
+}
+
+type BundleTopicCore struct {
+	Row         int
+	Owner       string
+	Name        string
+	CanRead     bool
+	CanWrite    bool
+	Description string
+	Tags        []string
+	ContentType string
+	Qos         *int
+	Retained    *bool
+	Contact     string
+}
+
+func (b *BundleHTTP) ToCore() BundleCore {
+	bundleCore := BundleCore{}
+	for i, user := range b.Users {
+		bundleCore.Users = append(bundleCore.Users, BundleUserCore{
+			Row:          i + 1,
+			Email:        user.Email,
+			FullName:     user.FullName,
+			Role:         user.Role,
+			Organization: user.Organization,
+			Password:     user.Password,
+		})
+	}
+	for i, topic := range b.Topics {
+		bundleCore.Topics = append(bundleCore.Topics, BundleTopicCore{
+			Row:         i + 1,
+			Owner:       topic.Owner,
+			Name:        topic.Name,
+			CanRead:     topic.CanRead,
+			CanWrite:    topic.CanWrite,
+			Description: topic.Description,
+			Tags:        topic.Tags,
+			ContentType: topic.ContentType,
+			Qos:         topic.Qos,
+			Retained:    topic.Retained,
+			Contact:     topic.Contact,
+		})
+	}
+	return bundleCore
+}
+
+func (b *BundleHTTP) FromCore(bundleCore BundleCore) {
+	b.Users = []BundleUserHTTP{}
+	b.Topics = []BundleTopicHTTP{}
+	for _, user := range bundleCore.Users {
+		b.Users = append(b.Users, BundleUserHTTP{
+			Email:        user.Email,
+			FullName:     user.FullName,
+			Role:         user.Role,
+			Organization: user.Organization,
+		})
+	}
+	for _, topic := range bundleCore.Topics {
+		b.Topics = append(b.Topics, BundleTopicHTTP{
+			Owner:       topic.Owner,
+			Name:        topic.Name,
+			CanRead:     topic.CanRead,
+			CanWrite:    topic.CanWrite,
+			Description: topic.Description,
+			Tags:        topic.Tags,
+			ContentType: topic.ContentType,
+			Qos:         topic.Qos,
+			Retained:    topic.Retained,
+			Contact:     topic.Contact,
+		})
+	}
+}
+
+const (
+	BundleKindUser  = "user"
+	BundleKindTopic = "topic"
+)
+
+type ImportReportHTTP struct {
+	DryRun bool                 `json:"dry_run"`
+	Users  int                  `json:"users"`
+	Topics int                  `json:"topics"`
+	Errors []ImportRowErrorHTTP `json:"errors"`
+}
+
+type ImportRowErrorHTTP struct {
+	Kind  string `json:"kind"`
+	Row   int    `json:"row"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// ImportReportCore counts the valid rows, which are the created ones unless DryRun.
+// Key of a row error is the email of a user or the owner and name of a topic
+type ImportReportCore struct {
+	DryRun bool
+	Users  int
+	Topics int
+	Errors []ImportRowErrorCore
+}
+
+type ImportRowErrorCore struct {
+	Kind  string
+	Row   int
+	Key   string
+	Error string
+}
+
+func (i *ImportReportHTTP) FromCore(reportCore ImportReportCore) {
+	i.DryRun = reportCore.DryRun
+	i.Users = reportCore.Users
+	i.Topics = reportCore.Topics
+	i.Errors = []ImportRowErrorHTTP{}
+	for _, rowError := range reportCore.Errors {
+		i.Errors = append(i.Errors, ImportRowErrorHTTP{
+			Kind:  rowError.Kind,
+			Row:   rowError.Row,
+			Key:   rowError.Key,
+			Error: rowError.Error,
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// TopicContractCore is the json schema the payloads of a topic must follow,
+// the counters start over when the schema is replaced
+type TopicContractCore struct {
+	ID              uint `gorm:"primaryKey"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	TopicId         uint      `gorm:"not null;uniqueIndex"`
+	Topic           TopicCore `gorm:"foreignKey:TopicId"`
+	Schema          string    `gorm:"not null"`
+	Messages        int64     `gorm:"not null;default:0"`
+	Violations      int64     `gorm:"not null;default:0"`
+	LastViolationAt *time.Time
+}
+
+// TopicViolationCore is a sample of a payload that broke the contract,
+// only the latest ones of a topic are kept
+type TopicViolationCore struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	TopicId   uint `gorm:"not null;index"`
+	// MqttTopic is the topic the message was published to, it differs from
+	// the name of the topic when that has wildcards
+	MqttTopic       string `gorm:"not null"`
+	Payload         string `gorm:"not null"`
+	PayloadEncoding string `gorm:"not null"`
+	Truncated       bool   `gorm:"not null;default:false"`
+	Error           string `gorm:"not null"`
+}
+
+type TopicContractHTTP struct {
+	TopicId         string          `json:"topic_id"`
+	Schema          json.RawMessage `json:"schema"`
+	Messages        int64           `json:"messages"`
+	Violations      int64           `json:"violations"`
+	LastViolationAt string          `json:"last_violation_at"`
+	UpdatedAt       string          `json:"updated_at"`
+}
+
+type TopicViolationHTTP struct {
+	ID              string `json:"id"`
+	CreatedAt       string `json:"created_at"`
+	Topic           string `json:"topic"`
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payload_encoding"`
+	Truncated       bool   `json:"truncated"`
+	Error           string `json:"error"`
+}
+
+func (t *TopicContractHTTP) FromCore(contractCore TopicContractCore) {
+	t.TopicId = strconv.Itoa(int(contractCore.TopicId))
+	t.Schema = json.RawMessage(contractCore.Schema)
+	t.Messages = contractCore.Messages
+	t.Violations = contractCore.Violations
+	if contractCore.LastViolationAt != nil {
+		t.LastViolationAt = contractCore.LastViolationAt.Format(time.DateTime)
+	}
+	t.UpdatedAt = contractCore.UpdatedAt.Format(time.DateTime)
+}
+
+func FromTopicViolationsCore(violationsCore []TopicViolationCore) (violationsHttp []*TopicViolationHTTP) {
+	violationsHttp = []*TopicViolationHTTP{}
+	for _, violationCore := range violationsCore {
+		violationsHttp = append(violationsHttp, &TopicViolationHTTP{
+			ID:              strconv.Itoa(int(violationCore.ID)),
+			CreatedAt:       violationCore.CreatedAt.Format(time.DateTime),
+			Topic:           violationCore.MqttTopic,
+			Payload:         violationCore.Payload,
+			PayloadEncoding: violationCore.PayloadEncoding,
+			Truncated:       violationCore.Truncated,
+			Error:           violationCore.Error,
+		})
+	}
+	return
+}
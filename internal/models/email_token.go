@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type EmailTokenPurpose string
+
+const (
+	EmailTokenVerifyEmail   EmailTokenPurpose = "verify_email"
+	EmailTokenResetPassword EmailTokenPurpose = "reset_password"
+	EmailTokenChangeEmail   EmailTokenPurpose = "change_email"
+	EmailTokenDeleteAccount EmailTokenPurpose = "delete_account"
+)
+
+// EmailTokenCore is a single use token sent by email, only its sha256 is stored
+type EmailTokenCore struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UserId    uint              `gorm:"index"`
+	User      UserCore          `gorm:"foreignKey:UserId"`
+	Purpose   EmailTokenPurpose `gorm:"not null"`
+	TokenHash string            `gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time         `gorm:"not null"`
+	UsedAt    *time.Time
+	// NewEmail is the address being confirmed by a change_email token
+	NewEmail string
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	PayloadEncodingUtf8   = "utf8"
+	PayloadEncodingBase64 = "base64"
+)
+
+// EncodePayload returns the payload as text when it is valid utf-8, in base64 otherwise
+func EncodePayload(payload []byte) (text, encoding string) {
+	if utf8.Valid(payload) {
+		return string(payload), PayloadEncodingUtf8
+	}
+	return base64.StdEncoding.EncodeToString(payload), PayloadEncodingBase64
+}
+
+// DecodePayload reverses EncodePayload, an empty encoding is utf8
+func DecodePayload(text, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", PayloadEncodingUtf8:
+		return []byte(text), nil
+	case PayloadEncodingBase64:
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return nil, errors.New("payload_encoding must be utf8 or base64")
+}
+
+type UserPropertyHTTP struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type UserPropertyCore struct {
+	Key   string
+	Value string
+}
+
+// PublishCore is a message published over http. Topic is the mqtt topic,
+// the name of the topic when empty
+type PublishCore struct {
+	Topic          string
+	Payload        []byte
+	Qos            int
+	Retain         bool
+	UserProperties []UserPropertyCore
+}
+
+const (
+	// PublishOutcomeSent is qos 0, the broker does not answer
+	PublishOutcomeSent          = "sent"
+	PublishOutcomeAccepted      = "accepted"
+	PublishOutcomeNoSubscribers = "no_matching_subscribers"
+	PublishOutcomeRejected      = "rejected"
+)
+
+// PublishResultCore is the answer of the broker, PacketId is 0 for qos 0
+type PublishResultCore struct {
+	Topic      string
+	PacketId   uint16
+	Qos        int
+	Outcome    string
+	ReasonCode byte
+	Reason     string
+}
+
+type PublishResultHTTP struct {
+	Topic      string `json:"topic"`
+	PacketId   uint16 `json:"packet_id"`
+	Qos        int    `json:"qos"`
+	Outcome    string `json:"outcome"`
+	ReasonCode byte   `json:"reason_code"`
+	Reason     string `json:"reason"`
+}
+
+func (p *PublishResultHTTP) FromCore(resultCore PublishResultCore) {
+	p.Topic = resultCore.Topic
+	p.PacketId = resultCore.PacketId
+	p.Qos = resultCore.Qos
+	p.Outcome = resultCore.Outcome
+	p.ReasonCode = resultCore.ReasonCode
+	p.Reason = resultCore.Reason
+}
+
+// MessageCore is a message received from the broker
+type MessageCore struct {
+	Topic          string
+	Payload        []byte
+	Qos            int
+	Retain         bool
+	UserProperties []UserPropertyCore
+	ReceivedAt     time.Time
+}
+
+type MessageHTTP struct {
+	Topic           string             `json:"topic"`
+	Payload         string             `json:"payload"`
+	PayloadEncoding string             `json:"payload_encoding"`
+	Qos             int                `json:"qos"`
+	Retain          bool               `json:"retain"`
+	Timestamp       string             `json:"timestamp"`
+	UserProperties  []UserPropertyHTTP `json:"user_properties"`
+}
+
+func (m *MessageHTTP) FromCore(messageCore MessageCore) {
+	m.Topic = messageCore.Topic
+	m.Payload, m.PayloadEncoding = EncodePayload(messageCore.Payload)
+	m.Qos = messageCore.Qos
+	m.Retain = messageCore.Retain
+	m.Timestamp = messageCore.ReceivedAt.Format(time.RFC3339Nano)
+	m.UserProperties = []UserPropertyHTTP{}
+	for _, property := range messageCore.UserProperties {
+		m.UserProperties = append(m.UserProperties, UserPropertyHTTP{Key: property.Key, Value: property.Value})
+	}
+}
+
+// RetainedMessageCore is a retained message of the broker, Payload is cut to
+// a preview in listings, Size is the full length
+type RetainedMessageCore struct {
+	MessageCore
+	Size      int
+	Truncated bool
+}
+
+type RetainedMessageHTTP struct {
+	MessageHTTP
+	Size      int  `json:"size"`
+	Truncated bool `json:"truncated"`
+}
+
+func (r *RetainedMessageHTTP) FromCore(retainedCore RetainedMessageCore) {
+	r.MessageHTTP.FromCore(retainedCore.MessageCore)
+	r.Size = retainedCore.Size
+	r.Truncated = retainedCore.Truncated
+}
+
+func FromRetainedMessagesCore(retainedCore []RetainedMessageCore) (retainedHttp []*RetainedMessageHTTP) {
+	retainedHttp = []*RetainedMessageHTTP{}
+	for _, messageCore := range retainedCore {
+		messageHttp := &RetainedMessageHTTP{}
+		messageHttp.FromCore(messageCore)
+		retainedHttp = append(retainedHttp, messageHttp)
+	}
+	return
+}
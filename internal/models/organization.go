@@ -0,0 +1,56 @@
+package models
+
+import (
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type OrganizationHTTP struct {
+	ID        string `json:"id"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	Name      string `json:"name"`
+	Slug      string `json:"slug"`
+}
+
+// OrganizationCore is a tenant. Slug is the first level of every topic of its
+// users in the acl, so it never changes after creation
+type OrganizationCore struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	Name      string         `gorm:"not null"`
+	Slug      string         `gorm:"not null;uniqueIndex"`
+}
+
+func (o *OrganizationHTTP) ToCore() OrganizationCore {
+	return OrganizationCore{
+		Name: o.Name,
+		Slug: o.Slug,
+	}
+}
+
+func (o *OrganizationHTTP) FromCore(organizationCore OrganizationCore) {
+	o.ID = strconv.Itoa(int(organizationCore.ID))
+	o.CreatedAt = organizationCore.CreatedAt.Format(time.DateTime)
+	o.UpdatedAt = organizationCore.UpdatedAt.Format(time.DateTime)
+	o.Name = organizationCore.Name
+	o.Slug = organizationCore.Slug
+}
+
+func FromOrganizationsCore(organizationsCore []OrganizationCore) (organizationsHttp []*OrganizationHTTP) {
+	for _, organizationCore := range organizationsCore {
+		var tmpOrganizationHttp OrganizationHTTP
+		tmpOrganizationHttp.FromCore(organizationCore)
+		organizationsHttp = append(organizationsHttp, &tmpOrganizationHttp)
+	}
+	return
+}
+
+// TopicPrefix is prepended to the topic names of the organization users
+func (o OrganizationCore) TopicPrefix() string {
+	return o.Slug + "/"
+}
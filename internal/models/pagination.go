@@ -0,0 +1,24 @@
+package models
+
+// PaginationHTTP is returned next to every paged list. NextCursor is set when
+// more rows follow a keyset page, Page is 0 then
+type PaginationHTTP struct {
+	Total      uint   `json:"total"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"page_size"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type PaginationCore struct {
+	Total      uint
+	Page       int
+	PageSize   int
+	NextCursor string
+}
+
+func (p *PaginationHTTP) FromCore(paginationCore PaginationCore) {
+	p.Total = paginationCore.Total
+	p.Page = paginationCore.Page
+	p.PageSize = paginationCore.PageSize
+	p.NextCursor = paginationCore.NextCursor
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+type Permission string
+
+// permissions without the :any suffix are limited to the caller's own records
+const (
+	PermissionProfileRead              Permission = "profile:read"
+	PermissionProfileWrite             Permission = "profile:write"
+	PermissionUsersReadAny             Permission = "users:read:any"
+	PermissionUsersWriteAny            Permission = "users:write:any"
+	PermissionTopicsRead               Permission = "topics:read"
+	PermissionTopicsReadAny            Permission = "topics:read:any"
+	PermissionTopicsWrite              Permission = "topics:write"
+	PermissionTopicsWriteAny           Permission = "topics:write:any"
+	PermissionBrokerControl            Permission = "broker:control"
+	PermissionServiceAccountsManage    Permission = "service_accounts:manage"
+	PermissionServiceAccountsManageAny Permission = "service_accounts:manage:any"
+	PermissionRolesManage              Permission = "roles:manage"
+	PermissionOrganizationsManage      Permission = "organizations:manage"
+	PermissionRetainedClearAny         Permission = "retained:clear:any"
+)
+
+var Permissions = []Permission{
+	PermissionProfileRead,
+	PermissionProfileWrite,
+	PermissionUsersReadAny,
+	PermissionUsersWriteAny,
+	PermissionTopicsRead,
+	PermissionTopicsReadAny,
+	PermissionTopicsWrite,
+	PermissionTopicsWriteAny,
+	PermissionBrokerControl,
+	PermissionServiceAccountsManage,
+	PermissionServiceAccountsManageAny,
+	PermissionRolesManage,
+	PermissionOrganizationsManage,
+	PermissionRetainedClearAny,
+}
+
+// DefaultRolePermissions is seeded into the db for roles that have no rows yet,
+// afterwards the mapping is edited through the role endpoints
+var DefaultRolePermissions = map[Role][]Permission{
+	RoleAnonymous: {},
+	RoleUser: {
+		PermissionProfileRead,
+		PermissionProfileWrite,
+		PermissionTopicsRead,
+		PermissionTopicsWrite,
+		PermissionBrokerControl,
+		PermissionServiceAccountsManage,
+	},
+	RoleOperator: {
+		PermissionProfileRead,
+		PermissionProfileWrite,
+		PermissionTopicsRead,
+		PermissionBrokerControl,
+	},
+	RoleAuditor: {
+		PermissionProfileRead,
+		PermissionProfileWrite,
+		PermissionUsersReadAny,
+		PermissionTopicsRead,
+		PermissionTopicsReadAny,
+	},
+	RoleTeacher: {
+		PermissionProfileRead,
+		PermissionProfileWrite,
+		PermissionTopicsRead,
+		PermissionTopicsWrite,
+		PermissionServiceAccountsManage,
+	},
+	// the :any permissions of a user in an organization reach only that organization
+	RoleOrgAdmin: {
+		PermissionProfileRead,
+		PermissionProfileWrite,
+		PermissionUsersReadAny,
+		PermissionUsersWriteAny,
+		PermissionTopicsRead,
+		PermissionTopicsReadAny,
+		PermissionTopicsWrite,
+		PermissionTopicsWriteAny,
+		PermissionServiceAccountsManage,
+	},
+	RoleSuperAdmin: Permissions,
+}
+
+func (p Permission) String() string {
+	return string(p)
+}
+
+// Covers reports whether an api key scope grants the permission,
+// topics:read covers topics:read and topics:read:any
+func (s Scope) Covers(permission Permission) bool {
+	return permission.String() == s.String() || strings.HasPrefix(permission.String(), s.String()+":")
+}
+
+type RolePermissionHTTP struct {
+	Role        Role     `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+type RolePermissionCore struct {
+	ID         uint `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	Role       Role       `gorm:"not null;uniqueIndex:idx_role_permission"`
+	Permission Permission `gorm:"not null;uniqueIndex:idx_role_permission"`
+}
+
+func FromRolePermissionsCore(rolePermissionsCore []RolePermissionCore) (rolePermissionsHttp []*RolePermissionHTTP) {
+	byRole := make(map[Role]*RolePermissionHTTP)
+	for _, role := range Roles {
+		byRole[role] = &RolePermissionHTTP{Role: role, Permissions: []string{}}
+		rolePermissionsHttp = append(rolePermissionsHttp, byRole[role])
+	}
+	for _, rolePermissionCore := range rolePermissionsCore {
+		if rolePermissionHttp, ok := byRole[rolePermissionCore.Role]; ok {
+			rolePermissionHttp.Permissions = append(rolePermissionHttp.Permissions, rolePermissionCore.Permission.String())
+		}
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package models
+
+import "time"
+
+// Quota limits what a user may own, zero means unlimited
+type Quota struct {
+	MaxTopics      int `json:"max_topics" mapstructure:"max_topics"`
+	MaxCredentials int `json:"max_credentials" mapstructure:"max_credentials"`
+	MaxGrants      int `json:"max_grants" mapstructure:"max_grants"`
+	MaxTopicDepth  int `json:"max_topic_depth" mapstructure:"max_topic_depth"`
+}
+
+// QuotaOverrideCore replaces single limits of the role quota for one user,
+// nil fields keep the role value
+type QuotaOverrideCore struct {
+	ID             uint `gorm:"primaryKey"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	UserId         uint     `gorm:"not null;uniqueIndex"`
+	User           UserCore `gorm:"foreignKey:UserId"`
+	MaxTopics      *int
+	MaxCredentials *int
+	MaxGrants      *int
+	MaxTopicDepth  *int
+}
+
+// QuotaUsage counts what the user owns: topics, api keys of the service
+// accounts and topics granting read or write in the acl
+type QuotaUsage struct {
+	Topics      int
+	Credentials int
+	Grants      int
+}
+
+type QuotaOverrideHTTP struct {
+	MaxTopics      *int `json:"max_topics"`
+	MaxCredentials *int `json:"max_credentials"`
+	MaxGrants      *int `json:"max_grants"`
+	MaxTopicDepth  *int `json:"max_topic_depth"`
+}
+
+type QuotaLimitHTTP struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+type QuotaHTTP struct {
+	Topics        QuotaLimitHTTP `json:"topics"`
+	Credentials   QuotaLimitHTTP `json:"credentials"`
+	Grants        QuotaLimitHTTP `json:"grants"`
+	MaxTopicDepth int            `json:"max_topic_depth"`
+}
+
+func (q *QuotaOverrideHTTP) ToCore(userId uint) QuotaOverrideCore {
+	return QuotaOverrideCore{
+		UserId:         userId,
+		MaxTopics:      q.MaxTopics,
+		MaxCredentials: q.MaxCredentials,
+		MaxGrants:      q.MaxGrants,
+		MaxTopicDepth:  q.MaxTopicDepth,
+	}
+}
+
+func (q *QuotaHTTP) FromCore(quota Quota, usage QuotaUsage) {
+	q.Topics = QuotaLimitHTTP{Used: usage.Topics, Limit: quota.MaxTopics}
+	q.Credentials = QuotaLimitHTTP{Used: usage.Credentials, Limit: quota.MaxCredentials}
+	q.Grants = QuotaLimitHTTP{Used: usage.Grants, Limit: quota.MaxGrants}
+	q.MaxTopicDepth = quota.MaxTopicDepth
+}
+
+// Apply returns the quota with the set fields of the override
+func (o QuotaOverrideCore) Apply(quota Quota) Quota {
+	if o.MaxTopics != nil {
+		quota.MaxTopics = *o.MaxTopics
+	}
+	if o.MaxCredentials != nil {
+		quota.MaxCredentials = *o.MaxCredentials
+	}
+	if o.MaxGrants != nil {
+		quota.MaxGrants = *o.MaxGrants
+	}
+	if o.MaxTopicDepth != nil {
+		quota.MaxTopicDepth = *o.MaxTopicDepth
+	}
+	return quota
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// RateLimitBucketCore is used only by the postgres rate limiter backend
+type RateLimitBucketCore struct {
+	Key       string    `gorm:"primaryKey"`
+	Tokens    float64   `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// RecoveryCodeCore is a one-time 2fa code, only its sha256 is stored
+type RecoveryCodeCore struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UserId    uint     `gorm:"index"`
+	User      UserCore `gorm:"foreignKey:UserId"`
+	CodeHash  string   `gorm:"not null"`
+	UsedAt    *time.Time
+}
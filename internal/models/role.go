@@ -5,9 +5,23 @@ type Role string
 const (
 	RoleAnonymous  Role = "Anonymous"
 	RoleUser       Role = "User"
+	RoleOperator   Role = "Operator"
+	RoleAuditor    Role = "Auditor"
+	RoleTeacher    Role = "Teacher"
+	RoleOrgAdmin   Role = "OrgAdmin"
 	RoleSuperAdmin Role = "SuperAdmin"
 )
 
+var Roles = []Role{
+	RoleAnonymous,
+	RoleUser,
+	RoleOperator,
+	RoleAuditor,
+	RoleTeacher,
+	RoleOrgAdmin,
+	RoleSuperAdmin,
+}
+
 func (e Role) String() string {
 	return string(e)
 }
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Scope string
+
+const (
+	ScopeTopicsRead    Scope = "topics:read"
+	ScopeTopicsWrite   Scope = "topics:write"
+	ScopeBrokerControl Scope = "broker:control"
+)
+
+var Scopes = []Scope{
+	ScopeTopicsRead,
+	ScopeTopicsWrite,
+	ScopeBrokerControl,
+}
+
+func (s Scope) String() string {
+	return string(s)
+}
+
+type ServiceAccountHTTP struct {
+	ID        string `json:"id"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	UserId    string `json:"user_id"`
+	Name      string `json:"name"`
+}
+
+type ServiceAccountCore struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	UserId    uint
+	User      UserCore `gorm:"foreignKey:UserId"`
+	Name      string   `gorm:"not null"`
+}
+
+func (s *ServiceAccountHTTP) FromCore(serviceAccountCore ServiceAccountCore) {
+	s.ID = strconv.Itoa(int(serviceAccountCore.ID))
+	s.CreatedAt = serviceAccountCore.CreatedAt.Format(time.DateTime)
+	s.UpdatedAt = serviceAccountCore.UpdatedAt.Format(time.DateTime)
+	s.UserId = strconv.Itoa(int(serviceAccountCore.UserId))
+	s.Name = serviceAccountCore.Name
+}
+
+func FromServiceAccountsCore(serviceAccountsCore []ServiceAccountCore) (serviceAccountsHttp []*ServiceAccountHTTP) {
+	for _, serviceAccountCore := range serviceAccountsCore {
+		var tmpServiceAccountHttp ServiceAccountHTTP
+		tmpServiceAccountHttp.FromCore(serviceAccountCore)
+		serviceAccountsHttp = append(serviceAccountsHttp, &tmpServiceAccountHttp)
+	}
+	return
+}
+
+type ApiKeyHTTP struct {
+	ID               string   `json:"id"`
+	CreatedAt        string   `json:"created_at"`
+	ServiceAccountId string   `json:"service_account_id"`
+	Prefix           string   `json:"prefix"`
+	Scopes           []string `json:"scopes"`
+	ExpiresAt        string   `json:"expires_at"`
+	LastUsedAt       string   `json:"last_used_at"`
+}
+
+// ApiKeyCore keeps only the sha256 of the key, the plain key is shown once on creation.
+// Prefix is the public part of the key used to find the row
+type ApiKeyCore struct {
+	ID               uint `gorm:"primaryKey"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	DeletedAt        gorm.DeletedAt `gorm:"index"`
+	ServiceAccountId uint
+	ServiceAccount   ServiceAccountCore `gorm:"foreignKey:ServiceAccountId"`
+	Prefix           string             `gorm:"not null;uniqueIndex"`
+	KeyHash          string             `gorm:"not null"`
+	Scopes           []Scope            `gorm:"not null;serializer:json"`
+	ExpiresAt        *time.Time
+	LastUsedAt       *time.Time
+}
+
+func (a *ApiKeyHTTP) FromCore(apiKeyCore ApiKeyCore) {
+	a.ID = strconv.Itoa(int(apiKeyCore.ID))
+	a.CreatedAt = apiKeyCore.CreatedAt.Format(time.DateTime)
+	a.ServiceAccountId = strconv.Itoa(int(apiKeyCore.ServiceAccountId))
+	a.Prefix = apiKeyCore.Prefix
+	a.Scopes = []string{}
+	for _, scope := range apiKeyCore.Scopes {
+		a.Scopes = append(a.Scopes, scope.String())
+	}
+	if apiKeyCore.ExpiresAt != nil {
+		a.ExpiresAt = apiKeyCore.ExpiresAt.Format(time.DateTime)
+	}
+	if apiKeyCore.LastUsedAt != nil {
+		a.LastUsedAt = apiKeyCore.LastUsedAt.Format(time.DateTime)
+	}
+}
+
+func FromApiKeysCore(apiKeysCore []ApiKeyCore) (apiKeysHttp []*ApiKeyHTTP) {
+	for _, apiKeyCore := range apiKeysCore {
+		var tmpApiKeyHttp ApiKeyHTTP
+		tmpApiKeyHttp.FromCore(apiKeyCore)
+		apiKeysHttp = append(apiKeysHttp, &tmpApiKeyHttp)
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"sort"
 	"strconv"
 	"time"
 
@@ -16,6 +17,14 @@ type TopicHTTP struct {
 	Password  string `json:"password"`
 	CanRead   bool   `json:"can_read"`
 	CanWrite  bool   `json:"can_write"`
+	// OrganizationId is empty for topics outside of organizations
+	OrganizationId string   `json:"organization_id"`
+	Description    string   `json:"description"`
+	Tags           []string `json:"tags"`
+	ContentType    string   `json:"content_type"`
+	Qos            *int     `json:"qos"`
+	Retained       *bool    `json:"retained"`
+	Contact        string   `json:"contact"`
 }
 
 type TopicCore struct {
@@ -29,6 +38,70 @@ type TopicCore struct {
 	Password  string   `gorm:"not null"`
 	CanRead   bool     `gorm:"not null;default:false"`
 	CanWrite  bool     `gorm:"not null;default:false"`
+	// OrganizationId is copied from the owner, Name then starts with the organization slug
+	OrganizationId *uint `gorm:"index"`
+	// the metadata documents the topic for its consumers, the broker does not enforce it
+	Description string         `gorm:"not null;default:''"`
+	Tags        []TopicTagCore `gorm:"foreignKey:TopicId"`
+	ContentType string         `gorm:"not null;default:''"`
+	// Qos is the recommended quality of service, nil when not set
+	Qos *int
+	// Retained tells whether publishers are expected to set the retain flag, nil when not set
+	Retained *bool
+	Contact  string `gorm:"not null;default:''"`
+}
+
+type TopicTagCore struct {
+	ID      uint   `gorm:"primaryKey"`
+	TopicId uint   `gorm:"not null;uniqueIndex:idx_topic_tag"`
+	Tag     string `gorm:"not null;uniqueIndex:idx_topic_tag;index"`
+}
+
+type TopicTagHTTP struct {
+	Tag    string `json:"tag"`
+	Topics int    `json:"topics"`
+}
+
+// TopicTagCountCore is a tag in use and the number of topics having it
+type TopicTagCountCore struct {
+	Tag    string
+	Topics int
+}
+
+func FromTopicTagsCore(tagsCore []TopicTagCountCore) (tagsHttp []*TopicTagHTTP) {
+	tagsHttp = []*TopicTagHTTP{}
+	for _, tagCore := range tagsCore {
+		tagsHttp = append(tagsHttp, &TopicTagHTTP{Tag: tagCore.Tag, Topics: tagCore.Topics})
+	}
+	return
+}
+
+const (
+	ContentTypeJson     = "json"
+	ContentTypeText     = "text"
+	ContentTypeBinary   = "binary"
+	ContentTypeProtobuf = "protobuf"
+)
+
+var ContentTypes = []string{ContentTypeJson, ContentTypeText, ContentTypeBinary, ContentTypeProtobuf}
+
+// TagNames returns the tags of the topic sorted
+func (t *TopicCore) TagNames() []string {
+	tags := make([]string, 0, len(t.Tags))
+	for _, tag := range t.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// SetTags replaces the tags of a topic that is not saved yet, or of one
+// whose tags the gateway rewrites
+func (t *TopicCore) SetTags(tags []string) {
+	t.Tags = make([]TopicTagCore, 0, len(tags))
+	for _, tag := range tags {
+		t.Tags = append(t.Tags, TopicTagCore{TopicId: t.ID, Tag: tag})
+	}
 }
 
 func (t *TopicHTTP) ToCore() TopicCore {
@@ -49,6 +122,15 @@ func (t *TopicHTTP) FromCore(topicCore TopicCore) {
 	t.Password = topicCore.Password
 	t.CanRead = topicCore.CanRead
 	t.CanWrite = topicCore.CanWrite
+	if topicCore.OrganizationId != nil {
+		t.OrganizationId = strconv.Itoa(int(*topicCore.OrganizationId))
+	}
+	t.Description = topicCore.Description
+	t.Tags = topicCore.TagNames()
+	t.ContentType = topicCore.ContentType
+	t.Qos = topicCore.Qos
+	t.Retained = topicCore.Retained
+	t.Contact = topicCore.Contact
 }
 
 func FromTopicsCore(topicsCore []TopicCore) (topicsHttp []*TopicHTTP) {
@@ -59,3 +141,44 @@ func FromTopicsCore(topicsCore []TopicCore) (topicsHttp []*TopicHTTP) {
 	}
 	return
 }
+
+const (
+	TopicSortId        = "id"
+	TopicSortName      = "name"
+	TopicSortCreatedAt = "created_at"
+)
+
+var TopicSorts = []string{TopicSortId, TopicSortName, TopicSortCreatedAt}
+
+const (
+	TopicPermissionRead  = "read"
+	TopicPermissionWrite = "write"
+	TopicPermissionNone  = "none"
+)
+
+// TopicFilter narrows a topic listing, zero fields do not filter
+type TopicFilter struct {
+	NamePrefix string
+	// NameContains matches the name or the description
+	NameContains string
+	// Tags are all required
+	Tags           []string
+	ContentType    string
+	UserId         *uint
+	OrganizationId *uint
+	// Permission is read or write for topics granting it, none for topics without grants
+	Permission  string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+}
+
+// TopicQuery is a page of a filtered listing. After is the last topic of the
+// previous keyset page, Offset is ignored with it
+type TopicQuery struct {
+	Filter TopicFilter
+	Sort   string
+	Desc   bool
+	Offset int
+	Limit  int
+	After  *TopicCore
+}
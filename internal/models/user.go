@@ -16,6 +16,11 @@ type UserHTTP struct {
 	Role        Role   `json:"role"`
 	FullName    string `json:"full_name"`
 	MosquittoOn bool   `json:"mosquitto_on"`
+	TotpEnabled bool   `json:"totp_enabled"`
+	Disabled    bool   `json:"disabled"`
+	// OrganizationId is empty for users outside of organizations
+	OrganizationId        string `json:"organization_id"`
+	PasswordResetRequired bool   `json:"password_reset_required"`
 }
 
 type UserCore struct {
@@ -28,6 +33,31 @@ type UserCore struct {
 	Role        Role           `gorm:"not null;"`
 	FullName    string         `gorm:"not null;"`
 	MosquittoOn bool           `gorm:"not null;default:false"`
+	// FailedSignIns counts wrong passwords in a row, reset by a successful sign in
+	FailedSignIns int `gorm:"not null;default:0"`
+	LockedUntil   *time.Time
+	// TotpSecret is set on enrolment, TotpEnabled only after the first valid code
+	TotpSecret   string
+	TotpEnabled  bool  `gorm:"not null;default:false"`
+	TotpLastStep int64 `gorm:"not null;default:0"`
+	// PendingVerification users have no broker credentials yet, their mosquitto
+	// password hash waits in BrokerPasswordHash until the email is confirmed
+	PendingVerification bool `gorm:"not null;default:false"`
+	BrokerPasswordHash  string
+	// refresh tokens issued before SessionsRevokedAt are rejected
+	SessionsRevokedAt *time.Time
+	// OidcSubject is the issuer and sub of the linked single sign-on account
+	OidcSubject *string `gorm:"uniqueIndex"`
+	// Disabled users keep their rows but lose the broker credentials,
+	// the passwordfile hash is kept in BrokerPasswordHash to restore them
+	Disabled bool `gorm:"not null;default:false"`
+	// OrganizationId is nil for users outside of organizations, who with :any
+	// permissions reach every organization
+	OrganizationId *uint            `gorm:"index"`
+	Organization   OrganizationCore `gorm:"foreignKey:OrganizationId"`
+	// PasswordResetRequired users were taken over from a broker passwordfile,
+	// only their mosquitto hash is known until they set a password
+	PasswordResetRequired bool `gorm:"not null;default:false"`
 }
 
 func (u *UserHTTP) ToCore() UserCore {
@@ -49,6 +79,12 @@ func (u *UserHTTP) FromCore(userCore UserCore) {
 	u.FullName = userCore.FullName
 	u.Role = userCore.Role
 	u.MosquittoOn = userCore.MosquittoOn
+	u.TotpEnabled = userCore.TotpEnabled
+	u.Disabled = userCore.Disabled
+	u.PasswordResetRequired = userCore.PasswordResetRequired
+	if userCore.OrganizationId != nil {
+		u.OrganizationId = strconv.Itoa(int(*userCore.OrganizationId))
+	}
 }
 
 func FromUsersCore(usersCore []UserCore) (usersHttp []*UserHTTP) {
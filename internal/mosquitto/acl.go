@@ -0,0 +1,83 @@
+package mosquitto
+
+import (
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// AclUser is a user block of the acl file as stored in the db.
+// Line is set only when the block was parsed from a file
+type AclUser struct {
+	Line     int
+	Username string
+	Topics   []AclTopic
+}
+
+type AclTopic struct {
+	Line     int
+	Name     string
+	CanRead  bool
+	CanWrite bool
+}
+
+// RenderAcl returns the acl file with the user blocks replaced by users and the
+// block of the service user, lines outside user blocks like pattern rules are kept
+func (m *mosquitto) RenderAcl(users []AclUser) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.renderAcl(users)
+}
+
+// WriteAcl replaces the user blocks of the acl file in one write
+func (m *mosquitto) WriteAcl(users []AclUser) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines, err := m.renderAcl(users)
+	if err != nil {
+		return err
+	}
+	return m.writeAclAtomic(aclPath(), lines)
+}
+
+func (m *mosquitto) renderAcl(users []AclUser) ([]string, error) {
+	lines, err := m.readAcl(aclPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var result []string
+	inUser := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "user ") || strings.HasPrefix(line, "pattern ") {
+			inUser = strings.HasPrefix(line, "user ")
+		}
+		if inUser {
+			continue
+		}
+		result = append(result, line)
+	}
+	for len(result) > 0 && result[len(result)-1] == "" {
+		result = result[:len(result)-1]
+	}
+
+	for _, user := range users {
+		result = append(result, "", "user "+user.Username)
+		for _, topic := range user.Topics {
+			if perm := permission(topic.CanRead, topic.CanWrite); perm != "" {
+				result = append(result, "topic "+perm+" "+topic.Name)
+			}
+		}
+	}
+	if username := ServiceUsername(); username != "" {
+		result = append(result, serviceAclBlock(username)...)
+	}
+	return result, nil
+}
+
+func aclPath() string {
+	return viper.GetString("mosquitto_dir_file") + "mosquitto.acl"
+}
@@ -0,0 +1,169 @@
+package mosquitto
+
+import (
+	"os"
+	"strings"
+)
+
+// Installation is what the passwordfile and the acl of a broker maintained
+// by hand hold, in the shape this service keeps them
+type Installation struct {
+	PasswdFile string
+	AclFile    string
+	Passwd     []PasswdEntry
+	Acl        []AclUser
+	Problems   []LineProblem
+}
+
+type PasswdEntry struct {
+	Line         int
+	Username     string
+	PasswordHash string
+}
+
+// LineProblem is a line that cannot be taken over, it stays in the file.
+// Text of a passwordfile line keeps the username only
+type LineProblem struct {
+	File   string
+	Line   int
+	Text   string
+	Reason string
+}
+
+// ReadInstallation parses the passwordfile and the acl, empty paths are the
+// files of the broker. Missing files are read as empty
+func (m *mosquitto) ReadInstallation(passwdFile, aclFile string) (Installation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if passwdFile == "" {
+		passwdFile = passwdPath()
+	}
+	if aclFile == "" {
+		aclFile = aclPath()
+	}
+
+	installation := Installation{PasswdFile: passwdFile, AclFile: aclFile}
+	lines, err := m.readAcl(passwdFile)
+	if err != nil && !os.IsNotExist(err) {
+		return Installation{}, err
+	}
+	installation.Passwd, installation.Problems = parsePasswd(passwdFile, lines)
+
+	lines, err = m.readAcl(aclFile)
+	if err != nil && !os.IsNotExist(err) {
+		return Installation{}, err
+	}
+	var problems []LineProblem
+	installation.Acl, problems = parseAcl(aclFile, lines)
+	installation.Problems = append(installation.Problems, problems...)
+	return installation, nil
+}
+
+func parsePasswd(file string, lines []string) ([]PasswdEntry, []LineProblem) {
+	var entries []PasswdEntry
+	var problems []LineProblem
+	seen := make(map[string]bool)
+	for i, line := range lines {
+		text := strings.TrimSpace(line)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, passwordHash, found := strings.Cut(text, ":")
+		problem := LineProblem{File: file, Line: i + 1, Text: username + ":..."}
+		if !found {
+			// the whole line may be a password pasted by hand
+			problem.Text = "..."
+		}
+
+		switch {
+		case !found || username == "" || passwordHash == "":
+			problem.Reason = "not a username:hash entry"
+		case !strings.HasPrefix(passwordHash, "$6$") && !strings.HasPrefix(passwordHash, "$7$"):
+			problem.Reason = "unsupported hash, only $6$ and $7$ are known to mosquitto"
+		case seen[username]:
+			problem.Reason = "duplicate username"
+		default:
+			seen[username] = true
+			entries = append(entries, PasswdEntry{Line: i + 1, Username: username, PasswordHash: passwordHash})
+			continue
+		}
+		problems = append(problems, problem)
+	}
+	return entries, problems
+}
+
+// parseAcl takes the user blocks over. Like the rest of the package a pattern
+// line ends the block, topics outside of user blocks apply to anonymous clients
+// and deny rules have no counterpart in the db, they are reported
+func parseAcl(file string, lines []string) ([]AclUser, []LineProblem) {
+	var users []AclUser
+	var problems []LineProblem
+	byUsername := make(map[string]int)
+	current := -1
+	for i, line := range lines {
+		text := strings.TrimSpace(line)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		problem := LineProblem{File: file, Line: i + 1, Text: line}
+
+		keyword, rest, _ := strings.Cut(text, " ")
+		rest = strings.TrimSpace(rest)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				problem.Reason = "user without a name"
+				break
+			}
+			index, found := byUsername[rest]
+			if !found {
+				index = len(users)
+				byUsername[rest] = index
+				users = append(users, AclUser{Line: i + 1, Username: rest})
+			}
+			current = index
+			continue
+		case "pattern":
+			current = -1
+			problem.Reason = "pattern rules are not imported"
+		case "topic":
+			if current < 0 {
+				problem.Reason = "topic outside of a user block"
+				break
+			}
+			topic, reason := parseAclTopic(rest)
+			if reason != "" {
+				problem.Reason = reason
+				break
+			}
+			topic.Line = i + 1
+			users[current].Topics = append(users[current].Topics, topic)
+			continue
+		default:
+			problem.Reason = "unknown statement"
+		}
+		problems = append(problems, problem)
+	}
+	return users, problems
+}
+
+// parseAclTopic reads "[read|write|readwrite|deny] name", mosquitto takes
+// the rest of the line as the name
+func parseAclTopic(rest string) (AclTopic, string) {
+	access, name, found := strings.Cut(rest, " ")
+	name = strings.TrimSpace(name)
+	switch {
+	case found && access == "read":
+		return AclTopic{Name: name, CanRead: true}, ""
+	case found && access == "write":
+		return AclTopic{Name: name, CanWrite: true}, ""
+	case found && access == "readwrite":
+		return AclTopic{Name: name, CanRead: true, CanWrite: true}, ""
+	case found && access == "deny":
+		return AclTopic{}, "deny rules are not imported"
+	case rest == "":
+		return AclTopic{}, "topic without a name"
+	}
+	return AclTopic{Name: rest, CanRead: true, CanWrite: true}, ""
+}
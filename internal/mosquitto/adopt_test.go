@@ -0,0 +1,182 @@
+package mosquitto
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	sha512Hash = "$6$c2FsdA==$aGFzaA=="
+	pbkdf2Hash = "$7$101$c2FsdA==$aGFzaA=="
+)
+
+func TestParsePasswd(t *testing.T) {
+	cases := []struct {
+		name   string
+		line   string
+		entry  *PasswdEntry
+		text   string
+		reason string
+	}{
+		{"sha512", "a@example.com:" + sha512Hash, &PasswdEntry{Line: 1, Username: "a@example.com", PasswordHash: sha512Hash}, "", ""},
+		{"pbkdf2", "a@example.com:" + pbkdf2Hash, &PasswdEntry{Line: 1, Username: "a@example.com", PasswordHash: pbkdf2Hash}, "", ""},
+		{"spaces around", "  a@example.com:" + sha512Hash + "  ", &PasswdEntry{Line: 1, Username: "a@example.com", PasswordHash: sha512Hash}, "", ""},
+		{"comment", "# a@example.com:" + sha512Hash, nil, "", ""},
+		{"blank", "   ", nil, "", ""},
+		{"no colon", "hunter2", nil, "...", "not a username:hash entry"},
+		{"no username", ":" + sha512Hash, nil, ":...", "not a username:hash entry"},
+		{"no hash", "a@example.com:", nil, "a@example.com:...", "not a username:hash entry"},
+		{"plain password", "a@example.com:hunter2", nil, "a@example.com:...", "unsupported hash, only $6$ and $7$ are known to mosquitto"},
+		{"bcrypt", "a@example.com:$2y$10$abc", nil, "a@example.com:...", "unsupported hash, only $6$ and $7$ are known to mosquitto"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entries, problems := parsePasswd("passwd", []string{c.line})
+			if c.entry == nil && len(entries) != 0 {
+				t.Errorf("entries = %+v, want none", entries)
+			}
+			if c.entry != nil && (len(entries) != 1 || entries[0] != *c.entry) {
+				t.Errorf("entries = %+v, want %+v", entries, *c.entry)
+			}
+			if c.reason == "" {
+				if len(problems) != 0 {
+					t.Errorf("problems = %+v, want none", problems)
+				}
+				return
+			}
+			want := LineProblem{File: "passwd", Line: 1, Text: c.text, Reason: c.reason}
+			if len(problems) != 1 || problems[0] != want {
+				t.Errorf("problems = %+v, want %+v", problems, want)
+			}
+		})
+	}
+}
+
+func TestParsePasswdDuplicate(t *testing.T) {
+	lines := []string{
+		"a@example.com:" + sha512Hash,
+		"",
+		"a@example.com:" + pbkdf2Hash,
+	}
+	entries, problems := parsePasswd("passwd", lines)
+	if len(entries) != 1 || entries[0].PasswordHash != sha512Hash {
+		t.Errorf("entries = %+v, want the first entry only", entries)
+	}
+	want := []LineProblem{{File: "passwd", Line: 3, Text: "a@example.com:...", Reason: "duplicate username"}}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %+v, want %+v", problems, want)
+	}
+	for _, problem := range problems {
+		if strings.Contains(problem.Text, "$") {
+			t.Errorf("problem text %q carries the hash", problem.Text)
+		}
+	}
+}
+
+func TestParseAclTopic(t *testing.T) {
+	cases := []struct {
+		rest   string
+		topic  AclTopic
+		reason string
+	}{
+		{"read a/b", AclTopic{Name: "a/b", CanRead: true}, ""},
+		{"write a/b", AclTopic{Name: "a/b", CanWrite: true}, ""},
+		{"readwrite a/b", AclTopic{Name: "a/b", CanRead: true, CanWrite: true}, ""},
+		{"read a b/c", AclTopic{Name: "a b/c", CanRead: true}, ""},
+		{"read   a/b", AclTopic{Name: "a/b", CanRead: true}, ""},
+		{"a/b", AclTopic{Name: "a/b", CanRead: true, CanWrite: true}, ""},
+		{"a/b c", AclTopic{Name: "a/b c", CanRead: true, CanWrite: true}, ""},
+		{"read", AclTopic{Name: "read", CanRead: true, CanWrite: true}, ""},
+		{"deny a/b", AclTopic{}, "deny rules are not imported"},
+		{"", AclTopic{}, "topic without a name"},
+	}
+	for _, c := range cases {
+		topic, reason := parseAclTopic(c.rest)
+		if topic != c.topic || reason != c.reason {
+			t.Errorf("parseAclTopic(%q) = %+v, %q, want %+v, %q", c.rest, topic, reason, c.topic, c.reason)
+		}
+	}
+}
+
+func TestParseAcl(t *testing.T) {
+	cases := []struct {
+		name     string
+		lines    []string
+		users    []AclUser
+		problems []LineProblem
+	}{
+		{
+			name:  "user block",
+			lines: []string{"# comment", "user a@example.com", "topic read a/b", "", "topic c/d"},
+			users: []AclUser{{Line: 2, Username: "a@example.com", Topics: []AclTopic{
+				{Line: 3, Name: "a/b", CanRead: true},
+				{Line: 5, Name: "c/d", CanRead: true, CanWrite: true},
+			}}},
+		},
+		{
+			name:     "user without a name",
+			lines:    []string{"user", "topic a/b"},
+			problems: []LineProblem{{File: "acl", Line: 1, Text: "user", Reason: "user without a name"}, {File: "acl", Line: 2, Text: "topic a/b", Reason: "topic outside of a user block"}},
+		},
+		{
+			name:     "topic outside of a user block",
+			lines:    []string{"topic read a/b", "user a@example.com"},
+			users:    []AclUser{{Line: 2, Username: "a@example.com"}},
+			problems: []LineProblem{{File: "acl", Line: 1, Text: "topic read a/b", Reason: "topic outside of a user block"}},
+		},
+		{
+			name:  "pattern ends the block",
+			lines: []string{"user a@example.com", "topic a/b", "pattern read %u/#", "topic c/d"},
+			users: []AclUser{{Line: 1, Username: "a@example.com", Topics: []AclTopic{{Line: 2, Name: "a/b", CanRead: true, CanWrite: true}}}},
+			problems: []LineProblem{
+				{File: "acl", Line: 3, Text: "pattern read %u/#", Reason: "pattern rules are not imported"},
+				{File: "acl", Line: 4, Text: "topic c/d", Reason: "topic outside of a user block"},
+			},
+		},
+		{
+			name:     "deny",
+			lines:    []string{"user a@example.com", "  topic deny a/b"},
+			users:    []AclUser{{Line: 1, Username: "a@example.com"}},
+			problems: []LineProblem{{File: "acl", Line: 2, Text: "  topic deny a/b", Reason: "deny rules are not imported"}},
+		},
+		{
+			name:     "topic without a name",
+			lines:    []string{"user a@example.com", "topic"},
+			users:    []AclUser{{Line: 1, Username: "a@example.com"}},
+			problems: []LineProblem{{File: "acl", Line: 2, Text: "topic", Reason: "topic without a name"}},
+		},
+		{
+			name:     "unknown statement",
+			lines:    []string{"user a@example.com", "include_dir /etc/acl.d"},
+			users:    []AclUser{{Line: 1, Username: "a@example.com"}},
+			problems: []LineProblem{{File: "acl", Line: 2, Text: "include_dir /etc/acl.d", Reason: "unknown statement"}},
+		},
+		{
+			name: "repeated user blocks merge",
+			lines: []string{
+				"user a@example.com", "topic read a/1",
+				"user b@example.com", "topic read b/1",
+				"user a@example.com", "topic write a/2",
+			},
+			users: []AclUser{
+				{Line: 1, Username: "a@example.com", Topics: []AclTopic{
+					{Line: 2, Name: "a/1", CanRead: true},
+					{Line: 6, Name: "a/2", CanWrite: true},
+				}},
+				{Line: 3, Username: "b@example.com", Topics: []AclTopic{{Line: 4, Name: "b/1", CanRead: true}}},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			users, problems := parseAcl("acl", c.lines)
+			if !reflect.DeepEqual(users, c.users) {
+				t.Errorf("users = %+v, want %+v", users, c.users)
+			}
+			if !reflect.DeepEqual(problems, c.problems) {
+				t.Errorf("problems = %+v, want %+v", problems, c.problems)
+			}
+		})
+	}
+}
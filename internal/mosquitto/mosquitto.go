@@ -22,6 +22,19 @@ type Mosquitto interface {
 	WriteUpdatedTopicToAcl(username, name string, canRead, canWrite bool)
 	DeleteTopicFromAcl(username, name string)
 	WriteNewTopicToAcl(username, name string, canRead, canWrite bool)
+	DeleteUserFromAcl(username string)
+	WritePasswdHash(username, passwordHash string) error
+	WritePasswdHashes(passwordHashes map[string]string) error
+	ReadPasswdHash(username string) (passwordHash string, found bool, err error)
+	DeletePasswd(username string) error
+	RenameUser(oldUsername, newUsername string) error
+	RenameTopicInAcl(username, oldName, newName string) error
+	PasswdUsernames() ([]string, error)
+	RenderAcl(users []AclUser) ([]string, error)
+	WriteAcl(users []AclUser) error
+	ReadInstallation(passwdFile, aclFile string) (Installation, error)
+	WriteServiceUser(username, passwordHash string) error
+	Reload()
 }
 
 type mosquitto struct {
@@ -280,6 +293,142 @@ func (m *mosquitto) DeleteTopicFromAcl(username, name string) {
 	}
 }
 
+// RenameTopicInAcl replaces the name in the topic line of the user block and
+// keeps the permission. A topic without permissions has no line, nothing is written then
+func (m *mosquitto) RenameTopicInAcl(username, oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines, err := m.readAcl(aclPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	renamed := false
+	inUser := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "user ") || strings.HasPrefix(line, "pattern ") {
+			inUser = line == "user "+username
+			continue
+		}
+		if inUser && strings.HasPrefix(line, "topic ") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[len(fields)-1] == oldName {
+				fields[len(fields)-1] = newName
+				lines[i] = strings.Join(fields, " ")
+				renamed = true
+			}
+		}
+	}
+
+	if !renamed {
+		return nil
+	}
+	return m.writeAclAtomic(aclPath(), lines)
+}
+
+// DeleteUserFromAcl removes the user line with all topics up to the next block
+func (m *mosquitto) DeleteUserFromAcl(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	aclPath := viper.GetString("mosquitto_dir_file") + "mosquitto.acl"
+
+	lines, err := m.readAcl(aclPath)
+	if err != nil {
+		m.loggers.Err.Println(err)
+		return
+	}
+
+	var result []string
+	inUser := false
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "user ") || strings.HasPrefix(line, "pattern ") {
+			inUser = line == "user "+username
+			if inUser {
+				// the blank line separating the block goes away with it
+				if len(result) > 0 && result[len(result)-1] == "" {
+					result = result[:len(result)-1]
+				}
+				continue
+			}
+		}
+		if inUser {
+			continue
+		}
+
+		result = append(result, line)
+	}
+
+	if err = m.writeAclAtomic(aclPath, result); err != nil {
+		m.loggers.Err.Println(err)
+	}
+}
+
+// RenameUser moves the passwordfile entry and the acl block to the new username
+// under one lock, the passwordfile is restored when the acl cannot be written.
+// A user without entries, e.g. pending verification, is left as is
+func (m *mosquitto) RenameUser(oldUsername, newUsername string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	passwdPath := passwdPath()
+	aclPath := viper.GetString("mosquitto_dir_file") + "mosquitto.acl"
+
+	passwdLines, err := m.readAcl(passwdPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	aclLines, err := m.readAcl(aclPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	passwdFound := false
+	renamedPasswd := make([]string, 0, len(passwdLines))
+	for _, line := range passwdLines {
+		if line == "" || strings.HasPrefix(line, newUsername+":") {
+			continue
+		}
+		if passwordHash, found := strings.CutPrefix(line, oldUsername+":"); found {
+			line = newUsername + ":" + passwordHash
+			passwdFound = true
+		}
+		renamedPasswd = append(renamedPasswd, line)
+	}
+
+	aclFound := false
+	renamedAcl := make([]string, 0, len(aclLines))
+	for _, line := range aclLines {
+		if line == "user "+oldUsername {
+			line = "user " + newUsername
+			aclFound = true
+		}
+		renamedAcl = append(renamedAcl, line)
+	}
+
+	if passwdFound {
+		if err = m.writeAclAtomic(passwdPath, renamedPasswd); err != nil {
+			return err
+		}
+	}
+	if aclFound {
+		if err = m.writeAclAtomic(aclPath, renamedAcl); err != nil {
+			if passwdFound {
+				if restoreErr := m.writeAclAtomic(passwdPath, passwdLines); restoreErr != nil {
+					m.loggers.Err.Println(restoreErr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mosquitto) readAcl(path string) ([]string, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,139 @@
+package mosquitto
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// the $7$ format of mosquitto 2: pbkdf2-sha512 with the same parameters as mosquitto_passwd
+const (
+	passwdIterations = 101
+	passwdSaltSize   = 12
+	passwdKeySize    = 64
+)
+
+// HashPassword returns a passwordfile hash, so a user can be written to the
+// file later without keeping the plain password around
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwdSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwdIterations, passwdKeySize, sha512.New)
+	return "$7$" + strconv.Itoa(passwdIterations) + "$" +
+		base64.StdEncoding.EncodeToString(salt) + "$" +
+		base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (m *mosquitto) WritePasswdHash(username, passwordHash string) error {
+	return m.WritePasswdHashes(map[string]string{username: passwordHash})
+}
+
+// WritePasswdHashes adds or replaces the entries of every username with one write
+func (m *mosquitto) WritePasswdHashes(passwordHashes map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	passwdPath := passwdPath()
+
+	lines, err := m.readAcl(passwdPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	replaced := make(map[string]bool, len(passwordHashes))
+	var result []string
+	for _, line := range lines {
+		username, _, _ := strings.Cut(line, ":")
+		if passwordHash, found := passwordHashes[username]; found {
+			if !replaced[username] {
+				result = append(result, username+":"+passwordHash)
+				replaced[username] = true
+			}
+			continue
+		}
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	for username, passwordHash := range passwordHashes {
+		if !replaced[username] {
+			result = append(result, username+":"+passwordHash)
+		}
+	}
+
+	return m.writeAclAtomic(passwdPath, result)
+}
+
+func (m *mosquitto) ReadPasswdHash(username string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines, err := m.readAcl(passwdPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	for _, line := range lines {
+		if passwordHash, found := strings.CutPrefix(line, username+":"); found {
+			return passwordHash, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (m *mosquitto) DeletePasswd(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines, err := m.readAcl(passwdPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var result []string
+	for _, line := range lines {
+		if line != "" && !strings.HasPrefix(line, username+":") {
+			result = append(result, line)
+		}
+	}
+	return m.writeAclAtomic(passwdPath(), result)
+}
+
+func (m *mosquitto) PasswdUsernames() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines, err := m.readAcl(passwdPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var usernames []string
+	for _, line := range lines {
+		if username, _, found := strings.Cut(line, ":"); found && username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+func passwdPath() string {
+	return viper.GetString("mosquitto_dir_file") + "passwordfile"
+}
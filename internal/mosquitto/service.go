@@ -0,0 +1,73 @@
+package mosquitto
+
+import (
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const defaultServiceUsername = "mosquitto-broker-service"
+
+// ServiceUsername is the superuser the internal mqtt client connects as,
+// empty while mqtt.url is not set. It has no email, so no user of the db can take it
+func ServiceUsername() string {
+	if viper.GetString("mqtt.url") == "" {
+		return ""
+	}
+	if username := viper.GetString("mqtt.username"); username != "" {
+		return username
+	}
+	return defaultServiceUsername
+}
+
+// WriteServiceUser adds or replaces the passwordfile entry and the acl block of
+// the service user, the block grants readwrite on every topic
+func (m *mosquitto) WriteServiceUser(username, passwordHash string) error {
+	if err := m.WritePasswdHash(username, passwordHash); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines, err := m.readAcl(aclPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var result []string
+	inUser := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "user ") || strings.HasPrefix(line, "pattern ") {
+			inUser = line == "user "+username
+			if inUser {
+				if len(result) > 0 && result[len(result)-1] == "" {
+					result = result[:len(result)-1]
+				}
+				continue
+			}
+		}
+		if inUser {
+			continue
+		}
+		result = append(result, line)
+	}
+	result = append(result, serviceAclBlock(username)...)
+	return m.writeAclAtomic(aclPath(), result)
+}
+
+// Reload makes a running broker reread the passwordfile and acl
+func (m *mosquitto) Reload() {
+	if runtime.GOOS == "windows" {
+		// there is no SIGHUP, the files are reread on the next launch
+		return
+	}
+
+	m.RunCommand("pkill", "-HUP", "mosquitto")
+}
+
+func serviceAclBlock(username string) []string {
+	return []string{"", "user " + username, "topic readwrite #"}
+}
@@ -0,0 +1,337 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"github.com/robboworld/mosquitto-broker/internal/mosquitto"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+const (
+	defaultClientId = "mosquitto-broker"
+	requestTimeout  = 10 * time.Second
+)
+
+// ErrConnectionDown is returned while the broker is not reachable
+var ErrConnectionDown = errors.New("the internal mqtt client is not connected to the broker")
+
+// Message is a publish received from the broker
+type Message struct {
+	Topic          string
+	Payload        []byte
+	Qos            byte
+	Retain         bool
+	UserProperties []UserProperty
+	ReceivedAt     time.Time
+}
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Handler is called from the connection goroutine, it must not block
+// and must not subscribe or unsubscribe
+type Handler func(message Message)
+
+type Client interface {
+	// Username is the service user the client connects as
+	Username() string
+	// Subscribe adds handler for the messages matching filter. Handlers of the
+	// same filter share one subscription at qos 2, so messages arrive with the qos
+	// they were published with. Subscriptions are restored after a reconnect,
+	// a filter the broker refuses is an error. The returned func removes the handler
+	Subscribe(filter string, handler Handler) (unsubscribe func(), err error)
+	// Publish sends the message and waits for the answer of the broker up to
+	// qos 2, a reason code of 0x80 and above is a refusal
+	Publish(ctx context.Context, publish Publish) (PublishResult, error)
+	// Retained returns up to limit retained messages under filter, more tells
+	// that some were left out
+	Retained(ctx context.Context, filter string, limit int) (messages []Message, more bool, err error)
+}
+
+type subscription struct {
+	id       int
+	filter   string
+	handlers map[int]Handler
+}
+
+type client struct {
+	loggers  logger.Loggers
+	username string
+	password string
+	config   autopaho.ClientConfig
+	manager  *autopaho.ConnectionManager
+
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+	byId          map[int]*subscription
+	nextId        int
+	down          bool
+}
+
+// New returns nil when mqtt.url is empty, features that need the broker are
+// disabled then. The client connects as the service user once the server
+// starts, without mqtt_password the password is new on every start
+func New(lifecycle fx.Lifecycle, loggers logger.Loggers, m mosquitto.Mosquitto) Client {
+	rawUrl := viper.GetString("mqtt.url")
+	if rawUrl == "" {
+		return nil
+	}
+	brokerUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		loggers.Err.Fatalf("invalid mqtt.url: %v", err)
+	}
+
+	password := viper.GetString("mqtt_password")
+	if password == "" {
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			loggers.Err.Fatalf("cannot generate the mqtt password: %v", err)
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	clientId := viper.GetString("mqtt.client_id")
+	if clientId == "" {
+		clientId = defaultClientId
+	}
+
+	c := &client{
+		loggers:       loggers,
+		username:      mosquitto.ServiceUsername(),
+		password:      password,
+		subscriptions: make(map[string]*subscription),
+		byId:          make(map[int]*subscription),
+	}
+	c.config = autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{brokerUrl},
+		KeepAlive:         30,
+		ConnectRetryDelay: 5 * time.Second,
+		OnConnectionUp:    c.onConnectionUp,
+		OnConnectError:    c.onConnectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientId,
+			Router:   paho.NewSingleHandlerRouter(c.route),
+			MIDs:     newPacketIds(),
+			OnClientError: func(err error) {
+				loggers.Err.Printf("mqtt client: %v", err)
+			},
+		},
+	}
+	c.config.SetUsernamePassword(c.username, []byte(password))
+
+	var cancel context.CancelFunc
+	lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			passwordHash, err := mosquitto.HashPassword(c.password)
+			if err != nil {
+				return err
+			}
+			if err = m.WriteServiceUser(c.username, passwordHash); err != nil {
+				return err
+			}
+			m.Reload()
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			c.manager, err = autopaho.NewConnection(ctx, c.config)
+			return err
+		},
+		OnStop: func(ctx context.Context) error {
+			if c.manager == nil {
+				return nil
+			}
+			err := c.manager.Disconnect(ctx)
+			cancel()
+			return err
+		},
+	})
+	return c
+}
+
+func (c *client) Username() string {
+	return c.username
+}
+
+func (c *client) Subscribe(filter string, handler Handler) (func(), error) {
+	c.mu.Lock()
+	c.nextId++
+	handlerId := c.nextId
+	sub, found := c.subscriptions[filter]
+	if found {
+		sub.handlers[handlerId] = handler
+		c.mu.Unlock()
+		return func() { c.unsubscribe(filter, handlerId) }, nil
+	}
+	sub = &subscription{id: handlerId, filter: filter, handlers: map[int]Handler{handlerId: handler}}
+	c.subscriptions[filter] = sub
+	c.byId[sub.id] = sub
+	c.mu.Unlock()
+
+	if err := c.subscribe(sub); err != nil && !errors.Is(err, ErrConnectionDown) {
+		c.mu.Lock()
+		delete(c.subscriptions, filter)
+		delete(c.byId, sub.id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	// while the connection is down the subscription is sent once it is up
+	return func() { c.unsubscribe(filter, handlerId) }, nil
+}
+
+func (c *client) unsubscribe(filter string, handlerId int) {
+	c.mu.Lock()
+	sub, found := c.subscriptions[filter]
+	if !found {
+		c.mu.Unlock()
+		return
+	}
+	delete(sub.handlers, handlerId)
+	if len(sub.handlers) > 0 {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.subscriptions, filter)
+	delete(c.byId, sub.id)
+	c.mu.Unlock()
+
+	if c.manager == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := c.manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{filter}})
+	if err != nil && !errors.Is(err, autopaho.ConnectionDownError) {
+		c.loggers.Err.Printf("mqtt unsubscribe %s: %v", filter, err)
+	}
+}
+
+// subscribe sends one packet per filter, the subscription identifier is per packet
+func (c *client) subscribe(sub *subscription) error {
+	if c.manager == nil {
+		return ErrConnectionDown
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	id := sub.id
+	suback, err := c.manager.Subscribe(ctx, &paho.Subscribe{
+		Properties:    &paho.SubscribeProperties{SubscriptionIdentifier: &id},
+		Subscriptions: []paho.SubscribeOptions{{Topic: sub.filter, QoS: 2}},
+	})
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return ErrConnectionDown
+	}
+	if err != nil {
+		return err
+	}
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("broker refused the subscription to %s with reason code 0x%02x", sub.filter, suback.Reasons[0])
+	}
+	return nil
+}
+
+func (c *client) onConnectionUp(_ *autopaho.ConnectionManager, _ *paho.Connack) {
+	c.mu.Lock()
+	c.loggers.Info.Printf("mqtt client connected as %s", c.username)
+	c.down = false
+	subs := make([]*subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subs = append(subs, sub)
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		if err := c.subscribe(sub); err != nil {
+			c.loggers.Err.Printf("mqtt resubscribe: %v", err)
+		}
+	}
+}
+
+// onConnectError logs only the first failure, the client keeps retrying
+func (c *client) onConnectError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.down {
+		c.loggers.Err.Printf("mqtt client cannot connect, retrying: %v", err)
+	}
+	c.down = true
+}
+
+// route passes the message to the handlers of its subscription identifier,
+// without one to the handlers of every matching filter
+func (c *client) route(p *paho.Publish) {
+	message := Message{
+		Topic:      p.Topic,
+		Payload:    p.Payload,
+		Qos:        p.QoS,
+		Retain:     p.Retain,
+		ReceivedAt: time.Now(),
+	}
+	subId := 0
+	if p.Properties != nil {
+		if p.Properties.SubscriptionIdentifier != nil {
+			subId = *p.Properties.SubscriptionIdentifier
+		}
+		for _, property := range p.Properties.User {
+			message.UserProperties = append(message.UserProperties, UserProperty{Key: property.Key, Value: property.Value})
+		}
+	}
+
+	var handlers []Handler
+	c.mu.Lock()
+	if sub, found := c.byId[subId]; found {
+		for _, handler := range sub.handlers {
+			handlers = append(handlers, handler)
+		}
+	} else {
+		for _, sub := range c.subscriptions {
+			if !Match(sub.filter, p.Topic) {
+				continue
+			}
+			for _, handler := range sub.handlers {
+				handlers = append(handlers, handler)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+// Match tells whether topic matches the filter with + and # wildcards. Like the
+// broker, wildcards in the first level do not match topics starting with $
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,42 @@
+package mqtt
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"A/b", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a//c", true},
+		{"+/+", "/b", true},
+		{"+", "a", true},
+		{"+", "a/b", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "b/c", false},
+		{"a/+/#", "a/b", true},
+		{"#", "a/b/c", true},
+		{"#", "/a", true},
+		// wildcards in the first level skip $ topics
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"a/#", "a/$b", true},
+	}
+	for _, c := range cases {
+		if got := Match(c.filter, c.topic); got != c.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.filter, c.topic, got, c.match)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Publish is a message to send to the broker
+type Publish struct {
+	Topic          string
+	Payload        []byte
+	Qos            byte
+	Retain         bool
+	UserProperties []UserProperty
+}
+
+// PublishResult is what the broker answered. Qos 0 has no answer, PacketId
+// and ReasonCode are zero then
+type PublishResult struct {
+	PacketId   uint16
+	ReasonCode byte
+	Reason     string
+}
+
+func (c *client) Publish(ctx context.Context, publish Publish) (PublishResult, error) {
+	if c.manager == nil {
+		return PublishResult{}, ErrConnectionDown
+	}
+
+	var packetId uint16
+	ctx = context.WithValue(ctx, packetIdKey{}, &packetId)
+	p := &paho.Publish{
+		Topic:   publish.Topic,
+		Payload: publish.Payload,
+		QoS:     publish.Qos,
+		Retain:  publish.Retain,
+	}
+	if len(publish.UserProperties) > 0 {
+		p.Properties = &paho.PublishProperties{}
+		for _, property := range publish.UserProperties {
+			p.Properties.User.Add(property.Key, property.Value)
+		}
+	}
+
+	response, err := c.manager.Publish(ctx, p)
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return PublishResult{}, ErrConnectionDown
+	}
+	// a refused qos 1 publish comes with the response and an error
+	if response == nil {
+		return PublishResult{PacketId: packetId}, err
+	}
+	result := PublishResult{PacketId: packetId, ReasonCode: response.ReasonCode}
+	if response.Properties != nil {
+		result.Reason = response.Properties.ReasonString
+	}
+	if result.Reason == "" {
+		result.Reason = (&packets.Puback{ReasonCode: response.ReasonCode}).Reason()
+	}
+	return result, nil
+}
+
+type packetIdKey struct{}
+
+// packetIds hands out packet identifiers like paho.MIDs, and passes the one
+// of a publish back through the *uint16 under packetIdKey of its context
+type packetIds struct {
+	mu     sync.Mutex
+	lastId uint16
+	index  map[uint16]*paho.CPContext
+}
+
+func newPacketIds() *packetIds {
+	return &packetIds{index: make(map[uint16]*paho.CPContext)}
+}
+
+func (p *packetIds) Request(cpCtx *paho.CPContext) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := p.lastId
+	for i := 0; i < 65535; i++ {
+		id++
+		if id == 0 {
+			id = 1
+		}
+		if _, used := p.index[id]; used {
+			continue
+		}
+		p.index[id] = cpCtx
+		p.lastId = id
+		if cpCtx != nil && cpCtx.Context != nil {
+			if out, ok := cpCtx.Context.Value(packetIdKey{}).(*uint16); ok {
+				*out = id
+			}
+		}
+		return id, nil
+	}
+	return 0, paho.ErrorMidsExhausted
+}
+
+func (p *packetIds) Get(id uint16) *paho.CPContext {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.index[id]
+}
+
+func (p *packetIds) Free(id uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.index, id)
+}
+
+func (p *packetIds) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.index = make(map[uint16]*paho.CPContext)
+}
@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// retainedQuiet ends the collection, the broker sends the retained messages
+// right after the suback
+const retainedQuiet = 500 * time.Millisecond
+
+// Retained connects once more as the service user, a subscription there does
+// not touch the ones of Subscribe. It collects what the broker sends with the
+// retain flag until retainedQuiet passes without a message, limit messages
+// arrived or ctx is done, more is true in the last two cases
+func (c *client) Retained(ctx context.Context, filter string, limit int) ([]Message, bool, error) {
+	if c.manager == nil {
+		return nil, false, ErrConnectionDown
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, false, err
+	}
+
+	var (
+		mu       sync.Mutex
+		messages []Message
+		more     bool
+	)
+	received := make(chan struct{}, 1)
+	config := c.config
+	config.OnConnectionUp = nil
+	config.OnConnectError = nil
+	config.ClientConfig.ClientID = c.config.ClientID + "-retained-" + hex.EncodeToString(suffix)
+	config.ClientConfig.MIDs = nil
+	config.ClientConfig.OnClientError = nil
+	config.ClientConfig.Router = paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+		if !p.Retain {
+			return
+		}
+		message := Message{
+			Topic:      p.Topic,
+			Payload:    p.Payload,
+			Qos:        p.QoS,
+			Retain:     true,
+			ReceivedAt: time.Now(),
+		}
+		if p.Properties != nil {
+			for _, property := range p.Properties.User {
+				message.UserProperties = append(message.UserProperties, UserProperty{Key: property.Key, Value: property.Value})
+			}
+		}
+		mu.Lock()
+		if len(messages) < limit {
+			messages = append(messages, message)
+		} else {
+			more = true
+		}
+		mu.Unlock()
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+
+	connCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager, err := autopaho.NewConnection(connCtx, config)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancelDisconnect()
+		_ = manager.Disconnect(disconnectCtx)
+	}()
+	if err = manager.AwaitConnection(ctx); err != nil {
+		return nil, false, ErrConnectionDown
+	}
+
+	suback, err := manager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: 2}},
+	})
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return nil, false, ErrConnectionDown
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return nil, false, fmt.Errorf("broker refused the subscription to %s with reason code 0x%02x", filter, suback.Reasons[0])
+	}
+
+	quiet := time.After(retainedQuiet)
+	for done := false; !done; {
+		select {
+		case <-received:
+			mu.Lock()
+			done = more
+			mu.Unlock()
+			quiet = time.After(retainedQuiet)
+		case <-quiet:
+			done = true
+		case <-ctx.Done():
+			mu.Lock()
+			more = true
+			mu.Unlock()
+			done = true
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return messages, more, nil
+}
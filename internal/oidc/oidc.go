@@ -0,0 +1,377 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+// the jwks is fetched again for an unknown kid, but not more often than this
+const jwksRefreshInterval = time.Minute
+
+var signingMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type Provider interface {
+	// AuthCodeURL builds the authorization request with the S256 pkce challenge of codeVerifier
+	AuthCodeURL(state, nonce, codeVerifier string) (string, error)
+	// Exchange trades the code for an id token and returns its validated claims
+	Exchange(code, codeVerifier, nonce string) (IdTokenClaims, error)
+	// Role maps the configured claim to a role, found is false when nothing matches
+	Role(claims IdTokenClaims) (role models.Role, found bool)
+	DefaultRole() models.Role
+}
+
+type IdTokenClaims struct {
+	jwt.StandardClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	// Raw keeps every claim of the token for the role mapping
+	Raw map[string]interface{} `json:"-"`
+}
+
+type RoleMapping struct {
+	Value string
+	Role  models.Role
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectUrl  string
+	scopes       []string
+	roleClaim    string
+	roleMapping  []RoleMapping
+	defaultRole  models.Role
+	client       *http.Client
+
+	mu            sync.Mutex
+	discovery     *discovery
+	jwks          keys.JWKS
+	jwksFetchedAt time.Time
+}
+
+// New returns nil when oidc.issuer is empty, single sign-on is disabled then.
+// The discovery document is fetched on the first login, so a provider that is
+// down does not stop the server
+func New(loggers logger.Loggers) Provider {
+	issuer := strings.TrimSuffix(viper.GetString("oidc.issuer"), "/")
+	if issuer == "" {
+		return nil
+	}
+
+	var roleMapping []RoleMapping
+	if err := viper.UnmarshalKey("oidc.role_mapping", &roleMapping); err != nil {
+		loggers.Err.Fatalf("invalid oidc.role_mapping: %v", err)
+	}
+	for _, mapping := range roleMapping {
+		if !isKnownRole(mapping.Role) {
+			loggers.Err.Fatalf("unknown role %q in oidc.role_mapping", mapping.Role)
+		}
+	}
+	defaultRole := models.Role(viper.GetString("oidc.default_role"))
+	if !isKnownRole(defaultRole) {
+		loggers.Err.Fatalf("unknown oidc.default_role %q", defaultRole)
+	}
+
+	scopes := viper.GetStringSlice("oidc.scopes")
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &provider{
+		issuer:       issuer,
+		clientId:     viper.GetString("oidc.client_id"),
+		clientSecret: viper.GetString("oidc_client_secret"),
+		redirectUrl:  viper.GetString("oidc.redirect_url"),
+		scopes:       scopes,
+		roleClaim:    viper.GetString("oidc.role_claim"),
+		roleMapping:  roleMapping,
+		defaultRole:  defaultRole,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *provider) AuthCodeURL(state, nonce, codeVerifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientId},
+		"redirect_uri":          {p.redirectUrl},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func (p *provider) Exchange(code, codeVerifier, nonce string) (IdTokenClaims, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectUrl},
+		"client_id":     {p.clientId},
+		"code_verifier": {codeVerifier},
+	}
+	request, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	var tokenResponse struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = p.doJSON(request, &tokenResponse); err != nil && tokenResponse.Error == "" {
+		return IdTokenClaims{}, err
+	}
+	if tokenResponse.Error != "" {
+		return IdTokenClaims{}, fmt.Errorf("token endpoint: %s %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.IdToken == "" {
+		return IdTokenClaims{}, errors.New("token endpoint returned no id_token")
+	}
+
+	return p.verify(tokenResponse.IdToken, nonce)
+}
+
+func (p *provider) verify(idToken, nonce string) (IdTokenClaims, error) {
+	claims := IdTokenClaims{}
+	_, err := jwt.ParseWithClaims(idToken, &claims, p.keyfunc,
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithAudience(p.clientId),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return IdTokenClaims{}, fmt.Errorf("invalid id token: %w", err)
+	}
+	// jwt-go skips a missing exp, id tokens must always expire
+	if claims.ExpiresAt == nil {
+		return IdTokenClaims{}, errors.New("invalid id token: no exp claim")
+	}
+	if claims.Nonce != nonce {
+		return IdTokenClaims{}, errors.New("invalid id token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return IdTokenClaims{}, errors.New("invalid id token: no sub claim")
+	}
+
+	// the signature is already checked, the payload is decoded once more to keep custom claims
+	payload, err := jwt.DecodeSegment(strings.Split(idToken, ".")[1])
+	if err != nil {
+		return IdTokenClaims{}, err
+	}
+	if err = json.Unmarshal(payload, &claims.Raw); err != nil {
+		return IdTokenClaims{}, err
+	}
+	return claims, nil
+}
+
+func (p *provider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	jwk, err := p.findKey(kid, token.Method.Alg(), false)
+	if err != nil {
+		// the provider may have rotated its keys
+		jwk, err = p.findKey(kid, token.Method.Alg(), true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jwk.PublicKey()
+}
+
+func (p *provider) findKey(kid, alg string, refresh bool) (keys.JWK, error) {
+	jwks, err := p.getJwks(refresh)
+	if err != nil {
+		return keys.JWK{}, err
+	}
+
+	var candidates []keys.JWK
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != alg {
+			continue
+		}
+		if kid == "" || jwk.Kid == kid {
+			candidates = append(candidates, jwk)
+		}
+	}
+	// without a kid the key must be unambiguous
+	if len(candidates) != 1 {
+		return keys.JWK{}, fmt.Errorf("no unique key for kid %q and alg %s", kid, alg)
+	}
+	return candidates[0], nil
+}
+
+func (p *provider) getJwks(refresh bool) (keys.JWKS, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return keys.JWKS{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.jwksFetchedAt.IsZero() && (!refresh || time.Since(p.jwksFetchedAt) < jwksRefreshInterval) {
+		return p.jwks, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, d.JwksUri, nil)
+	if err != nil {
+		return keys.JWKS{}, err
+	}
+	var jwks keys.JWKS
+	if err = p.doJSON(request, &jwks); err != nil {
+		return keys.JWKS{}, err
+	}
+	p.jwks = jwks
+	p.jwksFetchedAt = time.Now()
+	return jwks, nil
+}
+
+func (p *provider) getDiscovery() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d discovery
+	if err = p.doJSON(request, &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery issuer %s does not match %s", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksUri == "" {
+		return nil, errors.New("discovery document misses endpoints")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// doJSON decodes the body even for error statuses, token endpoints describe errors in json
+func (p *provider) doJSON(request *http.Request, v interface{}) error {
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	decodeErr := json.NewDecoder(response.Body).Decode(v)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", request.Method, request.URL.Redacted(), response.Status)
+	}
+	return decodeErr
+}
+
+func (p *provider) Role(claims IdTokenClaims) (models.Role, bool) {
+	if p.roleClaim == "" {
+		return "", false
+	}
+	values := claimValues(claims.Raw, p.roleClaim)
+	for _, mapping := range p.roleMapping {
+		for _, value := range values {
+			if value == mapping.Value {
+				return mapping.Role, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (p *provider) DefaultRole() models.Role {
+	return p.defaultRole
+}
+
+// claimValues follows a dotted path like realm_access.roles,
+// the claim may be a string or a list of strings
+func claimValues(raw map[string]interface{}, path string) []string {
+	var current interface{} = raw
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[part]
+	}
+
+	switch value := current.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func isKnownRole(role models.Role) bool {
+	for _, known := range models.Roles {
+		if known == role && role != models.RoleAnonymous {
+			return true
+		}
+	}
+	return false
+}
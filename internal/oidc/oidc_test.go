@@ -0,0 +1,275 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+)
+
+const (
+	testClientId    = "mosquitto-broker"
+	testRedirectUrl = "http://localhost:3030/oidc/callback"
+	testKid         = "test-key"
+)
+
+// mockProvider is a minimal identity provider: discovery, jwks, an authorization
+// endpoint that remembers the pkce challenge and a token endpoint that checks it
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// issuer is announced in the discovery document, the server url by default
+	issuer string
+	// claims are signed into the id token, code_verifier is checked first
+	claims    jwt.MapClaims
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, discovery{
+			Issuer:                m.issuer,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JwksUri:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, keys.JWKS{Keys: []keys.JWK{{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: testKid,
+			N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+			return
+		}
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != m.challenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error":             "invalid_grant",
+				"error_description": "pkce verification failed",
+			})
+			return
+		}
+		idToken, err := m.sign(m.claims)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": idToken})
+	})
+	m.server = httptest.NewServer(mux)
+	m.issuer = m.server.URL
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockProvider) provider() *provider {
+	return &provider{
+		issuer:      m.server.URL,
+		clientId:    testClientId,
+		redirectUrl: testRedirectUrl,
+		scopes:      []string{"openid", "email", "profile"},
+		roleClaim:   "realm_access.roles",
+		roleMapping: []RoleMapping{
+			{Value: "teachers", Role: models.RoleTeacher},
+			{Value: "admins", Role: models.RoleOrgAdmin},
+		},
+		defaultRole: models.RoleUser,
+		client:      m.server.Client(),
+	}
+}
+
+// authorize plays the browser part: it follows AuthCodeURL and keeps the challenge
+func (m *mockProvider) authorize(p *provider, nonce, verifier string) url.Values {
+	authURL, err := p.AuthCodeURL("state", nonce, verifier)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	query := parsed.Query()
+	m.challenge = query.Get("code_challenge")
+	return query
+}
+
+func (m *mockProvider) idTokenClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            testClientId,
+		"sub":            "subject-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+		"name":           "Test User",
+		"realm_access":   map[string]interface{}{"roles": []string{"offline", "teachers"}},
+	}
+}
+
+func (m *mockProvider) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testKid
+	return token.SignedString(m.key)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestDiscovery(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	query := m.authorize(p, "nonce", "verifier")
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientId,
+		"redirect_uri":          testRedirectUrl,
+		"scope":                 "openid email profile",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge_method": "S256",
+	}
+	for key, value := range expected {
+		if query.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, query.Get(key), value)
+		}
+	}
+
+	m.issuer = "https://other.example.com"
+	if _, err := m.provider().AuthCodeURL("state", "nonce", "verifier"); err == nil {
+		t.Error("discovery with another issuer was accepted")
+	}
+}
+
+func TestExchangePkce(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	m.authorize(p, "nonce", "verifier")
+	m.claims = m.idTokenClaims("nonce")
+
+	if _, err := p.Exchange("code", "other verifier", "nonce"); err == nil ||
+		!strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("wrong verifier: err = %v, want invalid_grant", err)
+	}
+
+	claims, err := p.Exchange("code", "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestExchangeRejectsInvalidIdToken(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(claims jwt.MapClaims)
+	}{
+		{"nonce mismatch", func(claims jwt.MapClaims) { claims["nonce"] = "other nonce" }},
+		{"issuer mismatch", func(claims jwt.MapClaims) { claims["iss"] = "https://other.example.com" }},
+		{"audience mismatch", func(claims jwt.MapClaims) { claims["aud"] = "other-client" }},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no exp", func(claims jwt.MapClaims) { delete(claims, "exp") }},
+		{"no sub", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newMockProvider(t)
+			p := m.provider()
+			m.authorize(p, "nonce", "verifier")
+			m.claims = m.idTokenClaims("nonce")
+			c.modify(m.claims)
+
+			if _, err := p.Exchange("code", "verifier", "nonce"); err == nil {
+				t.Error("id token was accepted")
+			}
+		})
+	}
+}
+
+func TestRole(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	cases := []struct {
+		name  string
+		raw   map[string]interface{}
+		role  models.Role
+		found bool
+	}{
+		{"nested list", map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": []interface{}{"offline", "teachers"}},
+		}, models.RoleTeacher, true},
+		{"first mapping wins", map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": []interface{}{"admins", "teachers"}},
+		}, models.RoleTeacher, true},
+		{"string claim", map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": "admins"},
+		}, models.RoleOrgAdmin, true},
+		{"no match", map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": []interface{}{"offline"}},
+		}, "", false},
+		{"missing claim", map[string]interface{}{}, "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			role, found := p.Role(IdTokenClaims{Raw: c.raw})
+			if role != c.role || found != c.found {
+				t.Errorf("Role = %q, %v, want %q, %v", role, found, c.role, c.found)
+			}
+		})
+	}
+	if p.DefaultRole() != models.RoleUser {
+		t.Errorf("DefaultRole = %q", p.DefaultRole())
+	}
+}
+
+func TestRoleFromIdToken(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	m.authorize(p, "nonce", "verifier")
+	m.claims = m.idTokenClaims("nonce")
+
+	claims, err := p.Exchange("code", "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, found := p.Role(claims); !found || role != models.RoleTeacher {
+		t.Errorf("Role = %q, %v, want %q", role, found, models.RoleTeacher)
+	}
+}
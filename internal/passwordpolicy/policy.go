@@ -0,0 +1,184 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// bcrypt ignores everything past 72 bytes
+const bcryptMaxBytes = 72
+
+//go:embed common.txt
+var commonPasswords string
+
+type Rule string
+
+const (
+	RuleMinLength        Rule = "min_length"
+	RuleMaxLength        Rule = "max_length"
+	RuleCharacterClasses Rule = "character_classes"
+	RuleBlocklist        Rule = "blocklist"
+	RuleContainsEmail    Rule = "contains_email"
+)
+
+type Violation struct {
+	Rule    Rule   `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ViolationsError unwraps to a 400 ResponseError, so handlers that do not
+// know about the violations still answer with the right code
+type ViolationsError struct {
+	Violations []Violation
+}
+
+func (e ViolationsError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return consts.ErrWeakPassword + ": " + strings.Join(messages, "; ")
+}
+
+func (e ViolationsError) Unwrap() error {
+	return utils.ResponseError{
+		Code:    http.StatusBadRequest,
+		Message: consts.ErrWeakPassword,
+	}
+}
+
+type Policy interface {
+	// Check returns ViolationsError with every broken rule, or nil
+	Check(password, email string) error
+}
+
+type policy struct {
+	minLength   int
+	maxBytes    int
+	minClasses  int
+	forbidEmail bool
+	blocklist   map[string]struct{}
+}
+
+// New reads password_policy from the config, the blocklist_file is added
+// to the built-in list of common passwords
+func New(loggers logger.Loggers) Policy {
+	p := &policy{
+		minLength:   viper.GetInt("password_policy.min_length"),
+		maxBytes:    viper.GetInt("password_policy.max_bytes"),
+		minClasses:  viper.GetInt("password_policy.min_classes"),
+		forbidEmail: viper.GetBool("password_policy.forbid_email"),
+		blocklist:   make(map[string]struct{}),
+	}
+	if p.maxBytes <= 0 || p.maxBytes > bcryptMaxBytes {
+		p.maxBytes = bcryptMaxBytes
+	}
+
+	addToBlocklist(p.blocklist, strings.NewReader(commonPasswords))
+	if path := viper.GetString("password_policy.blocklist_file"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			loggers.Err.Fatalf("cannot open password blocklist: %v", err)
+		}
+		defer file.Close()
+		if err = addToBlocklist(p.blocklist, file); err != nil {
+			loggers.Err.Fatalf("cannot read password blocklist: %v", err)
+		}
+	}
+	return p
+}
+
+func (p *policy) Check(password, email string) error {
+	var violations []Violation
+
+	if utf8.RuneCountInString(password) < p.minLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMinLength,
+			Message: "at least " + strconv.Itoa(p.minLength) + " characters",
+		})
+	}
+	if len(password) > p.maxBytes {
+		violations = append(violations, Violation{
+			Rule:    RuleMaxLength,
+			Message: "at most " + strconv.Itoa(p.maxBytes) + " bytes",
+		})
+	}
+	if classes := countClasses(password); classes < p.minClasses {
+		violations = append(violations, Violation{
+			Rule:    RuleCharacterClasses,
+			Message: "at least " + strconv.Itoa(p.minClasses) + " of lowercase, uppercase, digits and symbols",
+		})
+	}
+	if _, found := p.blocklist[strings.ToLower(password)]; found {
+		violations = append(violations, Violation{
+			Rule:    RuleBlocklist,
+			Message: "the password is too common",
+		})
+	}
+	if p.forbidEmail && containsEmail(password, email) {
+		violations = append(violations, Violation{
+			Rule:    RuleContainsEmail,
+			Message: "the password must not contain the email",
+		})
+	}
+
+	if len(violations) > 0 {
+		return ViolationsError{Violations: violations}
+	}
+	return nil
+}
+
+func countClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// containsEmail checks the whole address and its local part,
+// local parts shorter than 3 characters would match too much
+func containsEmail(password, email string) bool {
+	password = strings.ToLower(password)
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return false
+	}
+	if strings.Contains(password, email) {
+		return true
+	}
+	local, _, _ := strings.Cut(email, "@")
+	return len(local) >= 3 && strings.Contains(password, local)
+}
+
+func addToBlocklist(blocklist map[string]struct{}, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			blocklist[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,131 @@
+package passwordpolicy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+func testPolicy() *policy {
+	p := &policy{
+		minLength:   8,
+		maxBytes:    bcryptMaxBytes,
+		minClasses:  2,
+		forbidEmail: true,
+		blocklist:   make(map[string]struct{}),
+	}
+	addToBlocklist(p.blocklist, strings.NewReader(commonPasswords))
+	return p
+}
+
+func rules(err error) []Rule {
+	var violations ViolationsError
+	if !errors.As(err, &violations) {
+		return nil
+	}
+	var broken []Rule
+	for _, violation := range violations.Violations {
+		broken = append(broken, violation.Rule)
+	}
+	return broken
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		password string
+		email    string
+		rules    []Rule
+	}{
+		{"strong", "Tr4vel-Lantern", "user@example.com", nil},
+		{"too short", "Ab1", "user@example.com", []Rule{RuleMinLength}},
+		{"length counts characters", "Пароль12", "user@example.com", nil},
+		{"over 72 bytes", "Aa1" + strings.Repeat("x", 70), "user@example.com", []Rule{RuleMaxLength}},
+		{"one class", "lanternlantern", "user@example.com", []Rule{RuleCharacterClasses}},
+		{"symbols are a class", "lantern lantern", "user@example.com", nil},
+		{"common", "Password1", "user@example.com", []Rule{RuleBlocklist}},
+		{"whole email", "X1user@example.com", "user@example.com", []Rule{RuleContainsEmail}},
+		{"local part", "Jonathan-2024", "JONATHAN@example.com", []Rule{RuleContainsEmail}},
+		{"short local part", "Abcdefgh1", "ab@example.com", nil},
+		{"no email", "Abcdefgh1", "", nil},
+		{"several rules", "user", "user@example.com", []Rule{RuleMinLength, RuleCharacterClasses, RuleContainsEmail}},
+	}
+	p := testPolicy()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := p.Check(c.password, c.email)
+			if got := rules(err); !reflect.DeepEqual(got, c.rules) {
+				t.Errorf("broken rules = %v, want %v (err = %v)", got, c.rules, err)
+			}
+		})
+	}
+}
+
+func TestCheckWithoutEmailRule(t *testing.T) {
+	p := testPolicy()
+	p.forbidEmail = false
+	if err := p.Check("X1user@example.com", "user@example.com"); err != nil {
+		t.Errorf("err = %v with forbid_email off", err)
+	}
+}
+
+func TestViolationsErrorIsBadRequest(t *testing.T) {
+	err := testPolicy().Check("a", "")
+	var respErr utils.ResponseError
+	if !errors.As(err, &respErr) || respErr.Code != http.StatusBadRequest {
+		t.Errorf("err = %v does not unwrap to a 400 ResponseError", err)
+	}
+}
+
+func TestCountClasses(t *testing.T) {
+	cases := map[string]int{
+		"":         0,
+		"abc":      1,
+		"abcDEF":   2,
+		"abcDEF12": 3,
+		"aB1!":     4,
+		"ßÄ9":      3,
+	}
+	for password, classes := range cases {
+		if got := countClasses(password); got != classes {
+			t.Errorf("countClasses(%q) = %d, want %d", password, got, classes)
+		}
+	}
+}
+
+func TestNewReadsBlocklistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("# comment\n\n  Company-Name-2024  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("password_policy.min_length", 8)
+	viper.Set("password_policy.max_bytes", 100)
+	viper.Set("password_policy.min_classes", 2)
+	viper.Set("password_policy.blocklist_file", path)
+	t.Cleanup(viper.Reset)
+
+	p := New(logger.Loggers{Info: log.New(io.Discard, "", 0), Err: log.New(io.Discard, "", 0)}).(*policy)
+	if p.maxBytes != bcryptMaxBytes {
+		t.Errorf("maxBytes = %d, want it lowered to %d", p.maxBytes, bcryptMaxBytes)
+	}
+	if got := rules(p.Check("company-name-2024", "")); !reflect.DeepEqual(got, []Rule{RuleBlocklist}) {
+		t.Errorf("file entry: broken rules = %v", got)
+	}
+	if got := rules(p.Check("Password1", "")); !reflect.DeepEqual(got, []Rule{RuleBlocklist}) {
+		t.Errorf("built-in entry: broken rules = %v", got)
+	}
+	if _, found := p.blocklist["# comment"]; found {
+		t.Error("a comment was added to the blocklist")
+	}
+}
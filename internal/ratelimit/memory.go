@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const memoryPruneInterval = time.Minute
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	limit     Limit
+}
+
+type memoryLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	prunedAt time.Time
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{
+		buckets:  make(map[string]*bucket),
+		prunedAt: time.Now(),
+	}
+}
+
+func (m *memoryLimiter) Allow(key string, limit Limit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.prunedAt) > memoryPruneInterval {
+		m.prune(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+
+	var allowed bool
+	var retryAfter time.Duration
+	b.tokens, allowed, retryAfter = take(b.tokens, b.updatedAt, now, limit)
+	b.updatedAt = now
+	return allowed, retryAfter, nil
+}
+
+// prune drops buckets that are full again, they behave the same as missing ones
+func (m *memoryLimiter) prune(now time.Time) {
+	for key, b := range m.buckets {
+		if b.limit.Rate <= 0 {
+			continue
+		}
+		refill := now.Sub(b.updatedAt).Seconds() * b.limit.Rate / 60
+		if b.tokens+refill >= float64(b.limit.Burst) {
+			delete(m.buckets, key)
+		}
+	}
+	m.prunedAt = now
+}
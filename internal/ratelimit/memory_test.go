@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiterBurst(t *testing.T) {
+	m := newMemoryLimiter()
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i := 0; i < limit.Burst; i++ {
+		if allowed, _, err := m.Allow("ip:1.2.3.4", limit); err != nil || !allowed {
+			t.Fatalf("request %d: allowed = %v, err = %v", i+1, allowed, err)
+		}
+	}
+	allowed, retryAfter, err := m.Allow("ip:1.2.3.4", limit)
+	if err != nil || allowed {
+		t.Fatalf("request over the burst: allowed = %v, err = %v", allowed, err)
+	}
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Errorf("retryAfter = %v, want up to a minute at one token per minute", retryAfter)
+	}
+
+	// buckets are per key
+	if allowed, _, _ = m.Allow("ip:5.6.7.8", limit); !allowed {
+		t.Error("another key shares the bucket")
+	}
+}
+
+func TestMemoryLimiterRefill(t *testing.T) {
+	m := newMemoryLimiter()
+	limit := Limit{Rate: 60, Burst: 1}
+
+	if allowed, _, _ := m.Allow("key", limit); !allowed {
+		t.Fatal("first request refused")
+	}
+	if allowed, _, _ := m.Allow("key", limit); allowed {
+		t.Fatal("second request allowed with an empty bucket")
+	}
+	m.buckets["key"].updatedAt = time.Now().Add(-time.Second)
+	if allowed, _, _ := m.Allow("key", limit); !allowed {
+		t.Error("request refused after a refill")
+	}
+}
+
+func TestMemoryLimiterPrune(t *testing.T) {
+	m := newMemoryLimiter()
+	limit := Limit{Rate: 60, Burst: 2}
+	m.Allow("refilled", limit)
+	m.Allow("empty", limit)
+	m.Allow("empty", limit)
+	m.Allow("no rate", Limit{Rate: 0, Burst: 1})
+
+	now := time.Now()
+	m.buckets["refilled"].updatedAt = now.Add(-time.Minute)
+	m.prune(now)
+
+	if _, ok := m.buckets["refilled"]; ok {
+		t.Error("a full bucket was kept")
+	}
+	for _, key := range []string{"empty", "no rate"} {
+		if _, ok := m.buckets[key]; !ok {
+			t.Errorf("bucket %q was pruned", key)
+		}
+	}
+}
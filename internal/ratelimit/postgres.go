@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+const (
+	postgresPruneInterval = 10 * time.Minute
+	postgresBucketMaxIdle = time.Hour
+)
+
+type postgresLimiter struct {
+	db      *gorm.DB
+	loggers logger.Loggers
+
+	mu       sync.Mutex
+	prunedAt time.Time
+}
+
+func newPostgresLimiter(db *gorm.DB, loggers logger.Loggers) *postgresLimiter {
+	return &postgresLimiter{
+		db:       db,
+		loggers:  loggers,
+		prunedAt: time.Now(),
+	}
+}
+
+func (p *postgresLimiter) Allow(key string, limit Limit) (bool, time.Duration, error) {
+	p.pruneIfDue()
+
+	var allowed bool
+	var retryAfter time.Duration
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		newBucket := models.RateLimitBucketCore{
+			Key:       key,
+			Tokens:    float64(limit.Burst),
+			UpdatedAt: now,
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&newBucket).Error; err != nil {
+			return err
+		}
+
+		// the row lock serializes replicas taking tokens from the same bucket
+		var bucket models.RateLimitBucketCore
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("key = ?", key).Take(&bucket).Error; err != nil {
+			return err
+		}
+
+		bucket.Tokens, allowed, retryAfter = take(bucket.Tokens, bucket.UpdatedAt, now, limit)
+		return tx.Model(&bucket).Where("key = ?", key).
+			Updates(map[string]interface{}{
+				"tokens":     bucket.Tokens,
+				"updated_at": now,
+			}).Error
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+func (p *postgresLimiter) pruneIfDue() {
+	p.mu.Lock()
+	due := time.Since(p.prunedAt) > postgresPruneInterval
+	if due {
+		p.prunedAt = time.Now()
+	}
+	p.mu.Unlock()
+	if !due {
+		return
+	}
+
+	err := p.db.Where("updated_at < ?", time.Now().Add(-postgresBucketMaxIdle)).
+		Delete(&models.RateLimitBucketCore{}).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		p.loggers.Err.Printf("cannot prune rate limit buckets: %s", err.Error())
+	}
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormLogger "gorm.io/gorm/logger"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+// testPostgres connects to TEST_POSTGRES_DSN, the tests are skipped without it
+func testPostgres(t *testing.T) *gorm.DB {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: gormLogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&models.RateLimitBucketCore{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testKey(t *testing.T) string {
+	return t.Name() + ":" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func testLoggers() logger.Loggers {
+	return logger.Loggers{Info: log.New(io.Discard, "", 0), Err: log.New(io.Discard, "", 0)}
+}
+
+func TestPostgresLimiterBurst(t *testing.T) {
+	db := testPostgres(t)
+	key := testKey(t)
+	t.Cleanup(func() { db.Delete(&models.RateLimitBucketCore{}, "key = ?", key) })
+	limit := Limit{Rate: 1, Burst: 3}
+
+	// two replicas share the bucket
+	replicas := []*postgresLimiter{newPostgresLimiter(db, testLoggers()), newPostgresLimiter(db, testLoggers())}
+	for i := 0; i < limit.Burst; i++ {
+		if allowed, _, err := replicas[i%2].Allow(key, limit); err != nil || !allowed {
+			t.Fatalf("request %d: allowed = %v, err = %v", i+1, allowed, err)
+		}
+	}
+	allowed, retryAfter, err := replicas[1].Allow(key, limit)
+	if err != nil || allowed {
+		t.Fatalf("request over the burst: allowed = %v, err = %v", allowed, err)
+	}
+	if retryAfter <= 0 {
+		t.Errorf("retryAfter = %v", retryAfter)
+	}
+}
+
+func TestPostgresLimiterConcurrent(t *testing.T) {
+	db := testPostgres(t)
+	key := testKey(t)
+	t.Cleanup(func() { db.Delete(&models.RateLimitBucketCore{}, "key = ?", key) })
+	limit := Limit{Rate: 0, Burst: 5}
+	p := newPostgresLimiter(db, testLoggers())
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowedCount := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			allowed, _, err := p.Allow(key, limit)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if allowed {
+				mu.Lock()
+				allowedCount++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowedCount != limit.Burst {
+		t.Errorf("%d requests allowed, want %d", allowedCount, limit.Burst)
+	}
+}
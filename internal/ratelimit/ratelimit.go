@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/db"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+// Limit is a token bucket: Rate tokens per minute are added up to Burst
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// LimitFromConfig reads rate_limit.<name>.rate and rate_limit.<name>.burst
+func LimitFromConfig(name string) Limit {
+	return Limit{
+		Rate:  viper.GetFloat64("rate_limit." + name + ".rate"),
+		Burst: viper.GetInt("rate_limit." + name + ".burst"),
+	}
+}
+
+type Limiter interface {
+	// Allow takes a token from the bucket of the key, when the bucket is empty
+	// it returns false and the time until the next token
+	Allow(key string, limit Limit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// New selects the backend by rate_limit.backend, postgres is needed
+// when several replicas share the same clients
+func New(postgres db.PostgresDB, loggers logger.Loggers) Limiter {
+	switch backend := viper.GetString("rate_limit.backend"); backend {
+	case "postgres":
+		return newPostgresLimiter(postgres.DB, loggers)
+	case "memory", "":
+		return newMemoryLimiter()
+	default:
+		loggers.Err.Fatalf("unknown rate limit backend %s", backend)
+		return nil
+	}
+}
+
+// take refills the bucket for the time passed since updatedAt and takes one token
+func take(tokens float64, updatedAt, now time.Time, limit Limit) (float64, bool, time.Duration) {
+	perSecond := limit.Rate / 60
+	tokens = math.Min(float64(limit.Burst), tokens+now.Sub(updatedAt).Seconds()*perSecond)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	if perSecond <= 0 {
+		return tokens, false, time.Minute
+	}
+	return tokens, false, time.Duration((1 - tokens) / perSecond * float64(time.Second))
+}
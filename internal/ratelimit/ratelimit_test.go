@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	now := time.Now()
+	limit := Limit{Rate: 60, Burst: 5} // a token per second
+
+	cases := []struct {
+		name       string
+		tokens     float64
+		updatedAt  time.Time
+		limit      Limit
+		left       float64
+		allowed    bool
+		retryAfter time.Duration
+	}{
+		{"full bucket", 5, now, limit, 4, true, 0},
+		{"last token", 1, now, limit, 0, true, 0},
+		{"empty bucket", 0, now, limit, 0, false, time.Second},
+		{"half a token", 0.5, now, limit, 0.5, false, 500 * time.Millisecond},
+		{"refilled", 0, now.Add(-3 * time.Second), limit, 2, true, 0},
+		{"refill stops at burst", 0, now.Add(-time.Hour), limit, 4, true, 0},
+		{"no rate", 0, now.Add(-time.Hour), Limit{Rate: 0, Burst: 5}, 0, false, time.Minute},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			left, allowed, retryAfter := take(c.tokens, c.updatedAt, now, c.limit)
+			if math.Abs(left-c.left) > 1e-9 || allowed != c.allowed || retryAfter != c.retryAfter {
+				t.Errorf("take = %v, %v, %v, want %v, %v, %v", left, allowed, retryAfter, c.left, c.allowed, c.retryAfter)
+			}
+		})
+	}
+}
@@ -1,21 +1,31 @@
 package server
 
 import (
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go/v4"
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/keys"
 	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/ratelimit"
 	"github.com/robboworld/mosquitto-broker/internal/services"
+	http2 "github.com/robboworld/mosquitto-broker/internal/transports/http"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
 )
 
-func AuthMiddleware(errLogger *log.Logger) gin.HandlerFunc {
+func AuthMiddleware(
+	errLogger *log.Logger,
+	accessKeys keys.KeySet,
+	serviceAccountService services.ServiceAccountService,
+) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -31,10 +41,29 @@ func AuthMiddleware(errLogger *log.Logger) gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		data, err := jwt.ParseWithClaims(headerParts[1], &services.UserClaims{},
-			func(token *jwt.Token) (interface{}, error) {
-				return []byte(viper.GetString("auth_access_signing_key")), nil
-			})
+		if headerParts[0] == "ApiKey" {
+			principal, err := serviceAccountService.Authenticate(headerParts[1])
+			if err != nil {
+				errLogger.Printf("%s", err.Error())
+				var respErr utils.ResponseError
+				if errors.As(err, &respErr) {
+					c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				c.Abort()
+				return
+			}
+			c.Set(consts.KeyId, principal.UserId)
+			c.Set(consts.KeyRole, principal.Role)
+			c.Set(consts.KeyScopes, principal.Scopes)
+			if principal.ExpiresAt != nil {
+				c.Set(consts.KeyExpiresAt, *principal.ExpiresAt)
+			}
+			c.Next()
+			return
+		}
+		data, err := jwt.ParseWithClaims(headerParts[1], &services.UserClaims{}, accessKeys.Keyfunc)
 		if data == nil {
 			errLogger.Printf("%s", err.Error())
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
@@ -63,6 +92,61 @@ func AuthMiddleware(errLogger *log.Logger) gin.HandlerFunc {
 
 		c.Set(consts.KeyId, claims.Id)
 		c.Set(consts.KeyRole, claims.Role)
+		if claims.ExpiresAt != nil {
+			c.Set(consts.KeyExpiresAt, claims.ExpiresAt.Time)
+		}
 		c.Next()
 	}
 }
+
+func PermissionMiddleware(errLogger *log.Logger, roleService services.RoleService) http2.RequirePermission {
+	return func(permissions ...models.Permission) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			role := c.Value(consts.KeyRole).(models.Role)
+			scopes, isApiKey := c.Get(consts.KeyScopes)
+
+			for _, permission := range permissions {
+				allowed := roleService.HasPermission(role, permission)
+				if allowed && isApiKey {
+					allowed = false
+					for _, scope := range scopes.([]models.Scope) {
+						if scope.Covers(permission) {
+							allowed = true
+							break
+						}
+					}
+				}
+				if !allowed {
+					errLogger.Printf("%s: %s", consts.ErrAccessDenied, permission)
+					c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
+					c.Abort()
+					return
+				}
+			}
+			c.Next()
+		}
+	}
+}
+
+func RateLimitMiddleware(errLogger *log.Logger, limiter ratelimit.Limiter) http2.RateLimit {
+	return func(name string) gin.HandlerFunc {
+		limit := ratelimit.LimitFromConfig(name)
+		return func(c *gin.Context) {
+			allowed, retryAfter, err := limiter.Allow(name+":"+c.ClientIP()+":"+c.FullPath(), limit)
+			if err != nil {
+				// a broken limiter backend must not lock everybody out
+				errLogger.Printf("rate limiter: %s", err.Error())
+				c.Next()
+				return
+			}
+			if !allowed {
+				errLogger.Printf("%s: %s %s", consts.ErrTooManyRequests, c.ClientIP(), c.FullPath())
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": consts.ErrTooManyRequests})
+				c.Abort()
+				return
+			}
+			c.Next()
+		}
+	}
+}
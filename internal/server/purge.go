@@ -0,0 +1,40 @@
+package server
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/services"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+)
+
+// startPurge removes deleted users past the retention every deleted_users.purge_interval,
+// the returned func stops it
+func startPurge(loggers logger.Loggers, userService services.UserService) func() {
+	interval := viper.GetDuration("deleted_users.purge_interval")
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := userService.PurgeDeleted()
+			if err != nil {
+				loggers.Err.Printf("purge deleted users: %s", err.Error())
+			} else if purged > 0 {
+				loggers.Info.Printf("purged %d deleted users", purged)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
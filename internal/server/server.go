@@ -10,6 +10,9 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/internal/ratelimit"
+	"github.com/robboworld/mosquitto-broker/internal/services"
 	http2 "github.com/robboworld/mosquitto-broker/internal/transports/http"
 	"github.com/robboworld/mosquitto-broker/pkg/logger"
 )
@@ -19,30 +22,54 @@ func NewServer(
 	lifecycle fx.Lifecycle,
 	loggers logger.Loggers,
 	handlers http2.Handlers,
+	accessKeys keys.KeySet,
+	serviceAccountService services.ServiceAccountService,
+	roleService services.RoleService,
+	userService services.UserService,
+	contractService services.ContractService,
+	limiter ratelimit.Limiter,
 ) {
+	stopPurge := func() {}
+	stopValidator := func() {}
 	lifecycle.Append(
 		fx.Hook{
 			OnStart: func(ctx context.Context) (err error) {
 				serverHost := viper.GetString("server_host")
 				port := viper.GetString("http_server_port")
 				router := gin.Default()
+				// the rate limits are per client ip, a forwarded header of anyone
+				// else would let a client pick a new ip for each request
+				if err = router.SetTrustedProxies(viper.GetStringSlice("server.trusted_proxies")); err != nil {
+					return err
+				}
 				router.Use(
 					gin.Recovery(),
 					gin.Logger(),
-					AuthMiddleware(loggers.Err),
+					AuthMiddleware(loggers.Err, accessKeys, serviceAccountService),
 				)
 
+				requirePermission := PermissionMiddleware(loggers.Err, roleService)
+				rateLimit := RateLimitMiddleware(loggers.Err, limiter)
+
 				switch m {
 				case consts.Production:
-					handlers.AuthHandler.SetupAuthRoutes(router)
-					handlers.UserHandler.SetupUserRoutes(router)
-					handlers.MosquittoHandler.SetupMosquittoRoutes(router)
-					handlers.TopicHandler.SetupTopicRoutes(router)
+					handlers.AuthHandler.SetupAuthRoutes(router, rateLimit)
+					handlers.UserHandler.SetupUserRoutes(router, requirePermission)
+					handlers.MosquittoHandler.SetupMosquittoRoutes(router, requirePermission)
+					handlers.TopicHandler.SetupTopicRoutes(router, requirePermission)
+					handlers.ServiceAccountHandler.SetupServiceAccountRoutes(router, requirePermission)
+					handlers.RoleHandler.SetupRoleRoutes(router, requirePermission)
+					handlers.OrganizationHandler.SetupOrganizationRoutes(router, requirePermission)
+					handlers.AdminHandler.SetupAdminRoutes(router, requirePermission)
 				case consts.Development:
-					handlers.AuthHandler.SetupAuthRoutes(router)
-					handlers.UserHandler.SetupUserRoutes(router)
-					handlers.MosquittoHandler.SetupMosquittoRoutes(router)
-					handlers.TopicHandler.SetupTopicRoutes(router)
+					handlers.AuthHandler.SetupAuthRoutes(router, rateLimit)
+					handlers.UserHandler.SetupUserRoutes(router, requirePermission)
+					handlers.MosquittoHandler.SetupMosquittoRoutes(router, requirePermission)
+					handlers.TopicHandler.SetupTopicRoutes(router, requirePermission)
+					handlers.ServiceAccountHandler.SetupServiceAccountRoutes(router, requirePermission)
+					handlers.RoleHandler.SetupRoleRoutes(router, requirePermission)
+					handlers.OrganizationHandler.SetupOrganizationRoutes(router, requirePermission)
+					handlers.AdminHandler.SetupAdminRoutes(router, requirePermission)
 				}
 
 				server := &http.Server{
@@ -72,9 +99,13 @@ func NewServer(
 						loggers.Err.Fatalf("Failed to listen and serve: %v", err)
 					}
 				}()
+				stopPurge = startPurge(loggers, userService)
+				stopValidator = contractService.StartValidator()
 				return
 			},
 			OnStop: func(context.Context) error {
+				stopPurge()
+				stopValidator()
 				return nil
 			},
 		})
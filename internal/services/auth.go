@@ -1,7 +1,9 @@
 package services
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go/v4"
@@ -9,13 +11,25 @@ import (
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/internal/mailer"
 	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/oidc"
+	"github.com/robboworld/mosquitto-broker/internal/passwordpolicy"
+	"github.com/robboworld/mosquitto-broker/internal/ratelimit"
 	"github.com/robboworld/mosquitto-broker/pkg/utils"
 )
 
+// dummyPasswordHash is compared against when the email is unknown
+var dummyPasswordHash = utils.HashPassword("dummy password for unknown emails")
+
+// Tokens holds either the access and refresh pair or, when a second factor
+// is needed, only the challenge token
 type Tokens struct {
-	Access  string
-	Refresh string
+	Access        string
+	Refresh       string
+	Challenge     string
+	ChallengeType ChallengeType
 }
 
 type UserClaims struct {
@@ -25,81 +39,249 @@ type UserClaims struct {
 }
 
 type authService struct {
-	userGateway       gateways.UserGateway
-	mosquittoGateway  gateways.MosquittoGateway
-	accessSigningKey  []byte
-	accessTokenTTL    time.Duration
-	refreshSigningKey []byte
-	refreshTokenTTL   time.Duration
+	userGateway         gateways.UserGateway
+	mosquittoGateway    gateways.MosquittoGateway
+	accessKeys          keys.KeySet
+	accessTokenTTL      time.Duration
+	refreshSigningKey   []byte
+	refreshTokenTTL     time.Duration
+	limiter             ratelimit.Limiter
+	accountLimit        ratelimit.Limit
+	lockoutThreshold    int
+	lockoutBase         time.Duration
+	lockoutMax          time.Duration
+	totpIssuer          string
+	totpSkew            int
+	challengeKey        []byte
+	challengeTTL        time.Duration
+	recoveryCodeGateway gateways.RecoveryCodeGateway
+	emailTokenGateway   gateways.EmailTokenGateway
+	mailer              mailer.Mailer
+	verifyEmailURL      string
+	verifyEmailTTL      time.Duration
+	resetPasswordURL    string
+	resetPasswordTTL    time.Duration
+	changeEmailURL      string
+	changeEmailTTL      time.Duration
+	deleteAccountURL    string
+	deleteAccountTTL    time.Duration
+	passwordPolicy      passwordpolicy.Policy
+	oidc                oidc.Provider
+	oidcFlowKey         []byte
 }
 
 func NewAuthService(
 	userGateway gateways.UserGateway,
 	mosquittoGateway gateways.MosquittoGateway,
+	recoveryCodeGateway gateways.RecoveryCodeGateway,
+	emailTokenGateway gateways.EmailTokenGateway,
+	accessKeys keys.KeySet,
+	limiter ratelimit.Limiter,
+	mailer mailer.Mailer,
+	passwordPolicy passwordpolicy.Policy,
+	oidc oidc.Provider,
 ) *authService {
+	refreshSigningKey := []byte(viper.GetString("auth_refresh_signing_key"))
 	return &authService{
-		userGateway:       userGateway,
-		mosquittoGateway:  mosquittoGateway,
-		accessSigningKey:  []byte(viper.GetString("auth_access_signing_key")),
-		accessTokenTTL:    viper.GetDuration("auth_access_token_ttl"),
-		refreshSigningKey: []byte(viper.GetString("auth_refresh_signing_key")),
-		refreshTokenTTL:   viper.GetDuration("auth_refresh_token_ttl"),
+		userGateway:         userGateway,
+		mosquittoGateway:    mosquittoGateway,
+		accessKeys:          accessKeys,
+		accessTokenTTL:      viper.GetDuration("auth_access_token_ttl"),
+		refreshSigningKey:   refreshSigningKey,
+		refreshTokenTTL:     viper.GetDuration("auth_refresh_token_ttl"),
+		limiter:             limiter,
+		accountLimit:        ratelimit.LimitFromConfig("account"),
+		lockoutThreshold:    viper.GetInt("lockout.threshold"),
+		lockoutBase:         viper.GetDuration("lockout.base_duration"),
+		lockoutMax:          viper.GetDuration("lockout.max_duration"),
+		totpIssuer:          viper.GetString("two_factor.issuer"),
+		totpSkew:            viper.GetInt("two_factor.skew"),
+		challengeKey:        deriveKey(refreshSigningKey, "two-factor-challenge"),
+		challengeTTL:        viper.GetDuration("two_factor.challenge_ttl"),
+		recoveryCodeGateway: recoveryCodeGateway,
+		emailTokenGateway:   emailTokenGateway,
+		mailer:              mailer,
+		verifyEmailURL:      viper.GetString("mailer.verify_email_url"),
+		verifyEmailTTL:      viper.GetDuration("mailer.verify_email_ttl"),
+		resetPasswordURL:    viper.GetString("mailer.reset_password_url"),
+		resetPasswordTTL:    viper.GetDuration("mailer.reset_password_ttl"),
+		changeEmailURL:      viper.GetString("mailer.change_email_url"),
+		changeEmailTTL:      viper.GetDuration("mailer.change_email_ttl"),
+		deleteAccountURL:    viper.GetString("mailer.delete_account_url"),
+		deleteAccountTTL:    viper.GetDuration("mailer.delete_account_ttl"),
+		passwordPolicy:      passwordPolicy,
+		oidc:                oidc,
+		oidcFlowKey:         deriveKey(refreshSigningKey, "oidc-flow"),
 	}
 }
 
+// SignUp answers a registered email like a new one, the owner gets a letter
+// instead of a verification link, so the endpoint does not reveal accounts
 func (a *authService) SignUp(newUser models.UserCore) error {
-	if !utils.IsValidEmail(newUser.Email) {
-		return utils.ResponseError{
-			Code:    http.StatusBadRequest,
-			Message: consts.ErrIncorrectPasswordOrEmail,
+	newUser, brokerPasswordHash, err := a.prepareUser(newUser)
+	if err != nil {
+		return err
+	}
+
+	user, found, err := a.findByEmail(newUser.Email)
+	if err != nil {
+		return err
+	}
+	if found {
+		if user.PendingVerification {
+			return a.sendVerification(user)
 		}
+		return a.sendAlreadyRegistered(user)
 	}
 
-	exist, err := a.userGateway.DoesExistEmail(0, newUser.Email)
+	// broker credentials are written only after the email is verified
+	newUser.PendingVerification = true
+	newUser.BrokerPasswordHash = brokerPasswordHash
+
+	user, err = a.userGateway.Create(newUser)
 	if err != nil {
 		return err
 	}
-	if exist {
-		return utils.ResponseError{
-			Code:    http.StatusBadRequest,
-			Message: consts.ErrEmailAlreadyInUse,
+
+	return a.sendVerification(user)
+}
+
+// CreateUser adds an active user with broker credentials at once,
+// it is meant for the admin cli, the email is trusted
+func (a *authService) CreateUser(newUser models.UserCore) (models.UserCore, error) {
+	newUser, brokerPasswordHash, err := a.prepareUser(newUser)
+	if err != nil {
+		return models.UserCore{}, err
+	}
+	if err = a.checkEmailFree(0, newUser.Email); err != nil {
+		return models.UserCore{}, err
+	}
+
+	user, err := a.userGateway.Create(newUser)
+	if err != nil {
+		return models.UserCore{}, err
+	}
+	if err = a.mosquittoGateway.WriteMosquittoPasswdHash(user.Email, brokerPasswordHash); err != nil {
+		return models.UserCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
 		}
 	}
+	a.mosquittoGateway.WriteNewUserToAcl(user.Email)
+	a.mosquittoGateway.MosquittoReload()
+	return user, nil
+}
 
-	if len(newUser.Password) < 8 {
-		return utils.ResponseError{
+// prepareUser validates the email and the password and replaces the password
+// with its hash, the broker hash is returned apart. Whether the email is free
+// is up to the caller
+func (a *authService) prepareUser(newUser models.UserCore) (models.UserCore, string, error) {
+	if !utils.IsValidEmail(newUser.Email) {
+		return models.UserCore{}, "", utils.ResponseError{
 			Code:    http.StatusBadRequest,
-			Message: consts.ErrShortPassword,
+			Message: consts.ErrIncorrectPasswordOrEmail,
 		}
 	}
 
+	if err := a.passwordPolicy.Check(newUser.Password, newUser.Email); err != nil {
+		return models.UserCore{}, "", err
+	}
+
 	password := newUser.Password
-	passwordHash := utils.HashPassword(password)
-	newUser.Password = passwordHash
+	newUser.Password = utils.HashPassword(password)
 
-	if err = a.userGateway.Create(newUser); err != nil {
-		return err
+	brokerPasswordHash, err := a.mosquittoGateway.HashMosquittoPassword(password)
+	if err != nil {
+		return models.UserCore{}, "", utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
 	}
-
-	a.mosquittoGateway.WriteMosquittoPasswd(newUser.Email, password)
-	a.mosquittoGateway.WriteNewUserToAcl(newUser.Email)
-	return nil
+	return newUser, brokerPasswordHash, nil
 }
 
 func (a *authService) SignIn(email, password string) (Tokens, error) {
+	incorrect := utils.ResponseError{
+		Code:    http.StatusBadRequest,
+		Message: consts.ErrIncorrectPasswordOrEmail,
+	}
+
+	// the bucket is keyed by email, not by user, so unknown emails are throttled the same way
+	allowed, _, err := a.limiter.Allow("sign-in:"+strings.ToLower(email), a.accountLimit)
+	if err != nil {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if !allowed {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusTooManyRequests,
+			Message: consts.ErrTooManyRequests,
+		}
+	}
+
 	user, err := a.userGateway.GetByEmail(email)
 	if err != nil {
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) && respErr.Message == consts.ErrUserWithEmailNotFound {
+			// spend the same time as a real comparison so the response time does not reveal the email
+			_ = utils.ComparePassword(dummyPasswordHash, password)
+			return Tokens{}, incorrect
+		}
 		return Tokens{}, err
 	}
 
+	// a locked account answers like a wrong password after the same comparison,
+	// a distinct error would confirm that the email is registered
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		_ = utils.ComparePassword(user.Password, password)
+		return Tokens{}, incorrect
+	}
+
 	if err = utils.ComparePassword(user.Password, password); err != nil {
+		if err = a.failSignIn(user); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, incorrect
+	}
+
+	if user.PendingVerification {
 		return Tokens{}, utils.ResponseError{
-			Code:    http.StatusBadRequest,
-			Message: consts.ErrIncorrectPasswordOrEmail,
+			Code:    http.StatusForbidden,
+			Message: consts.ErrEmailNotVerified,
 		}
 	}
 
-	access, err := generateToken(user, a.accessTokenTTL, a.accessSigningKey)
+	return a.completeSignIn(user)
+}
+
+// completeSignIn is the last step of every sign in method
+func (a *authService) completeSignIn(user models.UserCore) (Tokens, error) {
+	if user.Disabled {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrUserDisabled,
+		}
+	}
+
+	// SuperAdmin without 2fa gets a challenge too, but it only allows enrolment
+	if user.TotpEnabled || user.Role == models.RoleSuperAdmin {
+		return a.challenge(user)
+	}
+	return a.issueTokens(user)
+}
+
+func (a *authService) issueTokens(user models.UserCore) (Tokens, error) {
+	// the failures in a row end only with a complete sign in, with 2fa after
+	// the code, so signing in again does not reset the count of wrong codes
+	if user.FailedSignIns > 0 {
+		if err := a.userGateway.SetSignInFailures(user.ID, 0, nil); err != nil {
+			return Tokens{}, err
+		}
+	}
+
+	access, err := generateAccessToken(user, a.accessTokenTTL, a.accessKeys.Signing())
 	if err != nil {
 		return Tokens{}, utils.ResponseError{
 			Code:    http.StatusInternalServerError,
@@ -118,18 +300,60 @@ func (a *authService) SignIn(email, password string) (Tokens, error) {
 	return Tokens{Access: access, Refresh: refresh}, nil
 }
 
+// failSignIn counts a wrong password or 2fa code and locks the account
+// once the failures in a row reach the threshold
+func (a *authService) failSignIn(user models.UserCore) error {
+	failedSignIns, err := a.userGateway.AddSignInFailure(user.ID)
+	if err != nil {
+		return err
+	}
+	if lockedUntil := a.lockedUntil(failedSignIns); lockedUntil != nil {
+		return a.userGateway.SetLockedUntil(user.ID, lockedUntil)
+	}
+	return nil
+}
+
+// lockedUntil doubles the lockout for every failure past the threshold
+func (a *authService) lockedUntil(failedSignIns int) *time.Time {
+	if a.lockoutThreshold <= 0 || failedSignIns < a.lockoutThreshold {
+		return nil
+	}
+	duration := a.lockoutBase
+	for i := a.lockoutThreshold; i < failedSignIns && duration < a.lockoutMax; i++ {
+		duration *= 2
+	}
+	if duration > a.lockoutMax {
+		duration = a.lockoutMax
+	}
+	lockedUntil := time.Now().Add(duration)
+	return &lockedUntil
+}
+
 func (a *authService) Refresh(token string) (string, error) {
 	claims, err := parseToken(token, a.refreshSigningKey)
 	if err != nil {
 		return "", err
 	}
 
-	user := models.UserCore{
-		ID:   claims.Id,
-		Role: claims.Role,
+	user, err := a.userGateway.GetById(claims.Id)
+	if err != nil {
+		return "", err
+	}
+	if user.Disabled {
+		return "", utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrUserDisabled,
+		}
+	}
+	if isRevoked(claims, user.SessionsRevokedAt) {
+		return "", utils.ResponseError{
+			Code:    http.StatusUnauthorized,
+			Message: consts.ErrSessionRevoked,
+		}
 	}
 
-	newAccessToken, err := generateToken(user, a.accessTokenTTL, a.accessSigningKey)
+	// the role comes from the db, a refresh token must not keep a revoked role
+	newAccessToken, err := generateAccessToken(user, a.accessTokenTTL, a.accessKeys.Signing())
 	if err != nil {
 		return "", utils.ResponseError{
 			Code:    http.StatusInternalServerError,
@@ -139,10 +363,31 @@ func (a *authService) Refresh(token string) (string, error) {
 	return newAccessToken, nil
 }
 
+func (a *authService) Jwks() keys.JWKS {
+	return a.accessKeys.JWKS()
+}
+
+// generateAccessToken signs with the asymmetric active key, so other services
+// can verify access tokens through the jwks endpoint without any shared secret
+func generateAccessToken(user models.UserCore, duration time.Duration, key keys.Key) (token string, err error) {
+	claims := UserClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: jwt.At(time.Now().Add(duration * time.Second)),
+		},
+		Id:   user.ID,
+		Role: user.Role,
+	}
+	ss := jwt.NewWithClaims(key.Method, claims)
+	ss.Header["kid"] = key.Kid
+	token, err = ss.SignedString(key.Private)
+	return token, err
+}
+
 func generateToken(user models.UserCore, duration time.Duration, signingKey []byte) (token string, err error) {
 	claims := UserClaims{
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: jwt.At(time.Now().Add(duration * time.Second)),
+			IssuedAt:  jwt.At(time.Now()),
 		},
 		Id:   user.ID,
 		Role: user.Role,
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/ratelimit"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const testPassword = "correct horse battery"
+
+func (f *fakeUserGateway) GetByEmail(email string) (models.UserCore, error) {
+	for _, user := range f.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return models.UserCore{}, utils.ResponseError{
+		Code:    http.StatusNotFound,
+		Message: consts.ErrUserWithEmailNotFound,
+	}
+}
+
+func (f *fakeUserGateway) SetSignInFailures(id uint, failedSignIns int, lockedUntil *time.Time) error {
+	user := f.users[id]
+	user.FailedSignIns, user.LockedUntil = failedSignIns, lockedUntil
+	f.users[id] = user
+	return nil
+}
+
+func (f *fakeUserGateway) AddSignInFailure(id uint) (int, error) {
+	user := f.users[id]
+	user.FailedSignIns++
+	f.users[id] = user
+	return user.FailedSignIns, nil
+}
+
+func (f *fakeUserGateway) SetLockedUntil(id uint, lockedUntil *time.Time) error {
+	user := f.users[id]
+	user.LockedUntil = lockedUntil
+	f.users[id] = user
+	return nil
+}
+
+type fakeLimiter struct {
+	allowed bool
+	keys    []string
+}
+
+func (f *fakeLimiter) Allow(key string, limit ratelimit.Limit) (bool, time.Duration, error) {
+	f.keys = append(f.keys, key)
+	return f.allowed, time.Second, nil
+}
+
+// newTestAuthService has a user with 2fa, so a successful sign in ends with
+// a challenge and needs no access token keys
+func newTestAuthService() (*authService, *fakeUserGateway) {
+	userGateway := &fakeUserGateway{users: map[uint]models.UserCore{
+		testOwnerId: {
+			ID:          testOwnerId,
+			Email:       "owner@example.com",
+			Password:    utils.HashPassword(testPassword),
+			Role:        models.RoleUser,
+			TotpEnabled: true,
+		},
+	}}
+	return &authService{
+		userGateway:      userGateway,
+		limiter:          &fakeLimiter{allowed: true},
+		lockoutThreshold: 3,
+		lockoutBase:      time.Minute,
+		lockoutMax:       time.Hour,
+		challengeKey:     []byte("challenge key"),
+		challengeTTL:     time.Minute,
+	}, userGateway
+}
+
+func isIncorrect(err error) bool {
+	respErr, ok := err.(utils.ResponseError)
+	return ok && respErr.Code == http.StatusBadRequest && respErr.Message == consts.ErrIncorrectPasswordOrEmail
+}
+
+func TestSignInLockout(t *testing.T) {
+	authService, userGateway := newTestAuthService()
+
+	for i := 1; i <= 3; i++ {
+		if _, err := authService.SignIn("owner@example.com", "wrong password"); !isIncorrect(err) {
+			t.Fatalf("wrong password %d: err = %v", i, err)
+		}
+		if failed := userGateway.users[testOwnerId].FailedSignIns; failed != i {
+			t.Fatalf("FailedSignIns = %d, want %d", failed, i)
+		}
+	}
+	lockedUntil := userGateway.users[testOwnerId].LockedUntil
+	if lockedUntil == nil || lockedUntil.Before(time.Now()) {
+		t.Fatalf("LockedUntil = %v after the threshold", lockedUntil)
+	}
+
+	// the right password is refused like a wrong one while locked
+	if _, err := authService.SignIn("owner@example.com", testPassword); !isIncorrect(err) {
+		t.Fatalf("locked account: err = %v, want the incorrect password error", err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	userGateway.SetLockedUntil(testOwnerId, &past)
+	tokens, err := authService.SignIn("owner@example.com", testPassword)
+	if err != nil {
+		t.Fatalf("after the lockout: err = %v", err)
+	}
+	if tokens.ChallengeType != ChallengeVerify {
+		t.Errorf("ChallengeType = %q, want %q", tokens.ChallengeType, ChallengeVerify)
+	}
+	// the failures are reset only once the 2fa code is verified
+	if failed := userGateway.users[testOwnerId].FailedSignIns; failed != 3 {
+		t.Errorf("FailedSignIns = %d after the password, want 3", failed)
+	}
+}
+
+func TestSignInUnknownEmail(t *testing.T) {
+	authService, _ := newTestAuthService()
+	if _, err := authService.SignIn("nobody@example.com", testPassword); !isIncorrect(err) {
+		t.Errorf("unknown email: err = %v, want the incorrect password error", err)
+	}
+}
+
+func TestSignInAccountLimit(t *testing.T) {
+	authService, userGateway := newTestAuthService()
+	limiter := &fakeLimiter{allowed: false}
+	authService.limiter = limiter
+
+	_, err := authService.SignIn("Owner@Example.com", testPassword)
+	if respErr, ok := err.(utils.ResponseError); !ok || respErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("err = %v, want 429", err)
+	}
+	if len(limiter.keys) != 1 || limiter.keys[0] != "sign-in:owner@example.com" {
+		t.Errorf("limiter keys = %v", limiter.keys)
+	}
+	if failed := userGateway.users[testOwnerId].FailedSignIns; failed != 0 {
+		t.Errorf("a throttled attempt counted as a failure: %d", failed)
+	}
+}
+
+func TestLockedUntil(t *testing.T) {
+	authService, _ := newTestAuthService()
+	cases := []struct {
+		failedSignIns int
+		duration      time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{9, time.Hour},
+		{100, time.Hour},
+	}
+	for _, c := range cases {
+		lockedUntil := authService.lockedUntil(c.failedSignIns)
+		if c.duration == 0 {
+			if lockedUntil != nil {
+				t.Errorf("%d failures: locked until %v", c.failedSignIns, lockedUntil)
+			}
+			continue
+		}
+		if lockedUntil == nil {
+			t.Errorf("%d failures: not locked", c.failedSignIns)
+			continue
+		}
+		if got := time.Until(*lockedUntil); got > c.duration || got < c.duration-time.Second {
+			t.Errorf("%d failures: locked for %v, want %v", c.failedSignIns, got, c.duration)
+		}
+	}
+
+	authService.lockoutThreshold = 0
+	if lockedUntil := authService.lockedUntil(100); lockedUntil != nil {
+		t.Errorf("threshold 0 locks until %v", lockedUntil)
+	}
+}
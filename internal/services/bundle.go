@@ -0,0 +1,542 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/mosquitto"
+	"github.com/robboworld/mosquitto-broker/internal/passwordpolicy"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type bundleService struct {
+	bundleGateway       gateways.BundleGateway
+	userGateway         gateways.UserGateway
+	topicGateway        gateways.TopicGateway
+	organizationGateway gateways.OrganizationGateway
+	mosquittoGateway    gateways.MosquittoGateway
+	roleService         RoleService
+	quotaService        QuotaService
+	passwordPolicy      passwordpolicy.Policy
+}
+
+func NewBundleService(
+	bundleGateway gateways.BundleGateway,
+	userGateway gateways.UserGateway,
+	topicGateway gateways.TopicGateway,
+	organizationGateway gateways.OrganizationGateway,
+	mosquittoGateway gateways.MosquittoGateway,
+	roleService RoleService,
+	quotaService QuotaService,
+	passwordPolicy passwordpolicy.Policy,
+) *bundleService {
+	return &bundleService{
+		bundleGateway:       bundleGateway,
+		userGateway:         userGateway,
+		topicGateway:        topicGateway,
+		organizationGateway: organizationGateway,
+		mosquittoGateway:    mosquittoGateway,
+		roleService:         roleService,
+		quotaService:        quotaService,
+		passwordPolicy:      passwordPolicy,
+	}
+}
+
+// importOwner is a topic owner of the import with the quota left to it
+type importOwner struct {
+	user  models.UserCore
+	quota models.Quota
+	usage models.QuotaUsage
+	names map[string]bool
+}
+
+// Import checks every row like the single endpoints do and creates the valid
+// ones in one transaction. The broker files are written once afterwards, users
+// imported without a password get no passwordfile entry until a password reset
+func (b *bundleService) Import(bundle models.BundleCore, dryRun bool, clientId uint, clientRole models.Role) (models.ImportReportCore, error) {
+	report := models.ImportReportCore{DryRun: dryRun, Errors: []models.ImportRowErrorCore{}}
+
+	clientOrganizationId, err := clientOrganization(b.userGateway, clientId)
+	if err != nil {
+		return models.ImportReportCore{}, err
+	}
+	organizations, err := b.organizationGateway.GetAll()
+	if err != nil {
+		return models.ImportReportCore{}, err
+	}
+	organizationsBySlug := make(map[string]models.OrganizationCore, len(organizations))
+	for _, organization := range organizations {
+		organizationsBySlug[organization.Slug] = organization
+	}
+
+	owners := make(map[string]*importOwner)
+	passwordHashes := make(map[string]string)
+	var users []models.UserCore
+	for _, bundleUser := range bundle.Users {
+		user, brokerPasswordHash, err := b.importUser(bundleUser, dryRun, clientOrganizationId, clientRole, organizationsBySlug, owners)
+		if err != nil {
+			report.Errors = append(report.Errors, models.ImportRowErrorCore{
+				Kind:  models.BundleKindUser,
+				Row:   bundleUser.Row,
+				Key:   bundleUser.Email,
+				Error: rowError(err),
+			})
+			continue
+		}
+		owners[user.Email] = &importOwner{
+			user:  user,
+			quota: b.quotaService.RoleQuota(user.Role),
+			names: make(map[string]bool),
+		}
+		if brokerPasswordHash != "" {
+			passwordHashes[user.Email] = brokerPasswordHash
+		}
+		users = append(users, user)
+	}
+
+	var topics []models.TopicCore
+	for _, bundleTopic := range bundle.Topics {
+		topic, err := b.importTopic(bundleTopic, clientOrganizationId, owners)
+		if err != nil {
+			report.Errors = append(report.Errors, models.ImportRowErrorCore{
+				Kind:  models.BundleKindTopic,
+				Row:   bundleTopic.Row,
+				Key:   bundleTopic.Owner + " " + bundleTopic.Name,
+				Error: rowError(err),
+			})
+			continue
+		}
+		topics = append(topics, topic)
+	}
+
+	report.Users = len(users)
+	report.Topics = len(topics)
+	if dryRun || (len(users) == 0 && len(topics) == 0) {
+		return report, nil
+	}
+
+	if err = b.bundleGateway.Import(users, topics); err != nil {
+		return models.ImportReportCore{}, err
+	}
+	if len(passwordHashes) > 0 {
+		if err = b.mosquittoGateway.WriteMosquittoPasswdHashes(passwordHashes); err != nil {
+			return models.ImportReportCore{}, utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}
+		}
+	}
+	aclUsers, _, err := brokerAclUsers(b.userGateway, b.topicGateway)
+	if err != nil {
+		return models.ImportReportCore{}, err
+	}
+	if err = b.mosquittoGateway.WriteAcl(aclUsers); err != nil {
+		return models.ImportReportCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	b.mosquittoGateway.MosquittoReload()
+	return report, nil
+}
+
+// importUser returns the user to create and its passwordfile hash, empty when
+// the row has no password. Hashing is skipped on a dry run
+func (b *bundleService) importUser(bundleUser models.BundleUserCore, dryRun bool,
+	clientOrganizationId *uint, clientRole models.Role,
+	organizationsBySlug map[string]models.OrganizationCore, owners map[string]*importOwner) (models.UserCore, string, error) {
+	if !utils.IsValidEmail(bundleUser.Email) {
+		return models.UserCore{}, "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidEmail,
+		}
+	}
+	exist := owners[bundleUser.Email] != nil
+	if !exist {
+		var err error
+		if exist, err = b.userGateway.DoesExistEmail(0, bundleUser.Email); err != nil {
+			return models.UserCore{}, "", err
+		}
+	}
+	if exist {
+		return models.UserCore{}, "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrEmailAlreadyInUse,
+		}
+	}
+
+	user := models.UserCore{
+		Email:    bundleUser.Email,
+		FullName: bundleUser.FullName,
+		Role:     bundleUser.Role,
+	}
+	if user.Role == "" {
+		user.Role = models.RoleUser
+	}
+	if !isKnownRole(user.Role) || user.Role == models.RoleAnonymous {
+		return models.UserCore{}, "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrUnknownRole,
+		}
+	}
+	// the same rule as SetRole, users:write:any alone must not create a SuperAdmin
+	if err := checkPrivilegedRole(b.roleService, user.Role, clientRole); err != nil {
+		return models.UserCore{}, "", err
+	}
+
+	if bundleUser.Organization != "" {
+		organization, found := organizationsBySlug[strings.ToLower(bundleUser.Organization)]
+		if !found {
+			return models.UserCore{}, "", utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrUnknownOrganization,
+			}
+		}
+		user.OrganizationId = &organization.ID
+	}
+	// a client in an organization imports only into it
+	if clientOrganizationId != nil {
+		if user.OrganizationId != nil && *user.OrganizationId != *clientOrganizationId {
+			return models.UserCore{}, "", utils.ResponseError{
+				Code:    http.StatusForbidden,
+				Message: consts.ErrAccessDenied,
+			}
+		}
+		user.OrganizationId = clientOrganizationId
+	}
+	if user.Role == models.RoleSuperAdmin && user.OrganizationId != nil {
+		return models.UserCore{}, "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrSuperAdminInOrganization,
+		}
+	}
+
+	password := bundleUser.Password
+	if password != "" {
+		if err := b.passwordPolicy.Check(password, user.Email); err != nil {
+			return models.UserCore{}, "", err
+		}
+	} else {
+		// nobody knows the password, it is set through the password reset
+		random, err := randomString(32)
+		if err != nil {
+			return models.UserCore{}, "", utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}
+		}
+		password = random
+	}
+	if dryRun {
+		return user, "", nil
+	}
+
+	user.Password = utils.HashPassword(password)
+	if bundleUser.Password == "" {
+		return user, "", nil
+	}
+	brokerPasswordHash, err := b.mosquittoGateway.HashMosquittoPassword(password)
+	if err != nil {
+		return models.UserCore{}, "", utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return user, brokerPasswordHash, nil
+}
+
+// importTopic checks the topic against its owner, who is a user of the import
+// or an existing one, and counts it into the quota of the owner
+func (b *bundleService) importTopic(bundleTopic models.BundleTopicCore, clientOrganizationId *uint,
+	owners map[string]*importOwner) (models.TopicCore, error) {
+	owner, found := owners[bundleTopic.Owner]
+	if !found {
+		user, err := b.userGateway.GetByEmail(bundleTopic.Owner)
+		if err != nil {
+			var respErr utils.ResponseError
+			if errors.As(err, &respErr) && respErr.Message == consts.ErrNotFoundInDB {
+				return models.TopicCore{}, utils.ResponseError{
+					Code:    http.StatusBadRequest,
+					Message: consts.ErrUserWithEmailNotFound,
+				}
+			}
+			return models.TopicCore{}, err
+		}
+		if !inOrganization(clientOrganizationId, user.OrganizationId) {
+			return models.TopicCore{}, utils.ResponseError{
+				Code:    http.StatusForbidden,
+				Message: consts.ErrAccessDenied,
+			}
+		}
+		quota, usage, err := b.quotaService.Get(user.ID)
+		if err != nil {
+			return models.TopicCore{}, err
+		}
+		owner = &importOwner{user: user, quota: quota, usage: usage, names: make(map[string]bool)}
+		owners[user.Email] = owner
+	}
+
+	if err := validTopicName(bundleTopic.Name); err != nil {
+		return models.TopicCore{}, err
+	}
+	topic := models.TopicCore{
+		CanRead:     bundleTopic.CanRead,
+		CanWrite:    bundleTopic.CanWrite,
+		Description: bundleTopic.Description,
+		ContentType: bundleTopic.ContentType,
+		Qos:         bundleTopic.Qos,
+		Retained:    bundleTopic.Retained,
+		Contact:     bundleTopic.Contact,
+	}
+	topic.SetTags(bundleTopic.Tags)
+	if err := validTopicMetadata(&topic); err != nil {
+		return models.TopicCore{}, err
+	}
+	if owner.quota.MaxTopicDepth > 0 && topicDepth(bundleTopic.Name) > owner.quota.MaxTopicDepth {
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: consts.ErrTopicTooDeep,
+		}
+	}
+	grant := bundleTopic.CanRead || bundleTopic.CanWrite
+	if exceeded(owner.quota.MaxTopics, owner.usage.Topics) {
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrTopicQuotaExceeded,
+		}
+	}
+	if grant && exceeded(owner.quota.MaxGrants, owner.usage.Grants) {
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrGrantQuotaExceeded,
+		}
+	}
+
+	name, err := namespace(b.organizationGateway, b.roleService, owner.user, bundleTopic.Name)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	exist := owner.names[name]
+	if !exist && owner.user.ID != 0 {
+		if exist, err = b.topicGateway.DoesExist(0, owner.user.ID, name); err != nil {
+			return models.TopicCore{}, err
+		}
+	}
+	if exist {
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTopicAlreadyExist,
+		}
+	}
+
+	owner.names[name] = true
+	owner.usage.Topics++
+	if grant {
+		owner.usage.Grants++
+	}
+	topic.Name = name
+	topic.OrganizationId = owner.user.OrganizationId
+	topic.User = models.UserCore{Email: owner.user.Email}
+	return topic, nil
+}
+
+// Export returns the users and topics the client reaches in the import format
+func (b *bundleService) Export(clientId uint) (models.BundleCore, error) {
+	organizationId, err := clientOrganization(b.userGateway, clientId)
+	if err != nil {
+		return models.BundleCore{}, err
+	}
+	organizations, err := b.organizationGateway.GetAll()
+	if err != nil {
+		return models.BundleCore{}, err
+	}
+	organizationsById := make(map[uint]models.OrganizationCore, len(organizations))
+	for _, organization := range organizations {
+		organizationsById[organization.ID] = organization
+	}
+
+	users, _, err := b.userGateway.GetAll(0, -1, "", organizationId)
+	if err != nil {
+		return models.BundleCore{}, err
+	}
+	topics, _, err := b.topicGateway.GetAll(0, -1, organizationId)
+	if err != nil {
+		return models.BundleCore{}, err
+	}
+
+	bundle := models.BundleCore{}
+	emails := make(map[uint]string, len(users))
+	for _, user := range users {
+		emails[user.ID] = user.Email
+		bundleUser := models.BundleUserCore{
+			Email:    user.Email,
+			FullName: user.FullName,
+			Role:     user.Role,
+		}
+		if user.OrganizationId != nil {
+			bundleUser.Organization = organizationsById[*user.OrganizationId].Slug
+		}
+		bundle.Users = append(bundle.Users, bundleUser)
+	}
+	for _, topic := range topics {
+		owner, found := emails[topic.UserId]
+		if !found {
+			continue
+		}
+		name := topic.Name
+		if topic.OrganizationId != nil {
+			name = strings.TrimPrefix(name, organizationsById[*topic.OrganizationId].TopicPrefix())
+		}
+		bundle.Topics = append(bundle.Topics, models.BundleTopicCore{
+			Owner:       owner,
+			Name:        name,
+			CanRead:     topic.CanRead,
+			CanWrite:    topic.CanWrite,
+			Description: topic.Description,
+			Tags:        topic.TagNames(),
+			ContentType: topic.ContentType,
+			Qos:         topic.Qos,
+			Retained:    topic.Retained,
+			Contact:     topic.Contact,
+		})
+	}
+	return bundle, nil
+}
+
+// rowError is the message of a row error, without the status code
+func rowError(err error) string {
+	var respErr utils.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.Message
+	}
+	return err.Error()
+}
+
+// AdoptReport lists what a broker takeover created, on a dry run what it
+// would create, and every line of the files it left out
+type AdoptReport struct {
+	Users    int
+	Topics   int
+	Problems []mosquitto.LineProblem
+}
+
+// Adopt takes over a broker maintained by hand. Every passwordfile entry becomes
+// a user who must reset the password, since only the mosquitto hash is known,
+// and the acl block of the user becomes its topics. Quotas are not applied, the
+// broker already grants this access. The files stay as they are, broker
+// reconcile later rewrites them in the form of the db
+func (b *bundleService) Adopt(passwdFile, aclFile string, role models.Role, dryRun bool) (AdoptReport, error) {
+	if role == "" {
+		role = models.RoleUser
+	}
+	if !isKnownRole(role) || role == models.RoleAnonymous {
+		return AdoptReport{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrUnknownRole,
+		}
+	}
+
+	installation, err := b.mosquittoGateway.ReadMosquittoInstallation(passwdFile, aclFile)
+	if err != nil {
+		return AdoptReport{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	report := AdoptReport{Problems: installation.Problems}
+	problem := func(file string, line int, text, reason string) {
+		report.Problems = append(report.Problems, mosquitto.LineProblem{File: file, Line: line, Text: text, Reason: reason})
+	}
+
+	var users []models.UserCore
+	newUsers := make(map[string]models.UserCore)
+	serviceUsername := mosquitto.ServiceUsername()
+	for _, entry := range installation.Passwd {
+		if entry.Username == serviceUsername {
+			continue
+		}
+		text := entry.Username + ":..."
+		if !utils.IsValidEmail(entry.Username) {
+			problem(installation.PasswdFile, entry.Line, text, "username is not an email, users sign in by email")
+			continue
+		}
+		exist, err := b.userGateway.DoesExistEmail(0, entry.Username)
+		if err != nil {
+			return AdoptReport{}, err
+		}
+		if exist {
+			problem(installation.PasswdFile, entry.Line, text, "user already exists")
+			continue
+		}
+
+		user := models.UserCore{
+			Email:                 entry.Username,
+			Role:                  role,
+			PasswordResetRequired: true,
+		}
+		if !dryRun {
+			// nobody knows the password, it is set through the password reset
+			password, err := randomString(32)
+			if err != nil {
+				return AdoptReport{}, utils.ResponseError{
+					Code:    http.StatusInternalServerError,
+					Message: err.Error(),
+				}
+			}
+			user.Password = utils.HashPassword(password)
+		}
+		newUsers[user.Email] = user
+		users = append(users, user)
+	}
+
+	var topics []models.TopicCore
+	for _, aclUser := range installation.Acl {
+		if aclUser.Username == serviceUsername {
+			continue
+		}
+		user, found := newUsers[aclUser.Username]
+		if !found {
+			problem(installation.AclFile, aclUser.Line, "user "+aclUser.Username,
+				"no new user from the passwordfile, the topics of the block are skipped")
+			continue
+		}
+		names := make(map[string]bool)
+		for _, aclTopic := range aclUser.Topics {
+			text := "topic " + aclTopic.Name
+			if err = validTopicName(aclTopic.Name); err != nil {
+				problem(installation.AclFile, aclTopic.Line, text, rowError(err))
+				continue
+			}
+			name, err := namespace(b.organizationGateway, b.roleService, user, aclTopic.Name)
+			if err != nil {
+				problem(installation.AclFile, aclTopic.Line, text, rowError(err))
+				continue
+			}
+			if names[name] {
+				problem(installation.AclFile, aclTopic.Line, text, consts.ErrTopicAlreadyExist)
+				continue
+			}
+			names[name] = true
+			topics = append(topics, models.TopicCore{
+				Name:     name,
+				CanRead:  aclTopic.CanRead,
+				CanWrite: aclTopic.CanWrite,
+				User:     models.UserCore{Email: user.Email},
+			})
+		}
+	}
+
+	report.Users = len(users)
+	report.Topics = len(topics)
+	if dryRun || len(users) == 0 {
+		return report, nil
+	}
+	if err = b.bundleGateway.Import(users, topics); err != nil {
+		return AdoptReport{}, err
+	}
+	return report, nil
+}
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/mqtt"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const (
+	maxSchemaBytes = 64 << 10
+
+	defaultContractFlushInterval = 10 * time.Second
+	defaultKeepViolations        = 20
+	defaultSampleBytes           = 4096
+)
+
+type contractService struct {
+	loggers         logger.Loggers
+	contractGateway gateways.ContractGateway
+	topicGateway    gateways.TopicGateway
+	userGateway     gateways.UserGateway
+	roleService     RoleService
+	mqttClient      mqtt.Client
+	flushInterval   time.Duration
+	keepViolations  int
+	sampleBytes     int
+
+	mu      sync.Mutex
+	watched map[uint]*watchedContract
+}
+
+// watchedContract is a contract the validator is subscribed for, with the
+// counters and samples not flushed yet
+type watchedContract struct {
+	topicId         uint
+	filter          string
+	updatedAt       time.Time
+	schema          *jsonschema.Schema
+	unsubscribe     func()
+	messages        int64
+	violations      int64
+	lastViolationAt *time.Time
+	samples         []models.TopicViolationCore
+}
+
+func NewContractService(
+	loggers logger.Loggers,
+	contractGateway gateways.ContractGateway,
+	topicGateway gateways.TopicGateway,
+	userGateway gateways.UserGateway,
+	roleService RoleService,
+	mqttClient mqtt.Client,
+) *contractService {
+	flushInterval := viper.GetDuration("contracts.flush_interval")
+	if flushInterval <= 0 {
+		flushInterval = defaultContractFlushInterval
+	}
+	keepViolations := viper.GetInt("contracts.keep_violations")
+	if keepViolations <= 0 {
+		keepViolations = defaultKeepViolations
+	}
+	sampleBytes := viper.GetInt("contracts.sample_bytes")
+	if sampleBytes <= 0 {
+		sampleBytes = defaultSampleBytes
+	}
+	return &contractService{
+		loggers:         loggers,
+		contractGateway: contractGateway,
+		topicGateway:    topicGateway,
+		userGateway:     userGateway,
+		roleService:     roleService,
+		mqttClient:      mqttClient,
+		flushInterval:   flushInterval,
+		keepViolations:  keepViolations,
+		sampleBytes:     sampleBytes,
+		watched:         make(map[uint]*watchedContract),
+	}
+}
+
+// SetSchema attaches the schema to the topic or replaces it, the validator
+// picks it up within contracts.flush_interval
+func (c *contractService) SetSchema(topicId uint, schema string, clientId uint, clientRole models.Role) (models.TopicContractCore, error) {
+	topic, err := c.topicGateway.GetById(topicId)
+	if err != nil {
+		return models.TopicContractCore{}, err
+	}
+	if err = checkTopicAccess(c.userGateway, c.roleService, topic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return models.TopicContractCore{}, err
+	}
+	if len(schema) > maxSchemaBytes {
+		return models.TopicContractCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrSchemaTooLarge,
+		}
+	}
+	if _, err = compileSchema(schema); err != nil {
+		return models.TopicContractCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidSchema + ": " + err.Error(),
+		}
+	}
+	return c.contractGateway.Set(topicId, schema)
+}
+
+func (c *contractService) GetSchema(topicId uint, clientId uint, clientRole models.Role) (models.TopicContractCore, error) {
+	topic, err := c.topicGateway.GetById(topicId)
+	if err != nil {
+		return models.TopicContractCore{}, err
+	}
+	if err = checkTopicAccess(c.userGateway, c.roleService, topic, clientId, clientRole, models.PermissionTopicsReadAny); err != nil {
+		return models.TopicContractCore{}, err
+	}
+	return c.contractGateway.Get(topicId)
+}
+
+func (c *contractService) DeleteSchema(topicId uint, clientId uint, clientRole models.Role) error {
+	topic, err := c.topicGateway.GetById(topicId)
+	if err != nil {
+		return err
+	}
+	if err = checkTopicAccess(c.userGateway, c.roleService, topic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return err
+	}
+	return c.contractGateway.Delete(topicId)
+}
+
+// GetViolations returns the contract with its counters and the latest samples, newest first
+func (c *contractService) GetViolations(topicId uint, page, pageSize *int, clientId uint, clientRole models.Role) (
+	models.TopicContractCore, []models.TopicViolationCore, uint, error) {
+	contract, err := c.GetSchema(topicId, clientId, clientRole)
+	if err != nil {
+		return models.TopicContractCore{}, []models.TopicViolationCore{}, 0, err
+	}
+	offset, limit := utils.GetOffsetAndLimit(page, pageSize)
+	violations, countRows, err := c.contractGateway.GetViolations(topicId, offset, limit)
+	if err != nil {
+		return models.TopicContractCore{}, []models.TopicViolationCore{}, 0, err
+	}
+	return contract, violations, countRows, nil
+}
+
+// StartValidator subscribes to the topics with a contract and validates what is
+// published to them, the returned func stops it. Without the internal mqtt
+// client nothing is validated
+func (c *contractService) StartValidator() func() {
+	if c.mqttClient == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(c.flushInterval)
+		defer ticker.Stop()
+		for {
+			c.flush()
+			c.sync()
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				c.flush()
+				c.mu.Lock()
+				for topicId, w := range c.watched {
+					w.unsubscribe()
+					delete(c.watched, topicId)
+				}
+				c.mu.Unlock()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// sync subscribes for new and replaced contracts and drops removed ones
+func (c *contractService) sync() {
+	contracts, err := c.contractGateway.GetAll()
+	if err != nil {
+		c.loggers.Err.Printf("load contracts: %s", err.Error())
+		return
+	}
+
+	current := make(map[uint]bool, len(contracts))
+	for _, contract := range contracts {
+		current[contract.TopicId] = true
+		c.mu.Lock()
+		w, found := c.watched[contract.TopicId]
+		c.mu.Unlock()
+		if found && w.updatedAt.Equal(contract.UpdatedAt) && w.filter == contract.Topic.Name {
+			continue
+		}
+		if found {
+			c.unwatch(contract.TopicId)
+		}
+		c.watch(contract)
+	}
+
+	c.mu.Lock()
+	var removed []uint
+	for topicId := range c.watched {
+		if !current[topicId] {
+			removed = append(removed, topicId)
+		}
+	}
+	c.mu.Unlock()
+	for _, topicId := range removed {
+		c.unwatch(topicId)
+	}
+}
+
+func (c *contractService) watch(contract models.TopicContractCore) {
+	schema, err := compileSchema(contract.Schema)
+	if err != nil {
+		c.loggers.Err.Printf("schema of topic %d: %s", contract.TopicId, err.Error())
+		return
+	}
+	w := &watchedContract{
+		topicId:   contract.TopicId,
+		filter:    contract.Topic.Name,
+		updatedAt: contract.UpdatedAt,
+		schema:    schema,
+	}
+	unsubscribe, err := c.mqttClient.Subscribe(w.filter, func(message mqtt.Message) {
+		c.validate(w, message)
+	})
+	if err != nil {
+		c.loggers.Err.Printf("subscribe to %s: %s", w.filter, err.Error())
+		return
+	}
+	w.unsubscribe = unsubscribe
+
+	c.mu.Lock()
+	c.watched[w.topicId] = w
+	c.mu.Unlock()
+}
+
+// unwatch drops the counters that were not flushed, they belong to a replaced schema
+func (c *contractService) unwatch(topicId uint) {
+	c.mu.Lock()
+	w, found := c.watched[topicId]
+	delete(c.watched, topicId)
+	c.mu.Unlock()
+	if found {
+		w.unsubscribe()
+	}
+}
+
+// validate skips retained messages, the broker sends them again on every
+// subscribe. They were validated when they were published
+func (c *contractService) validate(w *watchedContract, message mqtt.Message) {
+	if message.Retain {
+		return
+	}
+	err := validatePayload(w.schema, message.Payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.messages++
+	if err == nil {
+		return
+	}
+	w.violations++
+	receivedAt := message.ReceivedAt
+	w.lastViolationAt = &receivedAt
+	if len(w.samples) >= c.keepViolations {
+		w.samples = w.samples[1:]
+	}
+	payload, encoding, truncated := samplePayload(message.Payload, c.sampleBytes)
+	w.samples = append(w.samples, models.TopicViolationCore{
+		CreatedAt:       receivedAt,
+		TopicId:         w.topicId,
+		MqttTopic:       message.Topic,
+		Payload:         payload,
+		PayloadEncoding: encoding,
+		Truncated:       truncated,
+		Error:           err.Error(),
+	})
+}
+
+func (c *contractService) flush() {
+	var pending []watchedContract
+	c.mu.Lock()
+	for _, w := range c.watched {
+		if w.messages == 0 {
+			continue
+		}
+		pending = append(pending, *w)
+		w.messages = 0
+		w.violations = 0
+		w.lastViolationAt = nil
+		w.samples = nil
+	}
+	c.mu.Unlock()
+
+	for _, w := range pending {
+		if err := c.contractGateway.AddStats(w.topicId, w.updatedAt, w.messages, w.violations,
+			w.lastViolationAt, w.samples, c.keepViolations); err != nil {
+			c.loggers.Err.Printf("save contract stats of topic %d: %s", w.topicId, err.Error())
+		}
+	}
+}
+
+// compileSchema accepts references inside the schema only, a $ref to a file
+// or an url would let the schema read the disk or the network of the server
+func compileSchema(source string) (*jsonschema.Schema, error) {
+	if !json.Valid([]byte(source)) {
+		return nil, errors.New("not json")
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%s: only references inside the schema are allowed", s)
+	}
+	if err := compiler.AddResource("schema.json", strings.NewReader(source)); err != nil {
+		return nil, err
+	}
+	schema, err := compiler.Compile("schema.json")
+	// the url of the schema is a path of the server, only the cause is returned
+	var schemaErr *jsonschema.SchemaError
+	if errors.As(err, &schemaErr) {
+		return nil, schemaErr.Err
+	}
+	return schema, err
+}
+
+// validatePayload returns the first leaf error of the validation as
+// "location: message", the location is a json pointer into the payload
+func validatePayload(schema *jsonschema.Schema, payload []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("payload is not json: %v", err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("payload is not json: data after the value")
+	}
+
+	err := schema.Validate(value)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+	for len(validationErr.Causes) > 0 {
+		validationErr = validationErr.Causes[0]
+	}
+	location := validationErr.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+	return fmt.Errorf("%s: %s", location, validationErr.Message)
+}
+
+// samplePayload cuts the payload to maxBytes and encodes it
+func samplePayload(payload []byte, maxBytes int) (text, encoding string, truncated bool) {
+	payload, truncated = cutPayload(payload, maxBytes)
+	text, encoding = models.EncodePayload(payload)
+	return text, encoding, truncated
+}
+
+// cutPayload cuts the payload to maxBytes, text is cut on a rune boundary
+func cutPayload(payload []byte, maxBytes int) ([]byte, bool) {
+	if len(payload) <= maxBytes {
+		return payload, false
+	}
+	cut := maxBytes
+	if utf8.Valid(payload) {
+		for cut > 0 && !utf8.RuneStart(payload[cut]) {
+			cut--
+		}
+	}
+	return payload[:cut], true
+}
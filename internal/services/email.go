@@ -0,0 +1,317 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+func (a *authService) VerifyEmail(token string) error {
+	emailToken, err := a.emailTokenGateway.Consume(models.EmailTokenVerifyEmail, hashSecret(token))
+	if err != nil {
+		return err
+	}
+	user, err := a.userGateway.GetById(emailToken.UserId)
+	if err != nil {
+		return err
+	}
+	return a.activate(user)
+}
+
+// activate writes the broker credentials kept since sign up
+func (a *authService) activate(user models.UserCore) error {
+	if !user.PendingVerification {
+		return nil
+	}
+
+	if err := a.mosquittoGateway.WriteMosquittoPasswdHash(user.Email, user.BrokerPasswordHash); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	a.mosquittoGateway.WriteNewUserToAcl(user.Email)
+	if err := a.userGateway.SetVerified(user.ID); err != nil {
+		return err
+	}
+	a.mosquittoGateway.MosquittoReload()
+	return nil
+}
+
+// ResendVerification, like ForgotPassword, answers the same for unknown emails
+func (a *authService) ResendVerification(email string) error {
+	user, found, err := a.findByEmail(email)
+	if err != nil || !found || !user.PendingVerification {
+		return err
+	}
+	return a.sendVerification(user)
+}
+
+// ForgotPassword answers a disabled user like an unknown email, a reset would
+// write the passwordfile entry removed on disabling
+func (a *authService) ForgotPassword(email string) error {
+	user, found, err := a.findByEmail(email)
+	if err != nil || !found || user.Disabled {
+		return err
+	}
+
+	token, err := a.newEmailToken(models.EmailTokenCore{
+		UserId:  user.ID,
+		Purpose: models.EmailTokenResetPassword,
+	}, a.resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+	body := "A password reset was requested for your account.\n\n" +
+		"Open the link to choose a new password, it is valid for " + a.resetPasswordTTL.String() + ":\n" +
+		withToken(a.resetPasswordURL, token) + "\n\n" +
+		"If you did not request it, ignore this letter."
+	return a.send(user.Email, "Password reset", body)
+}
+
+// ResetPassword proves the ownership of the email as well,
+// so a user pending verification gets verified
+func (a *authService) ResetPassword(token, password string) error {
+	// the token is consumed only after the policy check, a weak password must not burn the link
+	emailToken, err := a.emailTokenGateway.Get(models.EmailTokenResetPassword, hashSecret(token))
+	if err != nil {
+		return err
+	}
+	user, err := a.userGateway.GetById(emailToken.UserId)
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrUserDisabled,
+		}
+	}
+	if err = a.passwordPolicy.Check(password, user.Email); err != nil {
+		return err
+	}
+	if _, err = a.emailTokenGateway.Consume(models.EmailTokenResetPassword, hashSecret(token)); err != nil {
+		return err
+	}
+
+	if err = a.setPassword(user, password); err != nil {
+		return err
+	}
+	if user.PendingVerification {
+		a.mosquittoGateway.WriteNewUserToAcl(user.Email)
+		if err = a.userGateway.SetVerified(user.ID); err != nil {
+			return err
+		}
+	}
+	a.mosquittoGateway.MosquittoReload()
+
+	// whoever knew the old password is signed out
+	if err = a.userGateway.RevokeSessions(user.ID, time.Now()); err != nil {
+		return err
+	}
+	return a.emailTokenGateway.DeleteByUserId(user.ID, models.EmailTokenResetPassword)
+}
+
+// RequestEmailChange mails a confirmation link to the new address,
+// the email stays the same until the link is opened
+func (a *authService) RequestEmailChange(clientId uint, password, newEmail string) error {
+	user, err := a.userGateway.GetById(clientId)
+	if err != nil {
+		return err
+	}
+	if err = utils.ComparePassword(user.Password, password); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrIncorrectPassword,
+		}
+	}
+	if !utils.IsValidEmail(newEmail) {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidEmail,
+		}
+	}
+	if newEmail == user.Email {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrSameEmail,
+		}
+	}
+	if err = a.checkEmailFree(user.ID, newEmail); err != nil {
+		return err
+	}
+
+	token, err := a.newEmailToken(models.EmailTokenCore{
+		UserId:   user.ID,
+		Purpose:  models.EmailTokenChangeEmail,
+		NewEmail: newEmail,
+	}, a.changeEmailTTL)
+	if err != nil {
+		return err
+	}
+	body := "A change of the account email to this address was requested.\n\n" +
+		"Open the link to confirm it, it is valid for " + a.changeEmailTTL.String() + ":\n" +
+		withToken(a.changeEmailURL, token) + "\n\n" +
+		"If you did not request it, ignore this letter."
+	return a.send(newEmail, "Confirm your new email", body)
+}
+
+// ConfirmEmailChange renames the broker user first, since the broker username
+// is the email, and renames it back when the db update fails
+func (a *authService) ConfirmEmailChange(token string) error {
+	emailToken, err := a.emailTokenGateway.Consume(models.EmailTokenChangeEmail, hashSecret(token))
+	if err != nil {
+		return err
+	}
+	user, err := a.userGateway.GetById(emailToken.UserId)
+	if err != nil {
+		return err
+	}
+	// the address could have been taken since the request
+	if err = a.checkEmailFree(user.ID, emailToken.NewEmail); err != nil {
+		return err
+	}
+
+	oldEmail := user.Email
+	if err = a.mosquittoGateway.RenameMosquittoUser(oldEmail, emailToken.NewEmail); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if err = a.userGateway.SetEmail(user.ID, emailToken.NewEmail); err != nil {
+		if renameErr := a.mosquittoGateway.RenameMosquittoUser(emailToken.NewEmail, oldEmail); renameErr != nil {
+			return utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: renameErr.Error(),
+			}
+		}
+		return err
+	}
+	a.mosquittoGateway.MosquittoReload()
+
+	// the old owner learns about the change, the letter is not worth failing the request
+	body := "The email of your account was changed to " + emailToken.NewEmail + ".\n\n" +
+		"If you did not do it, contact the administrator."
+	_ = a.send(oldEmail, "Your email was changed", body)
+	return nil
+}
+
+// RequestAccountDeletion mails a token accepted by DeleteMe instead of the
+// password, users signed in through single sign-on do not know theirs
+func (a *authService) RequestAccountDeletion(clientId uint) error {
+	user, err := a.userGateway.GetById(clientId)
+	if err != nil {
+		return err
+	}
+	token, err := a.newEmailToken(models.EmailTokenCore{
+		UserId:  user.ID,
+		Purpose: models.EmailTokenDeleteAccount,
+	}, a.deleteAccountTTL)
+	if err != nil {
+		return err
+	}
+	body := "A deletion of your account was requested.\n\n" +
+		"Open the link to confirm it, it is valid for " + a.deleteAccountTTL.String() + ":\n" +
+		withToken(a.deleteAccountURL, token) + "\n\n" +
+		"If you did not request it, ignore this letter."
+	return a.send(user.Email, "Confirm the account deletion", body)
+}
+
+func (a *authService) checkEmailFree(id uint, email string) error {
+	exist, err := a.userGateway.DoesExistEmail(id, email)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrEmailAlreadyInUse,
+		}
+	}
+	return nil
+}
+
+func (a *authService) sendVerification(user models.UserCore) error {
+	token, err := a.newEmailToken(models.EmailTokenCore{
+		UserId:  user.ID,
+		Purpose: models.EmailTokenVerifyEmail,
+	}, a.verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	body := "Welcome!\n\n" +
+		"Confirm your email to activate the account and its broker credentials:\n" +
+		withToken(a.verifyEmailURL, token) + "\n\n" +
+		"The link is valid for " + a.verifyEmailTTL.String() + "."
+	return a.send(user.Email, "Confirm your email", body)
+}
+
+// sendAlreadyRegistered is what a sign up with a registered email mails instead
+// of the verification link, the owner learns about it and nobody else does
+func (a *authService) sendAlreadyRegistered(user models.UserCore) error {
+	body := "Someone tried to sign up with this email, but it already has an account.\n\n" +
+		"If it was you, sign in or choose a new password:\n" +
+		a.resetPasswordURL + "\n\n" +
+		"If it was not, ignore this letter."
+	return a.send(user.Email, "You already have an account", body)
+}
+
+// newEmailToken replaces earlier tokens of the same purpose, only the last letter works
+func (a *authService) newEmailToken(emailToken models.EmailTokenCore, ttl time.Duration) (string, error) {
+	if err := a.emailTokenGateway.DeleteByUserId(emailToken.UserId, emailToken.Purpose); err != nil {
+		return "", err
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		return "", utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	emailToken.TokenHash = hashSecret(token)
+	emailToken.ExpiresAt = time.Now().Add(ttl)
+	if err = a.emailTokenGateway.Create(emailToken); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (a *authService) send(to, subject, body string) error {
+	if err := a.mailer.Send(to, subject, body); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (a *authService) findByEmail(email string) (models.UserCore, bool, error) {
+	user, err := a.userGateway.GetByEmail(email)
+	if err != nil {
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) && respErr.Message == consts.ErrUserWithEmailNotFound {
+			return models.UserCore{}, false, nil
+		}
+		return models.UserCore{}, false, err
+	}
+	return user, true, nil
+}
+
+func withToken(rawURL, token string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL + "?token=" + url.QueryEscape(token)
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,554 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/mqtt"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const (
+	maxPublishPayload        = 1 << 20
+	maxPublishUserProperties = 32
+	publishTimeout           = 10 * time.Second
+
+	defaultMaxStreams   = 5
+	defaultStreamBuffer = 256
+
+	maxRetained          = 1000
+	retainedPreviewBytes = 256
+	retainedTimeout      = 10 * time.Second
+)
+
+// reason codes of puback and pubrec
+const (
+	reasonNoMatchingSubscribers = 0x10
+	reasonFirstError            = 0x80
+)
+
+type messageService struct {
+	topicGateway gateways.TopicGateway
+	userGateway  gateways.UserGateway
+	roleService  RoleService
+	mqttClient   mqtt.Client
+	maxStreams   int
+	streamBuffer int
+
+	mu      sync.Mutex
+	streams map[uint]int
+}
+
+// MessageStream is an open subscription for a client. Messages is never closed,
+// the reader stops on its own and calls Close
+type MessageStream struct {
+	Filter   string
+	Messages <-chan models.MessageCore
+	// Dropped returns how many messages did not fit in the buffer since its last call
+	Dropped func() int64
+	// Check tells whether the client may still read the stream, the reader
+	// calls it now and then and ends the stream on an error
+	Check func() error
+	Close func()
+}
+
+func NewMessageService(
+	topicGateway gateways.TopicGateway,
+	userGateway gateways.UserGateway,
+	roleService RoleService,
+	mqttClient mqtt.Client,
+) *messageService {
+	maxStreams := viper.GetInt("streams.max_per_user")
+	if maxStreams <= 0 {
+		maxStreams = defaultMaxStreams
+	}
+	streamBuffer := viper.GetInt("streams.buffer")
+	if streamBuffer <= 0 {
+		streamBuffer = defaultStreamBuffer
+	}
+	return &messageService{
+		topicGateway: topicGateway,
+		userGateway:  userGateway,
+		roleService:  roleService,
+		mqttClient:   mqttClient,
+		maxStreams:   maxStreams,
+		streamBuffer: streamBuffer,
+		streams:      make(map[uint]int),
+	}
+}
+
+// Publish sends the message through the internal client. The service user may
+// write everywhere, so the topic must grant write and the client must be its
+// owner or have topics:write:any
+func (m *messageService) Publish(topicId uint, message models.PublishCore, clientId uint, clientRole models.Role) (models.PublishResultCore, error) {
+	if m.mqttClient == nil {
+		return models.PublishResultCore{}, utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrMqttDisabled,
+		}
+	}
+	topic, err := m.topicGateway.GetById(topicId)
+	if err != nil {
+		return models.PublishResultCore{}, err
+	}
+	if err = checkTopicAccess(m.userGateway, m.roleService, topic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return models.PublishResultCore{}, err
+	}
+	if !topic.CanWrite {
+		return models.PublishResultCore{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrTopicNotWritable,
+		}
+	}
+
+	if message.Topic == "" {
+		message.Topic = topic.Name
+	}
+	if err = validMessageTopic(topic.Name, message.Topic); err != nil {
+		return models.PublishResultCore{}, err
+	}
+	if err = validPublish(message); err != nil {
+		return models.PublishResultCore{}, err
+	}
+
+	publish := mqtt.Publish{
+		Topic:   message.Topic,
+		Payload: message.Payload,
+		Qos:     byte(message.Qos),
+		Retain:  message.Retain,
+	}
+	for _, property := range message.UserProperties {
+		publish.UserProperties = append(publish.UserProperties, mqtt.UserProperty{Key: property.Key, Value: property.Value})
+	}
+
+	result, err := m.publish(publish)
+	if err != nil {
+		return models.PublishResultCore{}, err
+	}
+
+	resultCore := models.PublishResultCore{
+		Topic:      message.Topic,
+		PacketId:   result.PacketId,
+		Qos:        message.Qos,
+		ReasonCode: result.ReasonCode,
+		Reason:     result.Reason,
+	}
+	switch {
+	case message.Qos == 0:
+		resultCore.Outcome = models.PublishOutcomeSent
+	case result.ReasonCode >= reasonFirstError:
+		resultCore.Outcome = models.PublishOutcomeRejected
+	case result.ReasonCode == reasonNoMatchingSubscribers:
+		resultCore.Outcome = models.PublishOutcomeNoSubscribers
+	default:
+		resultCore.Outcome = models.PublishOutcomeAccepted
+	}
+	return resultCore, nil
+}
+
+// Stream subscribes to the topic name, wildcards included, for a client that may
+// read the topic. A slow reader does not hold the internal client back: messages
+// that do not fit in streams.buffer are dropped and counted. A client has up to
+// streams.max_per_user open streams
+func (m *messageService) Stream(topicId uint, clientId uint, clientRole models.Role) (MessageStream, error) {
+	topic, err := m.readableTopic(topicId, clientId, clientRole)
+	if err != nil {
+		return MessageStream{}, err
+	}
+
+	m.mu.Lock()
+	if m.streams[clientId] >= m.maxStreams {
+		m.mu.Unlock()
+		return MessageStream{}, utils.ResponseError{
+			Code:    http.StatusTooManyRequests,
+			Message: consts.ErrTooManyStreams,
+		}
+	}
+	m.streams[clientId]++
+	m.mu.Unlock()
+	release := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.streams[clientId]--
+		if m.streams[clientId] <= 0 {
+			delete(m.streams, clientId)
+		}
+	}
+
+	messages := make(chan models.MessageCore, m.streamBuffer)
+	var dropped int64
+	unsubscribe, err := m.mqttClient.Subscribe(topic.Name, func(message mqtt.Message) {
+		select {
+		case messages <- messageFromMqtt(message):
+		default:
+			atomic.AddInt64(&dropped, 1)
+		}
+	})
+	if err != nil {
+		release()
+		return MessageStream{}, utils.ResponseError{
+			Code:    http.StatusBadGateway,
+			Message: err.Error(),
+		}
+	}
+
+	openedAt := time.Now()
+	var once sync.Once
+	return MessageStream{
+		Filter:   topic.Name,
+		Messages: messages,
+		Dropped: func() int64 {
+			return atomic.SwapInt64(&dropped, 0)
+		},
+		Check: func() error {
+			return m.checkStream(topicId, topic.Name, clientId, openedAt)
+		},
+		Close: func() {
+			once.Do(func() {
+				unsubscribe()
+				release()
+			})
+		},
+	}, nil
+}
+
+// GetRetained lists the retained messages under the topic name sorted by topic,
+// payloads are cut to retainedPreviewBytes. truncated tells that there were more
+// than maxRetained or the broker was too slow to send them all
+func (m *messageService) GetRetained(topicId uint, page, pageSize *int, clientId uint, clientRole models.Role) (
+	[]models.RetainedMessageCore, uint, bool, error) {
+	topic, err := m.readableTopic(topicId, clientId, clientRole)
+	if err != nil {
+		return []models.RetainedMessageCore{}, 0, false, err
+	}
+	messages, truncated, err := m.retained(topic.Name, maxRetained)
+	if err != nil {
+		return []models.RetainedMessageCore{}, 0, false, err
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic < messages[j].Topic
+	})
+
+	offset, limit := utils.GetOffsetAndLimit(page, pageSize)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(messages) {
+		offset = len(messages)
+	}
+	end := len(messages)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	retainedCore := []models.RetainedMessageCore{}
+	for _, message := range messages[offset:end] {
+		payload, cut := cutPayload(message.Payload, retainedPreviewBytes)
+		retainedMessage := models.RetainedMessageCore{
+			MessageCore: messageFromMqtt(message),
+			Size:        len(message.Payload),
+			Truncated:   cut,
+		}
+		retainedMessage.Payload = payload
+		retainedCore = append(retainedCore, retainedMessage)
+	}
+	return retainedCore, uint(len(messages)), truncated, nil
+}
+
+// GetRetainedMessage returns the retained message of mqttTopic with the whole
+// payload, mqttTopic defaults to the topic name
+func (m *messageService) GetRetainedMessage(topicId uint, mqttTopic string, clientId uint, clientRole models.Role) (
+	models.RetainedMessageCore, error) {
+	topic, err := m.readableTopic(topicId, clientId, clientRole)
+	if err != nil {
+		return models.RetainedMessageCore{}, err
+	}
+	if mqttTopic == "" {
+		mqttTopic = topic.Name
+	}
+	if err = validMessageTopic(topic.Name, mqttTopic); err != nil {
+		return models.RetainedMessageCore{}, err
+	}
+	messages, _, err := m.retained(mqttTopic, 1)
+	if err != nil {
+		return models.RetainedMessageCore{}, err
+	}
+	if len(messages) == 0 {
+		return models.RetainedMessageCore{}, utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrRetainedNotFound,
+		}
+	}
+	return models.RetainedMessageCore{
+		MessageCore: messageFromMqtt(messages[0]),
+		Size:        len(messages[0].Payload),
+	}, nil
+}
+
+// ClearRetained publishes an empty retained message to mqttTopic, which removes
+// the retained one. The topic does not need to allow write, only the owner or
+// topics:write:any may clear
+func (m *messageService) ClearRetained(topicId uint, mqttTopic string, clientId uint, clientRole models.Role) error {
+	if m.mqttClient == nil {
+		return utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrMqttDisabled,
+		}
+	}
+	topic, err := m.topicGateway.GetById(topicId)
+	if err != nil {
+		return err
+	}
+	if err = checkTopicAccess(m.userGateway, m.roleService, topic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return err
+	}
+	if mqttTopic == "" {
+		mqttTopic = topic.Name
+	}
+	if err = validMessageTopic(topic.Name, mqttTopic); err != nil {
+		return err
+	}
+	return m.clearRetained(mqttTopic)
+}
+
+// ClearRetainedUnder clears every retained message on prefix and below it and
+// returns how many were cleared. The prefix is not bound to any topic, so only
+// clients outside of organizations may do it
+func (m *messageService) ClearRetainedUnder(prefix string, clientId uint) (int, error) {
+	organizationId, err := clientOrganization(m.userGateway, clientId)
+	if err != nil {
+		return 0, err
+	}
+	if organizationId != nil {
+		return 0, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrAccessDenied,
+		}
+	}
+	if m.mqttClient == nil {
+		return 0, utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrMqttDisabled,
+		}
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || strings.ContainsAny(prefix, "+#") || validTopicName(prefix) != nil {
+		return 0, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidPrefix,
+		}
+	}
+
+	// # matches the parent level as well, so the prefix itself is cleared too
+	cleared := 0
+	for {
+		messages, more, err := m.retained(prefix+"/#", maxRetained)
+		if err != nil {
+			return cleared, err
+		}
+		for _, message := range messages {
+			if err = m.clearRetained(message.Topic); err != nil {
+				return cleared, err
+			}
+			cleared++
+		}
+		if !more || len(messages) == 0 {
+			return cleared, nil
+		}
+	}
+}
+
+// readableTopic returns the topic when the client may read it and the topic allows read
+func (m *messageService) readableTopic(topicId uint, clientId uint, clientRole models.Role) (models.TopicCore, error) {
+	if m.mqttClient == nil {
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrMqttDisabled,
+		}
+	}
+	topic, err := m.topicGateway.GetById(topicId)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = checkTopicAccess(m.userGateway, m.roleService, topic, clientId, clientRole, models.PermissionTopicsReadAny); err != nil {
+		return models.TopicCore{}, err
+	}
+	if !topic.CanRead {
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrTopicNotReadable,
+		}
+	}
+	return topic, nil
+}
+
+// checkStream repeats the checks of Stream with the role from the db, as a
+// role taken away must not keep a stream open. The stream ends as well when
+// the user is disabled, deleted or has the sessions revoked since openedAt
+func (m *messageService) checkStream(topicId uint, filter string, clientId uint, openedAt time.Time) error {
+	user, err := m.userGateway.GetById(clientId)
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrUserDisabled,
+		}
+	}
+	if user.SessionsRevokedAt != nil && !user.SessionsRevokedAt.Before(openedAt) {
+		return utils.ResponseError{
+			Code:    http.StatusUnauthorized,
+			Message: consts.ErrSessionRevoked,
+		}
+	}
+	topic, err := m.readableTopic(topicId, clientId, user.Role)
+	if err != nil {
+		return err
+	}
+	if topic.Name != filter {
+		return utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrTopicRenamed,
+		}
+	}
+	return nil
+}
+
+func (m *messageService) retained(filter string, limit int) ([]mqtt.Message, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), retainedTimeout)
+	defer cancel()
+	messages, more, err := m.mqttClient.Retained(ctx, filter, limit)
+	if err != nil {
+		if errors.Is(err, mqtt.ErrConnectionDown) {
+			return nil, false, utils.ResponseError{
+				Code:    http.StatusServiceUnavailable,
+				Message: consts.ErrBrokerUnavailable,
+			}
+		}
+		return nil, false, utils.ResponseError{
+			Code:    http.StatusBadGateway,
+			Message: err.Error(),
+		}
+	}
+	return messages, more, nil
+}
+
+func (m *messageService) clearRetained(mqttTopic string) error {
+	result, err := m.publish(mqtt.Publish{Topic: mqttTopic, Qos: 1, Retain: true})
+	if err != nil {
+		return err
+	}
+	if result.ReasonCode >= reasonFirstError {
+		return utils.ResponseError{
+			Code:    http.StatusBadGateway,
+			Message: result.Reason,
+		}
+	}
+	return nil
+}
+
+func (m *messageService) publish(publish mqtt.Publish) (mqtt.PublishResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	result, err := m.mqttClient.Publish(ctx, publish)
+	if err != nil {
+		if errors.Is(err, mqtt.ErrConnectionDown) {
+			return mqtt.PublishResult{}, utils.ResponseError{
+				Code:    http.StatusServiceUnavailable,
+				Message: consts.ErrBrokerUnavailable,
+			}
+		}
+		return mqtt.PublishResult{}, utils.ResponseError{
+			Code:    http.StatusBadGateway,
+			Message: err.Error(),
+		}
+	}
+	return result, nil
+}
+
+func messageFromMqtt(message mqtt.Message) models.MessageCore {
+	messageCore := models.MessageCore{
+		Topic:      message.Topic,
+		Payload:    message.Payload,
+		Qos:        int(message.Qos),
+		Retain:     message.Retain,
+		ReceivedAt: message.ReceivedAt,
+	}
+	for _, property := range message.UserProperties {
+		messageCore.UserProperties = append(messageCore.UserProperties, models.UserPropertyCore{
+			Key:   property.Key,
+			Value: property.Value,
+		})
+	}
+	return messageCore
+}
+
+// validMessageTopic checks that the mqtt topic has no wildcards and is
+// matched by the name of the topic, which may have them
+func validMessageTopic(name, mqttTopic string) error {
+	if strings.ContainsAny(mqttTopic, "+#") {
+		if mqttTopic == name {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrMessageTopicRequired,
+			}
+		}
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidTopicName,
+		}
+	}
+	if err := validTopicName(mqttTopic); err != nil {
+		return err
+	}
+	if !mqtt.Match(name, mqttTopic) {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrMessageTopicMismatch,
+		}
+	}
+	return nil
+}
+
+func validPublish(message models.PublishCore) error {
+	if message.Qos < 0 || message.Qos > 2 {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidQos,
+		}
+	}
+	if len(message.Payload) > maxPublishPayload {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrPayloadTooLarge,
+		}
+	}
+	if len(message.UserProperties) > maxPublishUserProperties {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidUserProperty,
+		}
+	}
+	for _, property := range message.UserProperties {
+		if property.Key == "" || !utf8.ValidString(property.Key) || !utf8.ValidString(property.Value) ||
+			strings.ContainsRune(property.Key, 0) || strings.ContainsRune(property.Value, 0) {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrInvalidUserProperty,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/mqtt"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type fakeMqttClient struct {
+	mqtt.Client
+	subscriptions int
+}
+
+func (f *fakeMqttClient) Subscribe(filter string, handler mqtt.Handler) (func(), error) {
+	f.subscriptions++
+	return func() { f.subscriptions-- }, nil
+}
+
+// newTestMessageService has the users and the topic of newTestTopicService
+func newTestMessageService() (*messageService, *fakeUserGateway, *fakeTopicGateway, *fakeMqttClient) {
+	userGateway := &fakeUserGateway{users: map[uint]models.UserCore{
+		testAdminId: {ID: testAdminId, Email: "admin@example.com", Role: models.RoleSuperAdmin},
+		testOwnerId: {ID: testOwnerId, Email: "owner@example.com", Role: models.RoleUser},
+	}}
+	topicGateway := &fakeTopicGateway{topics: map[uint]models.TopicCore{
+		1: {ID: 1, UserId: testOwnerId, Name: "sensors/temperature", CanRead: true},
+	}, nextId: 1}
+	mqttClient := &fakeMqttClient{}
+	return NewMessageService(topicGateway, userGateway, &fakeRoleService{}, mqttClient),
+		userGateway, topicGateway, mqttClient
+}
+
+func TestStreamCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		clientId uint
+		change   func(users *fakeUserGateway, topics *fakeTopicGateway)
+		ended    bool
+		// message is empty for the not found errors of the fakes
+		message string
+	}{
+		{"unchanged", testOwnerId, func(*fakeUserGateway, *fakeTopicGateway) {}, false, ""},
+		{"topic deleted", testOwnerId, func(_ *fakeUserGateway, topics *fakeTopicGateway) {
+			topics.Delete(1)
+		}, true, ""},
+		{"topic renamed", testOwnerId, func(_ *fakeUserGateway, topics *fakeTopicGateway) {
+			topic := topics.topics[1]
+			topic.Name = "sensors/humidity"
+			topics.topics[1] = topic
+		}, true, consts.ErrTopicRenamed},
+		{"read turned off", testOwnerId, func(_ *fakeUserGateway, topics *fakeTopicGateway) {
+			topics.UpdatePermissions(models.TopicCore{ID: 1, CanWrite: true})
+		}, true, consts.ErrTopicNotReadable},
+		{"user disabled", testOwnerId, func(users *fakeUserGateway, _ *fakeTopicGateway) {
+			user := users.users[testOwnerId]
+			user.Disabled = true
+			users.users[testOwnerId] = user
+		}, true, consts.ErrUserDisabled},
+		{"user deleted", testOwnerId, func(users *fakeUserGateway, _ *fakeTopicGateway) {
+			delete(users.users, testOwnerId)
+		}, true, ""},
+		{"sessions revoked", testOwnerId, func(users *fakeUserGateway, _ *fakeTopicGateway) {
+			user := users.users[testOwnerId]
+			now := time.Now()
+			user.SessionsRevokedAt = &now
+			users.users[testOwnerId] = user
+		}, true, consts.ErrSessionRevoked},
+		{"role taken away", testAdminId, func(users *fakeUserGateway, _ *fakeTopicGateway) {
+			user := users.users[testAdminId]
+			user.Role = models.RoleUser
+			users.users[testAdminId] = user
+		}, true, consts.ErrAccessDenied},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			messageService, userGateway, topicGateway, mqttClient := newTestMessageService()
+			clientRole := userGateway.users[c.clientId].Role
+			stream, err := messageService.Stream(1, c.clientId, clientRole)
+			if err != nil {
+				t.Fatalf("Stream: %v", err)
+			}
+			defer stream.Close()
+			if err = stream.Check(); err != nil {
+				t.Fatalf("Check right after the open: %v", err)
+			}
+
+			c.change(userGateway, topicGateway)
+			err = stream.Check()
+			if !c.ended {
+				if err != nil {
+					t.Errorf("Check = %v", err)
+				}
+				return
+			}
+			respErr, ok := err.(utils.ResponseError)
+			if !ok {
+				t.Fatalf("Check = %v, want a ResponseError", err)
+			}
+			if c.message != "" && respErr.Message != c.message {
+				t.Errorf("Check = %q, want %q", respErr.Message, c.message)
+			}
+
+			stream.Close()
+			if mqttClient.subscriptions != 0 {
+				t.Errorf("%d subscriptions left after Close", mqttClient.subscriptions)
+			}
+		})
+	}
+}
+
+func TestStreamCheckIgnoresEarlierRevocation(t *testing.T) {
+	messageService, userGateway, _, _ := newTestMessageService()
+	user := userGateway.users[testOwnerId]
+	earlier := time.Now().Add(-time.Minute)
+	user.SessionsRevokedAt = &earlier
+	userGateway.users[testOwnerId] = user
+
+	stream, err := messageService.Stream(1, testOwnerId, models.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err = stream.Check(); err != nil {
+		t.Errorf("a revocation before the open ends the stream: %v", err)
+	}
+}
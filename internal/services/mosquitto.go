@@ -1,20 +1,39 @@
 package services
 
 import (
+	"net/http"
+
 	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/mosquitto"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
 )
 
 type mosquittoService struct {
 	userGateway      gateways.UserGateway
+	topicGateway     gateways.TopicGateway
 	mosquittoGateway gateways.MosquittoGateway
 }
 
+// ReconcileReport lists what the broker files had different from the db
+type ReconcileReport struct {
+	AclUsers int
+	// RemovedPasswd are entries of users that are pending, disabled or deleted
+	RemovedPasswd []string
+	// OrphanPasswd are entries unknown to the db, removed only with prune
+	OrphanPasswd []string
+	// MissingPasswd users need a password reset, the hash cannot be rebuilt from the db
+	MissingPasswd []string
+}
+
 func NewMosquittoService(
 	userGateway gateways.UserGateway,
+	topicGateway gateways.TopicGateway,
 	mosquittoGateway gateways.MosquittoGateway,
 ) *mosquittoService {
 	return &mosquittoService{
 		userGateway:      userGateway,
+		topicGateway:     topicGateway,
 		mosquittoGateway: mosquittoGateway,
 	}
 }
@@ -37,3 +56,118 @@ func (m *mosquittoService) Launch(id uint, mosquittoOn bool) error {
 func (m *mosquittoService) Stop() {
 	m.mosquittoGateway.MosquittoStop()
 }
+
+// ExportAcl renders the acl file the db describes without writing it
+func (m *mosquittoService) ExportAcl() ([]string, error) {
+	aclUsers, _, err := brokerAclUsers(m.userGateway, m.topicGateway)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := m.mosquittoGateway.RenderAcl(aclUsers)
+	if err != nil {
+		return nil, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return lines, nil
+}
+
+// Reconcile rewrites the acl user blocks from the db and removes passwordfile
+// entries of users who must not connect. dryRun only fills the report
+func (m *mosquittoService) Reconcile(prune, dryRun bool) (ReconcileReport, error) {
+	aclUsers, users, err := brokerAclUsers(m.userGateway, m.topicGateway)
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+	usernames, err := m.mosquittoGateway.GetMosquittoUsernames()
+	if err != nil {
+		return ReconcileReport{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+
+	report := ReconcileReport{AclUsers: len(aclUsers)}
+	inPasswd := make(map[string]bool, len(usernames))
+	var toDelete []string
+	serviceUsername := mosquitto.ServiceUsername()
+	for _, username := range usernames {
+		inPasswd[username] = true
+		if username == serviceUsername {
+			continue
+		}
+		user, known := users[username]
+		switch {
+		case !known:
+			report.OrphanPasswd = append(report.OrphanPasswd, username)
+			if prune {
+				toDelete = append(toDelete, username)
+			}
+		case user.PendingVerification || user.Disabled:
+			report.RemovedPasswd = append(report.RemovedPasswd, username)
+			toDelete = append(toDelete, username)
+		}
+	}
+	for _, aclUser := range aclUsers {
+		if !inPasswd[aclUser.Username] {
+			report.MissingPasswd = append(report.MissingPasswd, aclUser.Username)
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	if err = m.mosquittoGateway.WriteAcl(aclUsers); err != nil {
+		return ReconcileReport{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	for _, username := range toDelete {
+		if err = m.mosquittoGateway.DeleteMosquittoPasswd(username); err != nil {
+			return ReconcileReport{}, utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}
+		}
+	}
+	m.mosquittoGateway.MosquittoReload()
+	return report, nil
+}
+
+// brokerAclUsers returns the blocks of the users allowed to connect
+// and every user of the db by email
+func brokerAclUsers(userGateway gateways.UserGateway, topicGateway gateways.TopicGateway) ([]mosquitto.AclUser, map[string]models.UserCore, error) {
+	users, _, err := userGateway.GetAll(0, -1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	topics, _, err := topicGateway.GetAll(0, -1, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topicsByUser := make(map[uint][]mosquitto.AclTopic)
+	for _, topic := range topics {
+		topicsByUser[topic.UserId] = append(topicsByUser[topic.UserId], mosquitto.AclTopic{
+			Name:     topic.Name,
+			CanRead:  topic.CanRead,
+			CanWrite: topic.CanWrite,
+		})
+	}
+
+	byEmail := make(map[string]models.UserCore, len(users))
+	var aclUsers []mosquitto.AclUser
+	for _, user := range users {
+		byEmail[user.Email] = user
+		if user.PendingVerification || user.Disabled {
+			continue
+		}
+		aclUsers = append(aclUsers, mosquitto.AclUser{
+			Username: user.Email,
+			Topics:   topicsByUser[user.ID],
+		})
+	}
+	return aclUsers, byEmail, nil
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// OidcFlowTTL is how long the user has to sign in at the identity provider
+const OidcFlowTTL = 10 * time.Minute
+
+// OidcFlowClaims carries the state, nonce and pkce verifier between the login
+// redirect and the callback, the token is kept in a cookie of the client
+type OidcFlowClaims struct {
+	jwt.StandardClaims
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func (a *authService) OidcLogin() (string, string, error) {
+	if a.oidc == nil {
+		return "", "", utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrOidcDisabled,
+		}
+	}
+
+	claims := OidcFlowClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: jwt.At(time.Now().Add(OidcFlowTTL)),
+		},
+	}
+	for _, value := range []*string{&claims.State, &claims.Nonce, &claims.Verifier} {
+		random, err := randomString(32)
+		if err != nil {
+			return "", "", utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}
+		}
+		*value = random
+	}
+
+	authURL, err := a.oidc.AuthCodeURL(claims.State, claims.Nonce, claims.Verifier)
+	if err != nil {
+		return "", "", utils.ResponseError{
+			Code:    http.StatusBadGateway,
+			Message: consts.ErrOidcFailed + ": " + err.Error(),
+		}
+	}
+	flowToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.oidcFlowKey)
+	if err != nil {
+		return "", "", utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return authURL, flowToken, nil
+}
+
+func (a *authService) OidcCallback(code, state, flowToken string) (Tokens, error) {
+	if a.oidc == nil {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusNotFound,
+			Message: consts.ErrOidcDisabled,
+		}
+	}
+
+	flow := &OidcFlowClaims{}
+	_, err := jwt.ParseWithClaims(flowToken, flow, jwt.KnownKeyfunc(jwt.SigningMethodHS256, a.oidcFlowKey))
+	if err != nil || subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidOidcState,
+		}
+	}
+
+	claims, err := a.oidc.Exchange(code, flow.Verifier, flow.Nonce)
+	if err != nil {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusUnauthorized,
+			Message: consts.ErrOidcFailed + ": " + err.Error(),
+		}
+	}
+
+	user, err := a.oidcUser(claims.Issuer+"#"+claims.Subject, claims.Email, claims.EmailVerified, claims.Name)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	if role, found := a.oidc.Role(claims); found && role != user.Role {
+		// the same rule as SetRole, a SuperAdmin in an organization would manage
+		// roles of every organization
+		if role == models.RoleSuperAdmin && user.OrganizationId != nil {
+			return Tokens{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrSuperAdminInOrganization,
+			}
+		}
+		if err = a.userGateway.SetRole(user.ID, role); err != nil {
+			return Tokens{}, err
+		}
+		user.Role = role
+	}
+	return a.completeSignIn(user)
+}
+
+// oidcUser finds the user linked to the subject. An existing account is linked
+// only by a verified email, otherwise anyone able to register that email at the
+// provider would take it over
+func (a *authService) oidcUser(subject, email string, emailVerified bool, name string) (models.UserCore, error) {
+	user, err := a.userGateway.GetByOidcSubject(subject)
+	if err == nil {
+		return user, nil
+	}
+	var respErr utils.ResponseError
+	if !errors.As(err, &respErr) || respErr.Message != consts.ErrNotFoundInDB {
+		return models.UserCore{}, err
+	}
+
+	if email == "" {
+		return models.UserCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrOidcNoEmail,
+		}
+	}
+
+	user, found, err := a.findByEmail(email)
+	if err != nil {
+		return models.UserCore{}, err
+	}
+	if found {
+		if !emailVerified {
+			return models.UserCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrEmailAlreadyInUse,
+			}
+		}
+		if err = a.userGateway.SetOidcSubject(user.ID, subject); err != nil {
+			return models.UserCore{}, err
+		}
+		// the provider has confirmed the email
+		if err = a.activate(user); err != nil {
+			return models.UserCore{}, err
+		}
+		user.PendingVerification = false
+		return user, nil
+	}
+
+	// the password is unknown to everyone, broker credentials are set
+	// through the password reset
+	password, err := randomString(32)
+	if err != nil {
+		return models.UserCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	newUser := models.UserCore{
+		Email:       email,
+		Password:    utils.HashPassword(password),
+		FullName:    name,
+		Role:        a.oidc.DefaultRole(),
+		MosquittoOn: false,
+		OidcSubject: &subject,
+	}
+	user, err = a.userGateway.Create(newUser)
+	if err != nil {
+		return models.UserCore{}, err
+	}
+	a.mosquittoGateway.WriteNewUserToAcl(user.Email)
+	return user, nil
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// the slug is a topic level, so it must not hold wildcards or separators
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+type organizationService struct {
+	organizationGateway gateways.OrganizationGateway
+	userGateway         gateways.UserGateway
+	topicGateway        gateways.TopicGateway
+}
+
+func NewOrganizationService(
+	organizationGateway gateways.OrganizationGateway,
+	userGateway gateways.UserGateway,
+	topicGateway gateways.TopicGateway,
+) *organizationService {
+	return &organizationService{
+		organizationGateway: organizationGateway,
+		userGateway:         userGateway,
+		topicGateway:        topicGateway,
+	}
+}
+
+func (o *organizationService) Create(organization models.OrganizationCore, clientId uint) (models.OrganizationCore, error) {
+	if err := o.requireGlobal(clientId); err != nil {
+		return models.OrganizationCore{}, err
+	}
+
+	organization.Slug = strings.ToLower(organization.Slug)
+	if !slugPattern.MatchString(organization.Slug) {
+		return models.OrganizationCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidSlug,
+		}
+	}
+	exist, err := o.organizationGateway.DoesExistSlug(organization.Slug)
+	if err != nil {
+		return models.OrganizationCore{}, err
+	}
+	if !exist {
+		// topics of users outside of organizations must not fall under the prefix
+		exist, err = o.topicGateway.DoesExistFirstLevel(organization.Slug)
+		if err != nil {
+			return models.OrganizationCore{}, err
+		}
+	}
+	if exist {
+		return models.OrganizationCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrSlugAlreadyInUse,
+		}
+	}
+
+	return o.organizationGateway.Create(organization)
+}
+
+func (o *organizationService) GetAll(clientId uint) ([]models.OrganizationCore, error) {
+	organizationId, err := clientOrganization(o.userGateway, clientId)
+	if err != nil {
+		return []models.OrganizationCore{}, err
+	}
+	if organizationId != nil {
+		organization, err := o.organizationGateway.GetById(*organizationId)
+		if err != nil {
+			return []models.OrganizationCore{}, err
+		}
+		return []models.OrganizationCore{organization}, nil
+	}
+	return o.organizationGateway.GetAll()
+}
+
+// SetUserOrganization moves a user without topics, topics would keep the
+// prefix of the old organization in their names. A nil organizationId
+// takes the user out of organizations
+func (o *organizationService) SetUserOrganization(id uint, organizationId *uint, clientId uint) error {
+	if err := o.requireGlobal(clientId); err != nil {
+		return err
+	}
+	user, err := o.userGateway.GetById(id)
+	if err != nil {
+		return err
+	}
+	if organizationId != nil {
+		if user.Role == models.RoleSuperAdmin {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrSuperAdminInOrganization,
+			}
+		}
+		if _, err = o.organizationGateway.GetById(*organizationId); err != nil {
+			return err
+		}
+	}
+
+	_, countRows, err := o.topicGateway.GetByUserId(id, 0, -1)
+	if err != nil {
+		return err
+	}
+	if countRows > 0 {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrUserHasTopics,
+		}
+	}
+	return o.userGateway.SetOrganization(id, organizationId)
+}
+
+// requireGlobal lets only users outside of organizations manage them
+func (o *organizationService) requireGlobal(clientId uint) error {
+	organizationId, err := clientOrganization(o.userGateway, clientId)
+	if err != nil {
+		return err
+	}
+	if organizationId != nil {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrAccessDenied,
+		}
+	}
+	return nil
+}
+
+// clientOrganization returns the organization the client is limited to, nil
+// when the client is outside of organizations. The cli acts with clientId 0
+// and is not limited, anonymous clients never get past the permission checks
+func clientOrganization(userGateway gateways.UserGateway, clientId uint) (*uint, error) {
+	if clientId == 0 {
+		return nil, nil
+	}
+	client, err := userGateway.GetById(clientId)
+	if err != nil {
+		return nil, err
+	}
+	return client.OrganizationId, nil
+}
+
+// inOrganization reports whether a client limited to clientOrganizationId
+// may reach a record of organizationId
+func inOrganization(clientOrganizationId, organizationId *uint) bool {
+	if clientOrganizationId == nil {
+		return true
+	}
+	return organizationId != nil && *organizationId == *clientOrganizationId
+}
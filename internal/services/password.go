@@ -0,0 +1,101 @@
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// ChangePassword returns new tokens when the other sessions are revoked,
+// the tokens of the current session stop working as well
+func (a *authService) ChangePassword(clientId uint, currentPassword, newPassword string, revokeSessions bool) (Tokens, error) {
+	user, err := a.userGateway.GetById(clientId)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if user.Disabled {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrUserDisabled,
+		}
+	}
+	if err = utils.ComparePassword(user.Password, currentPassword); err != nil {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrIncorrectPassword,
+		}
+	}
+	if err = a.passwordPolicy.Check(newPassword, user.Email); err != nil {
+		return Tokens{}, err
+	}
+
+	if err = a.setPassword(user, newPassword); err != nil {
+		return Tokens{}, err
+	}
+	a.mosquittoGateway.MosquittoReload()
+
+	if !revokeSessions {
+		return Tokens{}, nil
+	}
+	if err = a.userGateway.RevokeSessions(user.ID, time.Now()); err != nil {
+		return Tokens{}, err
+	}
+	return a.issueTokens(user)
+}
+
+// setPassword writes the broker passwordfile first and puts the old entry back
+// when the db update fails, so both passwords always stay the same
+func (a *authService) setPassword(user models.UserCore, password string) error {
+	brokerPasswordHash, err := a.mosquittoGateway.HashMosquittoPassword(password)
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	oldBrokerPasswordHash, found, err := a.mosquittoGateway.GetMosquittoPasswdHash(user.Email)
+	if err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+
+	if err = a.mosquittoGateway.WriteMosquittoPasswdHash(user.Email, brokerPasswordHash); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+
+	if err = a.userGateway.SetPassword(user.ID, utils.HashPassword(password)); err != nil {
+		var rollbackErr error
+		if found {
+			rollbackErr = a.mosquittoGateway.WriteMosquittoPasswdHash(user.Email, oldBrokerPasswordHash)
+		} else {
+			rollbackErr = a.mosquittoGateway.DeleteMosquittoPasswd(user.Email)
+		}
+		if rollbackErr != nil {
+			return utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error() + "; passwordfile rollback: " + rollbackErr.Error(),
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// isRevoked compares in whole seconds, the precision of the iat claim
+func isRevoked(claims *UserClaims, revokedAt *time.Time) bool {
+	if revokedAt == nil {
+		return false
+	}
+	if claims.IssuedAt == nil {
+		return true
+	}
+	return claims.IssuedAt.Before(revokedAt.Truncate(time.Second))
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type quotaService struct {
+	quotaGateway gateways.QuotaGateway
+	userGateway  gateways.UserGateway
+	roleQuotas   map[models.Role]models.Quota
+}
+
+// NewQuotaService reads quotas.default and quotas.roles, a role inherits
+// every limit it does not set from the default
+func NewQuotaService(
+	loggers logger.Loggers,
+	quotaGateway gateways.QuotaGateway,
+	userGateway gateways.UserGateway,
+) *quotaService {
+	var defaultQuota models.Quota
+	if err := viper.UnmarshalKey("quotas.default", &defaultQuota); err != nil {
+		loggers.Err.Fatalf("invalid quotas.default: %v", err)
+	}
+
+	roleQuotas := make(map[models.Role]models.Quota, len(models.Roles))
+	for _, role := range models.Roles {
+		quota := defaultQuota
+		// viper keys are lowercase
+		if err := viper.UnmarshalKey("quotas.roles."+strings.ToLower(role.String()), &quota); err != nil {
+			loggers.Err.Fatalf("invalid quotas.roles.%s: %v", role, err)
+		}
+		roleQuotas[role] = quota
+	}
+
+	return &quotaService{
+		quotaGateway: quotaGateway,
+		userGateway:  userGateway,
+		roleQuotas:   roleQuotas,
+	}
+}
+
+func (q *quotaService) Get(userId uint) (models.Quota, models.QuotaUsage, error) {
+	quota, err := q.quota(userId)
+	if err != nil {
+		return models.Quota{}, models.QuotaUsage{}, err
+	}
+	usage, err := q.quotaGateway.GetUsage(userId)
+	if err != nil {
+		return models.Quota{}, models.QuotaUsage{}, err
+	}
+	return quota, usage, nil
+}
+
+func (q *quotaService) SetOverride(override models.QuotaOverrideCore, clientId uint) error {
+	for _, limit := range []*int{override.MaxTopics, override.MaxCredentials, override.MaxGrants, override.MaxTopicDepth} {
+		if limit != nil && *limit < 0 {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrInvalidQuota,
+			}
+		}
+	}
+	// an admin would lift the own limits otherwise
+	if override.UserId == clientId {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrSelfManage,
+		}
+	}
+	user, err := q.userGateway.GetById(override.UserId)
+	if err != nil {
+		return err
+	}
+	organizationId, err := clientOrganization(q.userGateway, clientId)
+	if err != nil {
+		return err
+	}
+	if !inOrganization(organizationId, user.OrganizationId) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrAccessDenied,
+		}
+	}
+	return q.quotaGateway.SetOverride(override)
+}
+
+// CheckTopic is called before the user gets a new topic, grant tells
+// whether the topic adds a line to the acl
+func (q *quotaService) CheckTopic(userId uint, name string, grant bool) error {
+	quota, usage, err := q.Get(userId)
+	if err != nil {
+		return err
+	}
+	if quota.MaxTopicDepth > 0 && topicDepth(name) > quota.MaxTopicDepth {
+		return utils.ResponseError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: consts.ErrTopicTooDeep,
+		}
+	}
+	if exceeded(quota.MaxTopics, usage.Topics) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrTopicQuotaExceeded,
+		}
+	}
+	if grant && exceeded(quota.MaxGrants, usage.Grants) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrGrantQuotaExceeded,
+		}
+	}
+	return nil
+}
+
+// CheckTopicDepth is called when a topic of the user gets a new name
+func (q *quotaService) CheckTopicDepth(userId uint, name string) error {
+	quota, err := q.quota(userId)
+	if err != nil {
+		return err
+	}
+	if quota.MaxTopicDepth > 0 && topicDepth(name) > quota.MaxTopicDepth {
+		return utils.ResponseError{
+			Code:    http.StatusUnprocessableEntity,
+			Message: consts.ErrTopicTooDeep,
+		}
+	}
+	return nil
+}
+
+// CheckGrant is called when a topic without permissions gets one
+func (q *quotaService) CheckGrant(userId uint) error {
+	quota, usage, err := q.Get(userId)
+	if err != nil {
+		return err
+	}
+	if exceeded(quota.MaxGrants, usage.Grants) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrGrantQuotaExceeded,
+		}
+	}
+	return nil
+}
+
+func (q *quotaService) CheckCredential(userId uint) error {
+	quota, usage, err := q.Get(userId)
+	if err != nil {
+		return err
+	}
+	if exceeded(quota.MaxCredentials, usage.Credentials) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrCredentialQuotaExceeded,
+		}
+	}
+	return nil
+}
+
+// RoleQuota is the quota of a user of the role without an override
+func (q *quotaService) RoleQuota(role models.Role) models.Quota {
+	return q.roleQuotas[role]
+}
+
+func (q *quotaService) quota(userId uint) (models.Quota, error) {
+	user, err := q.userGateway.GetById(userId)
+	if err != nil {
+		return models.Quota{}, err
+	}
+	override, found, err := q.quotaGateway.GetOverride(userId)
+	if err != nil {
+		return models.Quota{}, err
+	}
+
+	quota := q.roleQuotas[user.Role]
+	if found {
+		quota = override.Apply(quota)
+	}
+	return quota, nil
+}
+
+// exceeded reports whether one more item goes over the limit, zero is unlimited
+func exceeded(limit, used int) bool {
+	return limit > 0 && used >= limit
+}
+
+// topicDepth counts the levels, a/b/c is 3
+func topicDepth(name string) int {
+	return strings.Count(name, "/") + 1
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// the mapping is checked on every request, other replicas pick up edits after this delay
+const rolePermissionsCacheTTL = 30 * time.Second
+
+type roleService struct {
+	loggers     logger.Loggers
+	roleGateway gateways.RoleGateway
+
+	mu       sync.RWMutex
+	cache    map[models.Role]map[models.Permission]bool
+	loadedAt time.Time
+}
+
+func NewRoleService(
+	loggers logger.Loggers,
+	roleGateway gateways.RoleGateway,
+) *roleService {
+	return &roleService{
+		loggers:     loggers,
+		roleGateway: roleGateway,
+	}
+}
+
+// HasPermission fails closed: if the mapping cannot be loaded nothing is allowed
+func (r *roleService) HasPermission(role models.Role, permission models.Permission) bool {
+	r.mu.RLock()
+	fresh := r.cache != nil && time.Since(r.loadedAt) < rolePermissionsCacheTTL
+	r.mu.RUnlock()
+
+	if !fresh {
+		if err := r.load(); err != nil {
+			r.loggers.Err.Printf("cannot load role permissions: %s", err.Error())
+			return false
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cache[role][permission]
+}
+
+func (r *roleService) GetAll() ([]models.RolePermissionCore, error) {
+	return r.roleGateway.GetAll()
+}
+
+func (r *roleService) SetPermissions(role models.Role, permissions []models.Permission) error {
+	if !isKnownRole(role) {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrUnknownRole,
+		}
+	}
+
+	unique := make(map[models.Permission]bool)
+	var result []models.Permission
+	for _, permission := range permissions {
+		if !isKnownPermission(permission) {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrUnknownPermission + ": " + permission.String(),
+			}
+		}
+		if !unique[permission] {
+			unique[permission] = true
+			result = append(result, permission)
+		}
+	}
+	// otherwise nobody could ever edit the mapping again
+	if role == models.RoleSuperAdmin && !unique[models.PermissionRolesManage] {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrSuperAdminRolesManage,
+		}
+	}
+
+	if err := r.roleGateway.SetPermissions(role, result); err != nil {
+		return err
+	}
+	return r.load()
+}
+
+func (r *roleService) load() error {
+	rolePermissions, err := r.roleGateway.GetAll()
+	if err != nil {
+		return err
+	}
+
+	cache := make(map[models.Role]map[models.Permission]bool)
+	for _, rolePermission := range rolePermissions {
+		if cache[rolePermission.Role] == nil {
+			cache[rolePermission.Role] = make(map[models.Permission]bool)
+		}
+		cache[rolePermission.Role][rolePermission.Permission] = true
+	}
+
+	r.mu.Lock()
+	r.cache = cache
+	r.loadedAt = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+func isKnownRole(role models.Role) bool {
+	for _, known := range models.Roles {
+		if known == role {
+			return true
+		}
+	}
+	return false
+}
+
+func isKnownPermission(permission models.Permission) bool {
+	for _, known := range models.Permissions {
+		if known == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -2,51 +2,177 @@ package services
 
 import (
 	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/mqtt"
+	"github.com/robboworld/mosquitto-broker/internal/oidc"
+	"github.com/robboworld/mosquitto-broker/internal/passwordpolicy"
 	"go.uber.org/fx"
 
 	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/internal/mailer"
+	"github.com/robboworld/mosquitto-broker/internal/ratelimit"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
 )
 
 type UserService interface {
 	GetById(id uint, clientId uint, clientRole models.Role) (models.UserCore, error)
+	GetByEmail(email string) (models.UserCore, error)
+	UpdateProfile(clientId uint, fullName string) (models.UserCore, error)
+	GetAll(page, pageSize *int, search string, clientId uint) ([]models.UserCore, uint, error)
+	GetTopics(id uint) ([]models.TopicCore, error)
+	SetRole(id uint, role models.Role, clientId uint, clientRole models.Role) error
+	SetDisabled(id uint, disabled bool, clientId uint, clientRole models.Role) error
+	Delete(id uint, clientId uint, clientRole models.Role) error
+	DeleteMe(clientId uint, password, token string) error
+	PurgeDeleted() (int, error)
 }
 
 type AuthService interface {
 	SignUp(newUser models.UserCore) error
+	CreateUser(newUser models.UserCore) (models.UserCore, error)
 	SignIn(email, password string) (Tokens, error)
 	Refresh(token string) (string, error)
+	Jwks() keys.JWKS
+	EnrollTwoFactor(clientId uint, challengeToken string) (secret, uri string, err error)
+	ConfirmTwoFactor(clientId uint, challengeToken, code string) (recoveryCodes []string, tokens Tokens, err error)
+	VerifyTwoFactor(challengeToken, code, recoveryCode string) (Tokens, error)
+	DisableTwoFactor(clientId uint, code string) error
+	VerifyEmail(token string) error
+	ResendVerification(email string) error
+	ForgotPassword(email string) error
+	ResetPassword(token, password string) error
+	ChangePassword(clientId uint, currentPassword, newPassword string, revokeSessions bool) (Tokens, error)
+	RequestEmailChange(clientId uint, password, newEmail string) error
+	ConfirmEmailChange(token string) error
+	RequestAccountDeletion(clientId uint) error
+	OidcLogin() (authURL, flowToken string, err error)
+	OidcCallback(code, state, flowToken string) (Tokens, error)
 }
 
 type MosquittoService interface {
 	Launch(id uint, mosquittoOn bool) error
 	Stop()
+	ExportAcl() ([]string, error)
+	Reconcile(prune, dryRun bool) (ReconcileReport, error)
 }
 
 type TopicService interface {
-	Create(topic models.TopicCore, clientId uint) (models.TopicCore, error)
+	Create(topic models.TopicCore, clientId uint, clientRole models.Role) (models.TopicCore, error)
 	GetById(id uint, clientId uint, clientRole models.Role) (models.TopicCore, error)
-	GetAll(page, pageSize *int, clientId uint, clientRole models.Role) (topics []models.TopicCore, countRows uint, err error)
+	GetAll(filter models.TopicFilter, sort, order string, page, pageSize *int, cursor string,
+		clientId uint, clientRole models.Role) (topics []models.TopicCore, pagination models.PaginationCore, err error)
 	UpdatePermissions(topic models.TopicCore, clientId uint, clientRole models.Role) (models.TopicCore, error)
+	Rename(id uint, name string, clientId uint, clientRole models.Role) (models.TopicCore, error)
+	UpdateMetadata(topic models.TopicCore, clientId uint, clientRole models.Role) (models.TopicCore, error)
+	GetTags(clientId uint, clientRole models.Role) ([]models.TopicTagCountCore, error)
+	Delete(id uint, clientId uint, clientRole models.Role) error
+}
+
+type ServiceAccountService interface {
+	Create(serviceAccount models.ServiceAccountCore, clientId uint) (models.ServiceAccountCore, error)
+	GetAll(clientId uint, clientRole models.Role) ([]models.ServiceAccountCore, error)
 	Delete(id uint, clientId uint, clientRole models.Role) error
+	CreateKey(apiKey models.ApiKeyCore, clientId uint, clientRole models.Role) (key string, newApiKey models.ApiKeyCore, err error)
+	GetKeys(serviceAccountId uint, clientId uint, clientRole models.Role) ([]models.ApiKeyCore, error)
+	DeleteKey(serviceAccountId, id uint, clientId uint, clientRole models.Role) error
+	Authenticate(key string) (ApiKeyPrincipal, error)
+}
+
+type RoleService interface {
+	HasPermission(role models.Role, permission models.Permission) bool
+	GetAll() ([]models.RolePermissionCore, error)
+	SetPermissions(role models.Role, permissions []models.Permission) error
+}
+
+type QuotaService interface {
+	Get(userId uint) (models.Quota, models.QuotaUsage, error)
+	SetOverride(override models.QuotaOverrideCore, clientId uint) error
+	CheckTopic(userId uint, name string, grant bool) error
+	CheckTopicDepth(userId uint, name string) error
+	CheckGrant(userId uint) error
+	CheckCredential(userId uint) error
+	RoleQuota(role models.Role) models.Quota
+}
+
+type OrganizationService interface {
+	Create(organization models.OrganizationCore, clientId uint) (models.OrganizationCore, error)
+	GetAll(clientId uint) ([]models.OrganizationCore, error)
+	SetUserOrganization(id uint, organizationId *uint, clientId uint) error
+}
+
+type BundleService interface {
+	Import(bundle models.BundleCore, dryRun bool, clientId uint, clientRole models.Role) (models.ImportReportCore, error)
+	Export(clientId uint) (models.BundleCore, error)
+	Adopt(passwdFile, aclFile string, role models.Role, dryRun bool) (AdoptReport, error)
+}
+
+type ContractService interface {
+	SetSchema(topicId uint, schema string, clientId uint, clientRole models.Role) (models.TopicContractCore, error)
+	GetSchema(topicId uint, clientId uint, clientRole models.Role) (models.TopicContractCore, error)
+	DeleteSchema(topicId uint, clientId uint, clientRole models.Role) error
+	GetViolations(topicId uint, page, pageSize *int, clientId uint, clientRole models.Role) (
+		contract models.TopicContractCore, violations []models.TopicViolationCore, countRows uint, err error)
+	StartValidator() (stop func())
+}
+
+type MessageService interface {
+	Publish(topicId uint, message models.PublishCore, clientId uint, clientRole models.Role) (models.PublishResultCore, error)
+	Stream(topicId uint, clientId uint, clientRole models.Role) (MessageStream, error)
+	GetRetained(topicId uint, page, pageSize *int, clientId uint, clientRole models.Role) (
+		messages []models.RetainedMessageCore, countRows uint, truncated bool, err error)
+	GetRetainedMessage(topicId uint, mqttTopic string, clientId uint, clientRole models.Role) (models.RetainedMessageCore, error)
+	ClearRetained(topicId uint, mqttTopic string, clientId uint, clientRole models.Role) error
+	ClearRetainedUnder(prefix string, clientId uint) (cleared int, err error)
 }
 
 type Services struct {
 	fx.Out
-	UserService      UserService
-	AuthService      AuthService
-	MosquittoService MosquittoService
-	TopicService     TopicService
+	UserService           UserService
+	AuthService           AuthService
+	MosquittoService      MosquittoService
+	TopicService          TopicService
+	ServiceAccountService ServiceAccountService
+	RoleService           RoleService
+	QuotaService          QuotaService
+	OrganizationService   OrganizationService
+	BundleService         BundleService
+	ContractService       ContractService
+	MessageService        MessageService
 }
 
 func New(
+	loggers logger.Loggers,
 	userGateway gateways.UserGateway,
 	mosquittoGateway gateways.MosquittoGateway,
 	topicGateway gateways.TopicGateway,
+	serviceAccountGateway gateways.ServiceAccountGateway,
+	roleGateway gateways.RoleGateway,
+	recoveryCodeGateway gateways.RecoveryCodeGateway,
+	emailTokenGateway gateways.EmailTokenGateway,
+	quotaGateway gateways.QuotaGateway,
+	organizationGateway gateways.OrganizationGateway,
+	bundleGateway gateways.BundleGateway,
+	contractGateway gateways.ContractGateway,
+	accessKeys keys.KeySet,
+	limiter ratelimit.Limiter,
+	mailer mailer.Mailer,
+	passwordPolicy passwordpolicy.Policy,
+	oidcProvider oidc.Provider,
+	mqttClient mqtt.Client,
 ) Services {
+	roleService := NewRoleService(loggers, roleGateway)
+	quotaService := NewQuotaService(loggers, quotaGateway, userGateway)
 	return Services{
-		UserService:      NewUserService(userGateway),
-		AuthService:      NewAuthService(userGateway, mosquittoGateway),
-		MosquittoService: NewMosquittoService(userGateway, mosquittoGateway),
-		TopicService:     NewTopicService(topicGateway, userGateway, mosquittoGateway),
+		UserService:           NewUserService(userGateway, topicGateway, mosquittoGateway, emailTokenGateway, roleService),
+		AuthService:           NewAuthService(userGateway, mosquittoGateway, recoveryCodeGateway, emailTokenGateway, accessKeys, limiter, mailer, passwordPolicy, oidcProvider),
+		MosquittoService:      NewMosquittoService(userGateway, topicGateway, mosquittoGateway),
+		TopicService:          NewTopicService(topicGateway, userGateway, organizationGateway, mosquittoGateway, roleService, quotaService),
+		ServiceAccountService: NewServiceAccountService(serviceAccountGateway, userGateway, roleService, quotaService),
+		RoleService:           roleService,
+		QuotaService:          quotaService,
+		OrganizationService:   NewOrganizationService(organizationGateway, userGateway, topicGateway),
+		BundleService:         NewBundleService(bundleGateway, userGateway, topicGateway, organizationGateway, mosquittoGateway, roleService, quotaService, passwordPolicy),
+		ContractService:       NewContractService(loggers, contractGateway, topicGateway, userGateway, roleService, mqttClient),
+		MessageService:        NewMessageService(topicGateway, userGateway, roleService, mqttClient),
 	}
 }
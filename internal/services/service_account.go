@@ -0,0 +1,213 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// api keys look like mqb_<prefix>.<secret>, the prefix is stored in plain text to find the row
+const apiKeyPrefix = "mqb_"
+
+// ApiKeyPrincipal is the identity behind an api key: the owner of the service account
+// limited by the scopes of the key
+type ApiKeyPrincipal struct {
+	UserId uint
+	Role   models.Role
+	Scopes []models.Scope
+	// ExpiresAt of the key, nil when it does not expire
+	ExpiresAt *time.Time
+}
+
+type serviceAccountService struct {
+	serviceAccountGateway gateways.ServiceAccountGateway
+	userGateway           gateways.UserGateway
+	roleService           RoleService
+	quotaService          QuotaService
+}
+
+func NewServiceAccountService(
+	serviceAccountGateway gateways.ServiceAccountGateway,
+	userGateway gateways.UserGateway,
+	roleService RoleService,
+	quotaService QuotaService,
+) *serviceAccountService {
+	return &serviceAccountService{
+		serviceAccountGateway: serviceAccountGateway,
+		userGateway:           userGateway,
+		roleService:           roleService,
+		quotaService:          quotaService,
+	}
+}
+
+func (s *serviceAccountService) Create(serviceAccount models.ServiceAccountCore, clientId uint) (models.ServiceAccountCore, error) {
+	serviceAccount.UserId = clientId
+	return s.serviceAccountGateway.Create(serviceAccount)
+}
+
+func (s *serviceAccountService) GetAll(clientId uint, clientRole models.Role) ([]models.ServiceAccountCore, error) {
+	if !s.roleService.HasPermission(clientRole, models.PermissionServiceAccountsManageAny) {
+		return s.serviceAccountGateway.GetByUserId(clientId)
+	}
+	return s.serviceAccountGateway.GetAll()
+}
+
+func (s *serviceAccountService) Delete(id uint, clientId uint, clientRole models.Role) error {
+	if _, err := s.getOwned(id, clientId, clientRole); err != nil {
+		return err
+	}
+	return s.serviceAccountGateway.Delete(id)
+}
+
+func (s *serviceAccountService) CreateKey(apiKey models.ApiKeyCore, clientId uint, clientRole models.Role) (string, models.ApiKeyCore, error) {
+	serviceAccount, err := s.getOwned(apiKey.ServiceAccountId, clientId, clientRole)
+	if err != nil {
+		return "", models.ApiKeyCore{}, err
+	}
+	// the key counts against the owner of the service account, not the admin creating it
+	if err = s.quotaService.CheckCredential(serviceAccount.UserId); err != nil {
+		return "", models.ApiKeyCore{}, err
+	}
+
+	if len(apiKey.Scopes) == 0 {
+		return "", models.ApiKeyCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrEmptyScopes,
+		}
+	}
+	for _, scope := range apiKey.Scopes {
+		if !isKnownScope(scope) {
+			return "", models.ApiKeyCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrUnknownScope + ": " + scope.String(),
+			}
+		}
+	}
+
+	prefix, err := randomString(6)
+	if err != nil {
+		return "", models.ApiKeyCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", models.ApiKeyCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+
+	apiKey.Prefix = prefix
+	apiKey.KeyHash = hashSecret(secret)
+	newApiKey, err := s.serviceAccountGateway.CreateKey(apiKey)
+	if err != nil {
+		return "", models.ApiKeyCore{}, err
+	}
+	return apiKeyPrefix + prefix + "." + secret, newApiKey, nil
+}
+
+func (s *serviceAccountService) GetKeys(serviceAccountId uint, clientId uint, clientRole models.Role) ([]models.ApiKeyCore, error) {
+	if _, err := s.getOwned(serviceAccountId, clientId, clientRole); err != nil {
+		return []models.ApiKeyCore{}, err
+	}
+	return s.serviceAccountGateway.GetKeysByServiceAccountId(serviceAccountId)
+}
+
+func (s *serviceAccountService) DeleteKey(serviceAccountId, id uint, clientId uint, clientRole models.Role) error {
+	if _, err := s.getOwned(serviceAccountId, clientId, clientRole); err != nil {
+		return err
+	}
+	return s.serviceAccountGateway.DeleteKey(serviceAccountId, id)
+}
+
+func (s *serviceAccountService) Authenticate(key string) (ApiKeyPrincipal, error) {
+	invalid := utils.ResponseError{
+		Code:    http.StatusUnauthorized,
+		Message: consts.ErrInvalidApiKey,
+	}
+
+	prefix, secret, found := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), ".")
+	if !found || !strings.HasPrefix(key, apiKeyPrefix) {
+		return ApiKeyPrincipal{}, invalid
+	}
+
+	apiKey, err := s.serviceAccountGateway.GetKeyByPrefix(prefix)
+	if err != nil {
+		return ApiKeyPrincipal{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashSecret(secret))) != 1 {
+		return ApiKeyPrincipal{}, invalid
+	}
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()) {
+		return ApiKeyPrincipal{}, utils.ResponseError{
+			Code:    http.StatusUnauthorized,
+			Message: consts.ErrApiKeyExpired,
+		}
+	}
+
+	// the role is taken from the owner on every request, so demoting the owner limits the key too
+	owner, err := s.userGateway.GetById(apiKey.ServiceAccount.UserId)
+	if err != nil || owner.Disabled {
+		return ApiKeyPrincipal{}, invalid
+	}
+
+	if err = s.serviceAccountGateway.SetKeyLastUsed(apiKey.ID, time.Now()); err != nil {
+		return ApiKeyPrincipal{}, err
+	}
+
+	return ApiKeyPrincipal{
+		UserId:    owner.ID,
+		Role:      owner.Role,
+		Scopes:    apiKey.Scopes,
+		ExpiresAt: apiKey.ExpiresAt,
+	}, nil
+}
+
+func (s *serviceAccountService) getOwned(id uint, clientId uint, clientRole models.Role) (models.ServiceAccountCore, error) {
+	serviceAccount, err := s.serviceAccountGateway.GetById(id)
+	if err != nil {
+		return models.ServiceAccountCore{}, err
+	}
+	if !s.roleService.HasPermission(clientRole, models.PermissionServiceAccountsManageAny) && serviceAccount.UserId != clientId {
+		return models.ServiceAccountCore{}, utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrAccessDenied,
+		}
+	}
+	return serviceAccount, nil
+}
+
+func isKnownScope(scope models.Scope) bool {
+	for _, known := range models.Scopes {
+		if known == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// api keys and recovery codes are random, a fast hash is enough and keeps the middleware cheap
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,7 +1,14 @@
 package services
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/gateways"
@@ -9,31 +16,72 @@ import (
 	"github.com/robboworld/mosquitto-broker/pkg/utils"
 )
 
+const (
+	maxTopicTags        = 16
+	maxTopicDescription = 2000
+	maxTopicContact     = 255
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
 type topicService struct {
-	topicGateway     gateways.TopicGateway
-	userGateway      gateways.UserGateway
-	mosquittoGateway gateways.MosquittoGateway
+	topicGateway        gateways.TopicGateway
+	userGateway         gateways.UserGateway
+	organizationGateway gateways.OrganizationGateway
+	mosquittoGateway    gateways.MosquittoGateway
+	roleService         RoleService
+	quotaService        QuotaService
 }
 
 func NewTopicService(
 	topicGateway gateways.TopicGateway,
 	userGateway gateways.UserGateway,
+	organizationGateway gateways.OrganizationGateway,
 	mosquittoGateway gateways.MosquittoGateway,
+	roleService RoleService,
+	quotaService QuotaService,
 ) *topicService {
 	return &topicService{
-		topicGateway:     topicGateway,
-		userGateway:      userGateway,
-		mosquittoGateway: mosquittoGateway,
+		topicGateway:        topicGateway,
+		userGateway:         userGateway,
+		organizationGateway: organizationGateway,
+		mosquittoGateway:    mosquittoGateway,
+		roleService:         roleService,
+		quotaService:        quotaService,
 	}
 }
 
-func (t *topicService) Create(topic models.TopicCore, clientId uint) (models.TopicCore, error) {
-	user, err := t.userGateway.GetById(clientId)
+// Create makes the topic for topic.UserId, a client creating it for someone
+// else needs topics:write:any and must share the organization of the owner
+func (t *topicService) Create(topic models.TopicCore, clientId uint, clientRole models.Role) (models.TopicCore, error) {
+	if topic.UserId == 0 {
+		topic.UserId = clientId
+	}
+	owner, err := t.userGateway.GetById(topic.UserId)
 	if err != nil {
 		return models.TopicCore{}, err
 	}
+	if err = t.checkAccess(models.TopicCore{UserId: owner.ID, OrganizationId: owner.OrganizationId},
+		clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = validTopicName(topic.Name); err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = validTopicMetadata(&topic); err != nil {
+		return models.TopicCore{}, err
+	}
 
-	exist, err := t.topicGateway.DoesExist(0, user.ID, topic.Name)
+	// the depth quota counts the levels asked for, without the prefix
+	if err = t.quotaService.CheckTopic(owner.ID, topic.Name, topic.CanRead || topic.CanWrite); err != nil {
+		return models.TopicCore{}, err
+	}
+	if topic.Name, err = namespace(t.organizationGateway, t.roleService, owner, topic.Name); err != nil {
+		return models.TopicCore{}, err
+	}
+	topic.OrganizationId = owner.OrganizationId
+
+	exist, err := t.topicGateway.DoesExist(0, owner.ID, topic.Name)
 	if err != nil {
 		return models.TopicCore{}, err
 	}
@@ -44,7 +92,7 @@ func (t *topicService) Create(topic models.TopicCore, clientId uint) (models.Top
 		}
 	}
 
-	t.mosquittoGateway.WriteNewTopicToAcl(user.Email, topic.Name, topic.CanRead, topic.CanWrite)
+	t.mosquittoGateway.WriteNewTopicToAcl(owner.Email, topic.Name, topic.CanRead, topic.CanWrite)
 
 	return t.topicGateway.Create(topic)
 }
@@ -54,22 +102,121 @@ func (t *topicService) GetById(id uint, clientId uint, clientRole models.Role) (
 	if err != nil {
 		return models.TopicCore{}, err
 	}
-	if clientRole.String() != models.RoleSuperAdmin.String() && topic.UserId != clientId {
-		return models.TopicCore{}, utils.ResponseError{
-			Code:    http.StatusForbidden,
-			Message: consts.ErrAccessDenied,
-		}
+	if err = t.checkAccess(topic, clientId, clientRole, models.PermissionTopicsReadAny); err != nil {
+		return models.TopicCore{}, err
 	}
 
 	return topic, nil
 }
 
-func (t *topicService) GetAll(page, pageSize *int, clientId uint, clientRole models.Role) ([]models.TopicCore, uint, error) {
-	offset, limit := utils.GetOffsetAndLimit(page, pageSize)
-	if clientRole.String() != models.RoleSuperAdmin.String() {
-		return t.topicGateway.GetByUserId(clientId, offset, limit)
+// topicCursor is the keyset of the last topic of a page, it is valid only
+// for the sort and order it was made with
+type topicCursor struct {
+	Sort      string    `json:"s"`
+	Desc      bool      `json:"d"`
+	ID        uint      `json:"i"`
+	Name      string    `json:"n,omitempty"`
+	CreatedAt time.Time `json:"c"`
+}
+
+// GetAll lists the topics of the client, or of its organization with topics:read:any.
+// A cursor continues a keyset page and replaces page, pageSize alone means the first page
+func (t *topicService) GetAll(filter models.TopicFilter, sort, order string, page, pageSize *int, cursor string,
+	clientId uint, clientRole models.Role) ([]models.TopicCore, models.PaginationCore, error) {
+	if !t.roleService.HasPermission(clientRole, models.PermissionTopicsReadAny) {
+		if filter.UserId != nil && *filter.UserId != clientId {
+			return []models.TopicCore{}, models.PaginationCore{}, utils.ResponseError{
+				Code:    http.StatusForbidden,
+				Message: consts.ErrAccessDenied,
+			}
+		}
+		filter.UserId = &clientId
+	} else {
+		organizationId, err := clientOrganization(t.userGateway, clientId)
+		if err != nil {
+			return []models.TopicCore{}, models.PaginationCore{}, err
+		}
+		filter.OrganizationId = organizationId
+	}
+
+	if filter.ContentType != "" && !containsString(models.ContentTypes, filter.ContentType) {
+		return []models.TopicCore{}, models.PaginationCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidContentType,
+		}
+	}
+	for i, tag := range filter.Tags {
+		filter.Tags[i] = strings.ToLower(strings.TrimSpace(tag))
+	}
+
+	switch filter.Permission {
+	case "", models.TopicPermissionRead, models.TopicPermissionWrite, models.TopicPermissionNone:
+	default:
+		return []models.TopicCore{}, models.PaginationCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidPermissionFilter,
+		}
+	}
+
+	topicQuery := models.TopicQuery{Filter: filter, Sort: models.TopicSortId}
+	if sort != "" {
+		if !containsString(models.TopicSorts, sort) {
+			return []models.TopicCore{}, models.PaginationCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrUnknownSort,
+			}
+		}
+		topicQuery.Sort = sort
+	}
+	switch strings.ToLower(order) {
+	case "", "asc":
+	case "desc":
+		topicQuery.Desc = true
+	default:
+		return []models.TopicCore{}, models.PaginationCore{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidOrder,
+		}
+	}
+
+	pagination := models.PaginationCore{}
+	if cursor != "" {
+		if pageSize == nil {
+			return []models.TopicCore{}, models.PaginationCore{}, utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrPageSizeRequired,
+			}
+		}
+		after, err := decodeTopicCursor(cursor, topicQuery.Sort, topicQuery.Desc)
+		if err != nil {
+			return []models.TopicCore{}, models.PaginationCore{}, err
+		}
+		topicQuery.After = &after
+		topicQuery.Limit = *pageSize
+		pagination.PageSize = *pageSize
+	} else {
+		if pageSize != nil && page == nil {
+			first := 1
+			page = &first
+		}
+		topicQuery.Offset, topicQuery.Limit = utils.GetOffsetAndLimit(page, pageSize)
+		if pageSize != nil {
+			pagination.Page = *page
+			pagination.PageSize = *pageSize
+		}
+	}
+
+	topics, countRows, err := t.topicGateway.List(topicQuery)
+	if err != nil {
+		return []models.TopicCore{}, models.PaginationCore{}, err
+	}
+	pagination.Total = countRows
+	if topicQuery.Limit > 0 && len(topics) == topicQuery.Limit {
+		if pagination.NextCursor, err = encodeTopicCursor(topics[len(topics)-1], topicQuery.Sort, topicQuery.Desc); err != nil {
+			return []models.TopicCore{}, models.PaginationCore{}, err
+		}
 	}
-	return t.topicGateway.GetAll(offset, limit)
+	return topics, pagination, nil
 }
 
 func (t *topicService) UpdatePermissions(topic models.TopicCore, clientId uint, clientRole models.Role) (models.TopicCore, error) {
@@ -77,20 +224,108 @@ func (t *topicService) UpdatePermissions(topic models.TopicCore, clientId uint,
 	if err != nil {
 		return models.TopicCore{}, err
 	}
-	if clientRole.String() != models.RoleSuperAdmin.String() && currentTopic.UserId != clientId {
+	if err = t.checkAccess(currentTopic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return models.TopicCore{}, err
+	}
+
+	// the acl block is the one of the owner, not of an admin editing the topic
+	owner, err := t.userGateway.GetById(currentTopic.UserId)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	if !currentTopic.CanRead && !currentTopic.CanWrite && (topic.CanRead || topic.CanWrite) {
+		if err = t.quotaService.CheckGrant(currentTopic.UserId); err != nil {
+			return models.TopicCore{}, err
+		}
+	}
+
+	t.mosquittoGateway.WriteUpdatedTopicToAcl(owner.Email, currentTopic.Name, topic.CanRead, topic.CanWrite)
+	return t.topicGateway.UpdatePermissions(topic)
+}
+
+// Rename keeps the permissions, the acl line of the owner is rewritten in place
+// after the db update, which is reverted when the acl cannot be written
+func (t *topicService) Rename(id uint, name string, clientId uint, clientRole models.Role) (models.TopicCore, error) {
+	topic, err := t.topicGateway.GetById(id)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = t.checkAccess(topic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = validTopicName(name); err != nil {
+		return models.TopicCore{}, err
+	}
+	owner, err := t.userGateway.GetById(topic.UserId)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = t.quotaService.CheckTopicDepth(owner.ID, name); err != nil {
+		return models.TopicCore{}, err
+	}
+	if name, err = namespace(t.organizationGateway, t.roleService, owner, name); err != nil {
+		return models.TopicCore{}, err
+	}
+	if name == topic.Name {
+		return topic, nil
+	}
+
+	exist, err := t.topicGateway.DoesExist(id, owner.ID, name)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	if exist {
 		return models.TopicCore{}, utils.ResponseError{
-			Code:    http.StatusForbidden,
-			Message: consts.ErrAccessDenied,
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTopicAlreadyExist,
 		}
 	}
 
-	user, err := t.userGateway.GetById(clientId)
+	renamedTopic, err := t.topicGateway.Rename(id, name)
 	if err != nil {
 		return models.TopicCore{}, err
 	}
+	if err = t.mosquittoGateway.RenameTopicInAcl(owner.Email, topic.Name, name); err != nil {
+		if _, renameErr := t.topicGateway.Rename(id, topic.Name); renameErr != nil {
+			return models.TopicCore{}, utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error() + "; db rollback: " + renameErr.Error(),
+			}
+		}
+		return models.TopicCore{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	t.mosquittoGateway.MosquittoReload()
+	return renamedTopic, nil
+}
 
-	t.mosquittoGateway.WriteUpdatedTopicToAcl(user.Email, currentTopic.Name, topic.CanRead, topic.CanWrite)
-	return t.topicGateway.UpdatePermissions(topic)
+// UpdateMetadata replaces description, tags, content type, qos, retained and contact
+func (t *topicService) UpdateMetadata(topic models.TopicCore, clientId uint, clientRole models.Role) (models.TopicCore, error) {
+	currentTopic, err := t.topicGateway.GetById(topic.ID)
+	if err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = t.checkAccess(currentTopic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return models.TopicCore{}, err
+	}
+	if err = validTopicMetadata(&topic); err != nil {
+		return models.TopicCore{}, err
+	}
+	return t.topicGateway.UpdateMetadata(topic)
+}
+
+// GetTags counts the tags in use on the topics the client can list
+func (t *topicService) GetTags(clientId uint, clientRole models.Role) ([]models.TopicTagCountCore, error) {
+	if !t.roleService.HasPermission(clientRole, models.PermissionTopicsReadAny) {
+		return t.topicGateway.GetTags(&clientId, nil)
+	}
+	organizationId, err := clientOrganization(t.userGateway, clientId)
+	if err != nil {
+		return []models.TopicTagCountCore{}, err
+	}
+	return t.topicGateway.GetTags(nil, organizationId)
 }
 
 func (t *topicService) Delete(id uint, clientId uint, clientRole models.Role) (err error) {
@@ -98,17 +333,197 @@ func (t *topicService) Delete(id uint, clientId uint, clientRole models.Role) (e
 	if err != nil {
 		return err
 	}
-	if clientRole.String() != models.RoleSuperAdmin.String() && topic.UserId != clientId {
+	if err = t.checkAccess(topic, clientId, clientRole, models.PermissionTopicsWriteAny); err != nil {
+		return err
+	}
+	owner, err := t.userGateway.GetById(topic.UserId)
+	if err != nil {
+		return err
+	}
+
+	t.mosquittoGateway.DeleteTopicFromAcl(owner.Email, topic.Name)
+	return t.topicGateway.Delete(id)
+}
+
+func (t *topicService) checkAccess(topic models.TopicCore, clientId uint, clientRole models.Role, anyPermission models.Permission) error {
+	return checkTopicAccess(t.userGateway, t.roleService, topic, clientId, clientRole, anyPermission)
+}
+
+// checkTopicAccess lets the owner through, others need the :any permission
+// and must be in the organization of the topic when they are in one
+func checkTopicAccess(userGateway gateways.UserGateway, roleService RoleService,
+	topic models.TopicCore, clientId uint, clientRole models.Role, anyPermission models.Permission) error {
+	if topic.UserId == clientId {
+		return nil
+	}
+	if !roleService.HasPermission(clientRole, anyPermission) {
 		return utils.ResponseError{
 			Code:    http.StatusForbidden,
 			Message: consts.ErrAccessDenied,
 		}
 	}
-	user, err := t.userGateway.GetById(clientId)
+	organizationId, err := clientOrganization(userGateway, clientId)
 	if err != nil {
 		return err
 	}
+	if !inOrganization(organizationId, topic.OrganizationId) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrAccessDenied,
+		}
+	}
+	return nil
+}
 
-	t.mosquittoGateway.DeleteTopicFromAcl(user.Email, topic.Name)
-	return t.topicGateway.Delete(id)
+// namespace prefixes the topic of an organization user with the slug. The first
+// level of topics outside of organizations must not be a slug, and for users
+// without topics:read:any not a wildcard, which would match every organization
+func namespace(organizationGateway gateways.OrganizationGateway, roleService RoleService,
+	user models.UserCore, name string) (string, error) {
+	if user.OrganizationId != nil {
+		organization, err := organizationGateway.GetById(*user.OrganizationId)
+		if err != nil {
+			return "", err
+		}
+		return organization.TopicPrefix() + name, nil
+	}
+
+	firstLevel, _, _ := strings.Cut(name, "/")
+	if strings.ContainsAny(firstLevel, "#+") {
+		if roleService.HasPermission(user.Role, models.PermissionTopicsReadAny) {
+			return name, nil
+		}
+		return "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTopicReservedLevel,
+		}
+	}
+	exist, err := organizationGateway.DoesExistSlug(strings.ToLower(firstLevel))
+	if err != nil {
+		return "", err
+	}
+	if exist {
+		return "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTopicReservedLevel,
+		}
+	}
+	return name, nil
+}
+
+// validTopicMetadata normalizes the tags to lowercase without duplicates and checks the limits
+func validTopicMetadata(topic *models.TopicCore) error {
+	if utf8.RuneCountInString(topic.Description) > maxTopicDescription || utf8.RuneCountInString(topic.Contact) > maxTopicContact {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTopicMetadataTooLong,
+		}
+	}
+	if topic.ContentType != "" && !containsString(models.ContentTypes, topic.ContentType) {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidContentType,
+		}
+	}
+	if topic.Qos != nil && (*topic.Qos < 0 || *topic.Qos > 2) {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrInvalidQos,
+		}
+	}
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range topic.TagNames() {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrInvalidTag,
+			}
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTopicTags {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTooManyTags,
+		}
+	}
+	topic.SetTags(tags)
+	return nil
+}
+
+// validTopicName checks the mqtt syntax of a topic filter. Whitespace is not
+// allowed either, acl lines are split on it
+func validTopicName(name string) error {
+	invalid := utils.ResponseError{
+		Code:    http.StatusBadRequest,
+		Message: consts.ErrInvalidTopicName,
+	}
+	if name == "" || len(name) > 65535 || !utf8.ValidString(name) {
+		return invalid
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return r == 0 || unicode.IsSpace(r) }) >= 0 {
+		return invalid
+	}
+	levels := strings.Split(name, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return invalid
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return invalid
+		}
+	}
+	return nil
+}
+
+func encodeTopicCursor(topic models.TopicCore, sort string, desc bool) (string, error) {
+	data, err := json.Marshal(topicCursor{
+		Sort:      sort,
+		Desc:      desc,
+		ID:        topic.ID,
+		Name:      topic.Name,
+		CreatedAt: topic.CreatedAt,
+	})
+	if err != nil {
+		return "", utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeTopicCursor(cursor, sort string, desc bool) (models.TopicCore, error) {
+	invalid := utils.ResponseError{
+		Code:    http.StatusBadRequest,
+		Message: consts.ErrInvalidCursor,
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.TopicCore{}, invalid
+	}
+	var keyset topicCursor
+	if err = json.Unmarshal(data, &keyset); err != nil || keyset.Sort != sort || keyset.Desc != desc {
+		return models.TopicCore{}, invalid
+	}
+	return models.TopicCore{
+		ID:        keyset.ID,
+		Name:      keyset.Name,
+		CreatedAt: keyset.CreatedAt,
+	}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/robboworld/mosquitto-broker/internal/gateways"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const (
+	testAdminId uint = 1
+	testOwnerId uint = 2
+)
+
+// the fakes embed the interfaces, a call of a method the tests do not expect panics
+
+type fakeUserGateway struct {
+	gateways.UserGateway
+	users map[uint]models.UserCore
+}
+
+func (f *fakeUserGateway) GetById(id uint) (models.UserCore, error) {
+	user, ok := f.users[id]
+	if !ok {
+		return models.UserCore{}, utils.ResponseError{Code: http.StatusNotFound}
+	}
+	return user, nil
+}
+
+type fakeTopicGateway struct {
+	gateways.TopicGateway
+	topics map[uint]models.TopicCore
+	nextId uint
+}
+
+func (f *fakeTopicGateway) GetById(id uint) (models.TopicCore, error) {
+	topic, ok := f.topics[id]
+	if !ok {
+		return models.TopicCore{}, utils.ResponseError{Code: http.StatusNotFound}
+	}
+	return topic, nil
+}
+
+func (f *fakeTopicGateway) DoesExist(id, userId uint, name string) (bool, error) {
+	for _, topic := range f.topics {
+		if topic.ID != id && topic.UserId == userId && topic.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeTopicGateway) Create(topic models.TopicCore) (models.TopicCore, error) {
+	f.nextId++
+	topic.ID = f.nextId
+	f.topics[topic.ID] = topic
+	return topic, nil
+}
+
+func (f *fakeTopicGateway) UpdatePermissions(topic models.TopicCore) (models.TopicCore, error) {
+	current := f.topics[topic.ID]
+	current.CanRead, current.CanWrite = topic.CanRead, topic.CanWrite
+	f.topics[topic.ID] = current
+	return current, nil
+}
+
+func (f *fakeTopicGateway) Delete(id uint) error {
+	delete(f.topics, id)
+	return nil
+}
+
+type fakeOrganizationGateway struct {
+	gateways.OrganizationGateway
+}
+
+func (f *fakeOrganizationGateway) DoesExistSlug(slug string) (bool, error) {
+	return false, nil
+}
+
+// fakeMosquittoGateway keeps the acl as topic permissions by user block
+type fakeMosquittoGateway struct {
+	gateways.MosquittoGateway
+	acl map[string]map[string]string
+}
+
+func (f *fakeMosquittoGateway) block(email string) map[string]string {
+	if f.acl[email] == nil {
+		f.acl[email] = map[string]string{}
+	}
+	return f.acl[email]
+}
+
+func (f *fakeMosquittoGateway) WriteNewTopicToAcl(email, name string, canRead, canWrite bool) {
+	f.block(email)[name] = aclAccess(canRead, canWrite)
+}
+
+func (f *fakeMosquittoGateway) WriteUpdatedTopicToAcl(email, name string, canRead, canWrite bool) {
+	f.block(email)[name] = aclAccess(canRead, canWrite)
+}
+
+func (f *fakeMosquittoGateway) DeleteTopicFromAcl(username, name string) {
+	delete(f.block(username), name)
+}
+
+func aclAccess(canRead, canWrite bool) string {
+	switch {
+	case canRead && canWrite:
+		return "readwrite"
+	case canRead:
+		return "read"
+	case canWrite:
+		return "write"
+	}
+	return "deny"
+}
+
+type fakeRoleService struct {
+	RoleService
+}
+
+func (f *fakeRoleService) HasPermission(role models.Role, permission models.Permission) bool {
+	for _, granted := range models.DefaultRolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeQuotaService struct {
+	QuotaService
+}
+
+func (f *fakeQuotaService) CheckTopic(userId uint, name string, grant bool) error {
+	return nil
+}
+
+func (f *fakeQuotaService) CheckGrant(userId uint) error {
+	return nil
+}
+
+// newTestTopicService has a SuperAdmin and a user owning the topic 1 "sensors/temperature"
+func newTestTopicService() (*topicService, *fakeMosquittoGateway) {
+	userGateway := &fakeUserGateway{users: map[uint]models.UserCore{
+		testAdminId: {ID: testAdminId, Email: "admin@example.com", Role: models.RoleSuperAdmin},
+		testOwnerId: {ID: testOwnerId, Email: "owner@example.com", Role: models.RoleUser},
+	}}
+	topicGateway := &fakeTopicGateway{topics: map[uint]models.TopicCore{
+		1: {ID: 1, UserId: testOwnerId, Name: "sensors/temperature", CanRead: true},
+	}, nextId: 1}
+	mosquittoGateway := &fakeMosquittoGateway{acl: map[string]map[string]string{
+		"admin@example.com": {"admin/#": "readwrite"},
+		"owner@example.com": {"sensors/temperature": "read"},
+	}}
+	topicService := NewTopicService(topicGateway, userGateway, &fakeOrganizationGateway{}, mosquittoGateway,
+		&fakeRoleService{}, &fakeQuotaService{})
+	return topicService, mosquittoGateway
+}
+
+func copyBlock(block map[string]string) map[string]string {
+	copied := map[string]string{}
+	for name, access := range block {
+		copied[name] = access
+	}
+	return copied
+}
+
+// checkAclBlocks fails unless the owner block is expected and the admin block unchanged
+func checkAclBlocks(t *testing.T, mosquittoGateway *fakeMosquittoGateway, adminBefore, ownerExpected map[string]string) {
+	t.Helper()
+	if owner := mosquittoGateway.acl["owner@example.com"]; !reflect.DeepEqual(owner, ownerExpected) {
+		t.Errorf("owner acl block = %v, want %v", owner, ownerExpected)
+	}
+	if admin := mosquittoGateway.acl["admin@example.com"]; !reflect.DeepEqual(admin, adminBefore) {
+		t.Errorf("admin acl block = %v, want it unchanged %v", admin, adminBefore)
+	}
+}
+
+func TestUpdatePermissionsOfAnotherUserWritesOwnerAcl(t *testing.T) {
+	topicService, mosquittoGateway := newTestTopicService()
+	adminBefore := copyBlock(mosquittoGateway.acl["admin@example.com"])
+
+	topic, err := topicService.UpdatePermissions(models.TopicCore{ID: 1, CanRead: true, CanWrite: true},
+		testAdminId, models.RoleSuperAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic.UserId != testOwnerId || !topic.CanWrite {
+		t.Errorf("unexpected topic %+v", topic)
+	}
+	checkAclBlocks(t, mosquittoGateway, adminBefore, map[string]string{"sensors/temperature": "readwrite"})
+}
+
+func TestDeleteOfAnotherUserWritesOwnerAcl(t *testing.T) {
+	topicService, mosquittoGateway := newTestTopicService()
+	adminBefore := copyBlock(mosquittoGateway.acl["admin@example.com"])
+
+	if err := topicService.Delete(1, testAdminId, models.RoleSuperAdmin); err != nil {
+		t.Fatal(err)
+	}
+	checkAclBlocks(t, mosquittoGateway, adminBefore, map[string]string{})
+}
+
+func TestCreateForAnotherUserWritesOwnerAcl(t *testing.T) {
+	topicService, mosquittoGateway := newTestTopicService()
+	adminBefore := copyBlock(mosquittoGateway.acl["admin@example.com"])
+
+	topic, err := topicService.Create(models.TopicCore{UserId: testOwnerId, Name: "sensors/humidity", CanWrite: true},
+		testAdminId, models.RoleSuperAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic.UserId != testOwnerId {
+		t.Errorf("topic owner = %d, want %d", topic.UserId, testOwnerId)
+	}
+	checkAclBlocks(t, mosquittoGateway, adminBefore, map[string]string{
+		"sensors/temperature": "read",
+		"sensors/humidity":    "write",
+	})
+}
+
+func TestUpdatePermissionsOfAnotherUserNeedsWriteAny(t *testing.T) {
+	topicService, mosquittoGateway := newTestTopicService()
+	ownerBefore := copyBlock(mosquittoGateway.acl["owner@example.com"])
+
+	_, err := topicService.UpdatePermissions(models.TopicCore{ID: 1, CanWrite: true}, testAdminId, models.RoleUser)
+	if respErr, ok := err.(utils.ResponseError); !ok || respErr.Code != http.StatusForbidden {
+		t.Fatalf("err = %v, want 403", err)
+	}
+	if owner := mosquittoGateway.acl["owner@example.com"]; !reflect.DeepEqual(owner, ownerBefore) {
+		t.Errorf("owner acl block = %v, want it unchanged %v", owner, ownerBefore)
+	}
+}
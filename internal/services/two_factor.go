@@ -0,0 +1,278 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/totp"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const recoveryCodesCount = 10
+
+type ChallengeType string
+
+const (
+	// ChallengeVerify asks for a totp or recovery code
+	ChallengeVerify ChallengeType = "verify"
+	// ChallengeEnroll is returned to users who must enable 2fa before getting tokens
+	ChallengeEnroll ChallengeType = "enroll"
+)
+
+type ChallengeClaims struct {
+	jwt.StandardClaims
+	Id   uint
+	Type ChallengeType
+}
+
+func (a *authService) challenge(user models.UserCore) (Tokens, error) {
+	challengeType := ChallengeVerify
+	if !user.TotpEnabled {
+		challengeType = ChallengeEnroll
+	}
+
+	claims := ChallengeClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: jwt.At(time.Now().Add(a.challengeTTL)),
+		},
+		Id:   user.ID,
+		Type: challengeType,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.challengeKey)
+	if err != nil {
+		return Tokens{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return Tokens{Challenge: token, ChallengeType: challengeType}, nil
+}
+
+func (a *authService) parseChallenge(token string, challengeType ChallengeType) (models.UserCore, error) {
+	invalid := utils.ResponseError{
+		Code:    http.StatusUnauthorized,
+		Message: consts.ErrInvalidChallenge,
+	}
+
+	claims := &ChallengeClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, jwt.KnownKeyfunc(jwt.SigningMethodHS256, a.challengeKey))
+	if err != nil || claims.Type != challengeType {
+		return models.UserCore{}, invalid
+	}
+	user, err := a.userGateway.GetById(claims.Id)
+	if err != nil {
+		return models.UserCore{}, invalid
+	}
+	// wrong codes lock the account like wrong passwords, the challenges
+	// issued before stop working as well
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		return models.UserCore{}, invalid
+	}
+	return user, nil
+}
+
+// resolveUser takes the user from the challenge token when it is given,
+// otherwise from the session
+func (a *authService) resolveUser(clientId uint, challengeToken string) (models.UserCore, error) {
+	if challengeToken != "" {
+		return a.parseChallenge(challengeToken, ChallengeEnroll)
+	}
+	if clientId == 0 {
+		return models.UserCore{}, utils.ResponseError{
+			Code:    http.StatusUnauthorized,
+			Message: consts.ErrInvalidChallenge,
+		}
+	}
+	return a.userGateway.GetById(clientId)
+}
+
+func (a *authService) EnrollTwoFactor(clientId uint, challengeToken string) (string, string, error) {
+	user, err := a.resolveUser(clientId, challengeToken)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TotpEnabled {
+		return "", "", utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTwoFactorAlreadyEnabled,
+		}
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if err = a.userGateway.SetTotp(user.ID, secret, false); err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(a.totpIssuer, user.Email, secret), nil
+}
+
+// ConfirmTwoFactor enables 2fa after the first valid code. When enrolment was
+// forced by a challenge the session tokens are issued right away
+func (a *authService) ConfirmTwoFactor(clientId uint, challengeToken, code string) ([]string, Tokens, error) {
+	user, err := a.resolveUser(clientId, challengeToken)
+	if err != nil {
+		return nil, Tokens{}, err
+	}
+	if user.TotpEnabled {
+		return nil, Tokens{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTwoFactorAlreadyEnabled,
+		}
+	}
+	if user.TotpSecret == "" {
+		return nil, Tokens{}, utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTwoFactorNotEnrolled,
+		}
+	}
+	if err = a.validateCode(user, code); err != nil {
+		return nil, Tokens{}, err
+	}
+
+	recoveryCodes, codeHashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, Tokens{}, utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	if err = a.recoveryCodeGateway.Replace(user.ID, codeHashes); err != nil {
+		return nil, Tokens{}, err
+	}
+	if err = a.userGateway.SetTotp(user.ID, user.TotpSecret, true); err != nil {
+		return nil, Tokens{}, err
+	}
+
+	if challengeToken == "" {
+		return recoveryCodes, Tokens{}, nil
+	}
+	tokens, err := a.issueTokens(user)
+	return recoveryCodes, tokens, err
+}
+
+func (a *authService) VerifyTwoFactor(challengeToken, code, recoveryCode string) (Tokens, error) {
+	user, err := a.parseChallenge(challengeToken, ChallengeVerify)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	if recoveryCode != "" {
+		used, err := a.recoveryCodeGateway.Use(user.ID, hashSecret(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return Tokens{}, err
+		}
+		if !used {
+			return Tokens{}, a.failTwoFactor(user)
+		}
+		return a.issueTokens(user)
+	}
+
+	if err = a.validateCode(user, code); err != nil {
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) && respErr.Message == consts.ErrInvalidTwoFactorCode {
+			return Tokens{}, a.failTwoFactor(user)
+		}
+		return Tokens{}, err
+	}
+	return a.issueTokens(user)
+}
+
+// failTwoFactor counts the wrong code on the account, a 6 digit code would
+// be guessed otherwise by retrying the challenge or signing in again
+func (a *authService) failTwoFactor(user models.UserCore) error {
+	if err := a.failSignIn(user); err != nil {
+		return err
+	}
+	return utils.ResponseError{
+		Code:    http.StatusBadRequest,
+		Message: consts.ErrInvalidTwoFactorCode,
+	}
+}
+
+func (a *authService) DisableTwoFactor(clientId uint, code string) error {
+	user, err := a.userGateway.GetById(clientId)
+	if err != nil {
+		return err
+	}
+	if user.Role == models.RoleSuperAdmin {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrTwoFactorRequired,
+		}
+	}
+	if !user.TotpEnabled {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrTwoFactorNotEnrolled,
+		}
+	}
+	if err = a.validateCode(user, code); err != nil {
+		return err
+	}
+
+	if err = a.recoveryCodeGateway.Replace(user.ID, nil); err != nil {
+		return err
+	}
+	return a.userGateway.SetTotp(user.ID, "", false)
+}
+
+func (a *authService) validateCode(user models.UserCore, code string) error {
+	invalid := utils.ResponseError{
+		Code:    http.StatusBadRequest,
+		Message: consts.ErrInvalidTwoFactorCode,
+	}
+
+	step, ok := totp.Validate(user.TotpSecret, strings.TrimSpace(code), time.Now(), a.totpSkew)
+	if !ok {
+		return invalid
+	}
+	fresh, err := a.userGateway.UseTotpStep(user.ID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return invalid
+	}
+	return nil
+}
+
+func generateRecoveryCodes() (codes []string, codeHashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 5)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		codeHashes = append(codeHashes, hashSecret(code))
+	}
+	return codes, codeHashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// deriveKey gives challenge tokens their own key, so they can never be
+// accepted as refresh tokens signed with the parent key
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/keys"
+	"github.com/robboworld/mosquitto-broker/pkg/totp"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const testRecoveryCode = "abcd-efgh"
+
+type fakeKeySet struct {
+	keys.KeySet
+	key keys.Key
+}
+
+func (f *fakeKeySet) Signing() keys.Key {
+	return f.key
+}
+
+func (f *fakeUserGateway) UseTotpStep(id uint, step int64) (bool, error) {
+	user := f.users[id]
+	if user.TotpLastStep >= step {
+		return false, nil
+	}
+	user.TotpLastStep = step
+	f.users[id] = user
+	return true, nil
+}
+
+type fakeRecoveryCodeGateway struct {
+	codeHashes map[string]bool
+}
+
+func (f *fakeRecoveryCodeGateway) Replace(userId uint, codeHashes []string) error {
+	f.codeHashes = map[string]bool{}
+	for _, codeHash := range codeHashes {
+		f.codeHashes[codeHash] = true
+	}
+	return nil
+}
+
+func (f *fakeRecoveryCodeGateway) Use(userId uint, codeHash string) (bool, error) {
+	used := f.codeHashes[codeHash]
+	delete(f.codeHashes, codeHash)
+	return used, nil
+}
+
+// newTestTwoFactorService signs in the user with 2fa and returns the challenge
+func newTestTwoFactorService(t *testing.T) (*authService, *fakeUserGateway, string) {
+	authService, userGateway := newTestAuthService()
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := userGateway.users[testOwnerId]
+	user.TotpSecret = secret
+	userGateway.users[testOwnerId] = user
+	authService.recoveryCodeGateway = &fakeRecoveryCodeGateway{codeHashes: map[string]bool{
+		hashSecret(normalizeRecoveryCode(testRecoveryCode)): true,
+	}}
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authService.accessKeys = &fakeKeySet{key: keys.Key{
+		Kid:     "test",
+		Method:  jwt.SigningMethodES256,
+		Private: private,
+		Public:  private.Public(),
+	}}
+	authService.refreshSigningKey = []byte("refresh key")
+
+	tokens, err := authService.SignIn("owner@example.com", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authService, userGateway, tokens.Challenge
+}
+
+// wrongCode is a well formed code that is not valid around now
+func wrongCode(secret string) string {
+	for _, code := range []string{"000000", "111111", "222222", "333333"} {
+		if _, ok := totp.Validate(secret, code, time.Now(), 2); !ok {
+			return code
+		}
+	}
+	return "444444"
+}
+
+func isInvalidCode(err error) bool {
+	respErr, ok := err.(utils.ResponseError)
+	return ok && respErr.Code == http.StatusBadRequest && respErr.Message == consts.ErrInvalidTwoFactorCode
+}
+
+func isInvalidChallenge(err error) bool {
+	respErr, ok := err.(utils.ResponseError)
+	return ok && respErr.Code == http.StatusUnauthorized && respErr.Message == consts.ErrInvalidChallenge
+}
+
+func TestVerifyTwoFactorLocksAfterWrongCodes(t *testing.T) {
+	authService, userGateway, challenge := newTestTwoFactorService(t)
+	code := wrongCode(userGateway.users[testOwnerId].TotpSecret)
+
+	for i := 1; i <= authService.lockoutThreshold; i++ {
+		if _, err := authService.VerifyTwoFactor(challenge, code, ""); !isInvalidCode(err) {
+			t.Fatalf("wrong code %d: err = %v", i, err)
+		}
+		if failed := userGateway.users[testOwnerId].FailedSignIns; failed != i {
+			t.Fatalf("FailedSignIns = %d, want %d", failed, i)
+		}
+	}
+
+	// the challenge is rejected now, even with a right recovery code
+	if _, err := authService.VerifyTwoFactor(challenge, "", testRecoveryCode); !isInvalidChallenge(err) {
+		t.Fatalf("locked account: err = %v, want the invalid challenge error", err)
+	}
+	// and a new challenge cannot be taken with the password
+	if _, err := authService.SignIn("owner@example.com", testPassword); !isIncorrect(err) {
+		t.Fatalf("sign in while locked: err = %v", err)
+	}
+}
+
+func TestVerifyTwoFactorCountsAcrossSignIns(t *testing.T) {
+	authService, userGateway, challenge := newTestTwoFactorService(t)
+	code := wrongCode(userGateway.users[testOwnerId].TotpSecret)
+
+	for i := 1; i < authService.lockoutThreshold; i++ {
+		if _, err := authService.VerifyTwoFactor(challenge, code, ""); !isInvalidCode(err) {
+			t.Fatalf("wrong code %d: err = %v", i, err)
+		}
+		// a new challenge with the right password does not start over
+		tokens, err := authService.SignIn("owner@example.com", testPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge = tokens.Challenge
+	}
+	if _, err := authService.VerifyTwoFactor(challenge, code, ""); !isInvalidCode(err) {
+		t.Fatalf("last wrong code: err = %v", err)
+	}
+	if _, err := authService.VerifyTwoFactor(challenge, "", testRecoveryCode); !isInvalidChallenge(err) {
+		t.Fatalf("locked account: err = %v, want the invalid challenge error", err)
+	}
+}
+
+func TestVerifyTwoFactorWrongRecoveryCode(t *testing.T) {
+	authService, userGateway, challenge := newTestTwoFactorService(t)
+
+	if _, err := authService.VerifyTwoFactor(challenge, "", "zzzz-zzzz"); !isInvalidCode(err) {
+		t.Fatalf("wrong recovery code: err = %v", err)
+	}
+	if failed := userGateway.users[testOwnerId].FailedSignIns; failed != 1 {
+		t.Fatalf("FailedSignIns = %d, want 1", failed)
+	}
+
+	tokens, err := authService.VerifyTwoFactor(challenge, "", testRecoveryCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Access == "" || tokens.Refresh == "" {
+		t.Errorf("no session tokens: %+v", tokens)
+	}
+	if user := userGateway.users[testOwnerId]; user.FailedSignIns != 0 || user.LockedUntil != nil {
+		t.Errorf("failures not reset after the sign in: %d, %v", user.FailedSignIns, user.LockedUntil)
+	}
+}
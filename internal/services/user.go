@@ -2,6 +2,9 @@ package services
 
 import (
 	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/gateways"
@@ -10,12 +13,28 @@ import (
 )
 
 type userService struct {
-	userGateway gateways.UserGateway
+	userGateway       gateways.UserGateway
+	topicGateway      gateways.TopicGateway
+	mosquittoGateway  gateways.MosquittoGateway
+	emailTokenGateway gateways.EmailTokenGateway
+	roleService       RoleService
+	deletedRetention  time.Duration
 }
 
-func NewUserService(userGateway gateways.UserGateway) *userService {
+func NewUserService(
+	userGateway gateways.UserGateway,
+	topicGateway gateways.TopicGateway,
+	mosquittoGateway gateways.MosquittoGateway,
+	emailTokenGateway gateways.EmailTokenGateway,
+	roleService RoleService,
+) *userService {
 	return &userService{
-		userGateway: userGateway,
+		userGateway:       userGateway,
+		topicGateway:      topicGateway,
+		mosquittoGateway:  mosquittoGateway,
+		emailTokenGateway: emailTokenGateway,
+		roleService:       roleService,
+		deletedRetention:  viper.GetDuration("deleted_users.retention"),
 	}
 }
 
@@ -25,12 +44,292 @@ func (u *userService) GetById(id uint, clientId uint, clientRole models.Role) (m
 		return models.UserCore{}, err
 	}
 
-	if clientRole.String() != models.RoleSuperAdmin.String() && user.ID != clientId {
+	if user.ID == clientId {
+		return user, nil
+	}
+	if !u.roleService.HasPermission(clientRole, models.PermissionUsersReadAny) {
 		return models.UserCore{}, utils.ResponseError{
 			Code:    http.StatusForbidden,
 			Message: consts.ErrAccessDenied,
 		}
 	}
+	if err = u.checkOrganization(user, clientId); err != nil {
+		return models.UserCore{}, err
+	}
 
 	return user, nil
 }
+
+func (u *userService) GetByEmail(email string) (models.UserCore, error) {
+	return u.userGateway.GetByEmail(email)
+}
+
+func (u *userService) UpdateProfile(clientId uint, fullName string) (models.UserCore, error) {
+	if err := u.userGateway.SetFullName(clientId, fullName); err != nil {
+		return models.UserCore{}, err
+	}
+	return u.userGateway.GetById(clientId)
+}
+
+func (u *userService) GetAll(page, pageSize *int, search string, clientId uint) ([]models.UserCore, uint, error) {
+	organizationId, err := clientOrganization(u.userGateway, clientId)
+	if err != nil {
+		return []models.UserCore{}, 0, err
+	}
+	offset, limit := utils.GetOffsetAndLimit(page, pageSize)
+	return u.userGateway.GetAll(offset, limit, search, organizationId)
+}
+
+func (u *userService) GetTopics(id uint) ([]models.TopicCore, error) {
+	topics, _, err := u.topicGateway.GetByUserId(id, 0, -1)
+	return topics, err
+}
+
+func (u *userService) SetRole(id uint, role models.Role, clientId uint, clientRole models.Role) error {
+	if !isKnownRole(role) || role == models.RoleAnonymous {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrUnknownRole,
+		}
+	}
+	// an admin demoting themselves could leave nobody to undo it
+	if id == clientId {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrSelfManage,
+		}
+	}
+	user, err := u.userGateway.GetById(id)
+	if err != nil {
+		return err
+	}
+	if err = u.checkOrganization(user, clientId); err != nil {
+		return err
+	}
+	// demoting a SuperAdmin is guarded as well as promoting to it
+	if err = checkPrivilegedRole(u.roleService, user.Role, clientRole); err != nil {
+		return err
+	}
+	if err = checkPrivilegedRole(u.roleService, role, clientRole); err != nil {
+		return err
+	}
+	// a SuperAdmin in an organization would manage roles of every organization
+	if role == models.RoleSuperAdmin && user.OrganizationId != nil {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrSuperAdminInOrganization,
+		}
+	}
+	if err = u.userGateway.SetRole(id, role); err != nil {
+		return err
+	}
+	// access tokens carry the role, the old ones must not outlive the change
+	return u.userGateway.RevokeSessions(id, time.Now())
+}
+
+// SetDisabled removes the passwordfile entry and the acl block of a disabled
+// user and restores them from the kept hash and the topics on enabling
+func (u *userService) SetDisabled(id uint, disabled bool, clientId uint, clientRole models.Role) error {
+	if id == clientId {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrSelfManage,
+		}
+	}
+	user, err := u.userGateway.GetById(id)
+	if err != nil {
+		return err
+	}
+	if err = u.checkOrganization(user, clientId); err != nil {
+		return err
+	}
+	// disabling every SuperAdmin would leave nobody to manage the roles
+	if err = checkPrivilegedRole(u.roleService, user.Role, clientRole); err != nil {
+		return err
+	}
+	if disabled == user.Disabled {
+		message := consts.ErrUserAlreadyDisabled
+		if !disabled {
+			message = consts.ErrUserNotDisabled
+		}
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: message,
+		}
+	}
+
+	if disabled {
+		return u.disable(user)
+	}
+	return u.enable(user)
+}
+
+func (u *userService) disable(user models.UserCore) error {
+	// a user pending verification has no broker entries, the hash is already kept
+	brokerPasswordHash := user.BrokerPasswordHash
+	if !user.PendingVerification {
+		passwordHash, found, err := u.mosquittoGateway.GetMosquittoPasswdHash(user.Email)
+		if err != nil {
+			return utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}
+		}
+		if found {
+			brokerPasswordHash = passwordHash
+		}
+	}
+
+	if err := u.userGateway.SetDisabled(user.ID, true, brokerPasswordHash); err != nil {
+		return err
+	}
+	if err := u.userGateway.RevokeSessions(user.ID, time.Now()); err != nil {
+		return err
+	}
+
+	if err := u.mosquittoGateway.DeleteMosquittoPasswd(user.Email); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	u.mosquittoGateway.DeleteUserFromAcl(user.Email)
+	u.mosquittoGateway.MosquittoReload()
+	return nil
+}
+
+func (u *userService) enable(user models.UserCore) error {
+	if user.PendingVerification {
+		return u.userGateway.SetDisabled(user.ID, false, user.BrokerPasswordHash)
+	}
+
+	topics, _, err := u.topicGateway.GetByUserId(user.ID, 0, -1)
+	if err != nil {
+		return err
+	}
+	if user.BrokerPasswordHash != "" {
+		if err = u.mosquittoGateway.WriteMosquittoPasswdHash(user.Email, user.BrokerPasswordHash); err != nil {
+			return utils.ResponseError{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			}
+		}
+	}
+	u.mosquittoGateway.WriteNewUserToAcl(user.Email)
+	for _, topic := range topics {
+		u.mosquittoGateway.WriteNewTopicToAcl(user.Email, topic.Name, topic.CanRead, topic.CanWrite)
+	}
+
+	if err = u.userGateway.SetDisabled(user.ID, false, ""); err != nil {
+		return err
+	}
+	u.mosquittoGateway.MosquittoReload()
+	return nil
+}
+
+func (u *userService) Delete(id uint, clientId uint, clientRole models.Role) error {
+	if id == clientId {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrSelfManage,
+		}
+	}
+	user, err := u.userGateway.GetById(id)
+	if err != nil {
+		return err
+	}
+	if err = u.checkOrganization(user, clientId); err != nil {
+		return err
+	}
+	if err = checkPrivilegedRole(u.roleService, user.Role, clientRole); err != nil {
+		return err
+	}
+	return u.delete(user)
+}
+
+// DeleteMe takes the current password or a token of RequestAccountDeletion,
+// the token proves the ownership of the email like a password reset does
+func (u *userService) DeleteMe(clientId uint, password, token string) error {
+	user, err := u.userGateway.GetById(clientId)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		// a token of another user is not consumed
+		var emailToken models.EmailTokenCore
+		emailToken, err = u.emailTokenGateway.Get(models.EmailTokenDeleteAccount, hashSecret(token))
+		if err != nil {
+			return err
+		}
+		if emailToken.UserId != user.ID {
+			return utils.ResponseError{
+				Code:    http.StatusBadRequest,
+				Message: consts.ErrInvalidEmailToken,
+			}
+		}
+		if _, err = u.emailTokenGateway.Consume(models.EmailTokenDeleteAccount, hashSecret(token)); err != nil {
+			return err
+		}
+		return u.delete(user)
+	}
+	if err = utils.ComparePassword(user.Password, password); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusBadRequest,
+			Message: consts.ErrIncorrectPassword,
+		}
+	}
+	return u.delete(user)
+}
+
+// PurgeDeleted removes the users deleted longer than deleted_users.retention ago,
+// zero retention keeps them forever
+func (u *userService) PurgeDeleted() (int, error) {
+	if u.deletedRetention <= 0 {
+		return 0, nil
+	}
+	return u.userGateway.PurgeDeleted(time.Now().Add(-u.deletedRetention))
+}
+
+// delete soft deletes the user with the topics, the broker entries are removed at once
+func (u *userService) delete(user models.UserCore) error {
+	if err := u.userGateway.Delete(user.ID); err != nil {
+		return err
+	}
+
+	if err := u.mosquittoGateway.DeleteMosquittoPasswd(user.Email); err != nil {
+		return utils.ResponseError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	u.mosquittoGateway.DeleteUserFromAcl(user.Email)
+	u.mosquittoGateway.MosquittoReload()
+	return nil
+}
+
+// checkPrivilegedRole keeps users:write:any from making anyone SuperAdmin or
+// changing a SuperAdmin, that role holds every permission including roles:manage
+func checkPrivilegedRole(roleService RoleService, role, clientRole models.Role) error {
+	if role != models.RoleSuperAdmin || roleService.HasPermission(clientRole, models.PermissionRolesManage) {
+		return nil
+	}
+	return utils.ResponseError{
+		Code:    http.StatusForbidden,
+		Message: consts.ErrPrivilegedRole,
+	}
+}
+
+// checkOrganization keeps the :any permissions of a client in an organization inside it
+func (u *userService) checkOrganization(user models.UserCore, clientId uint) error {
+	organizationId, err := clientOrganization(u.userGateway, clientId)
+	if err != nil {
+		return err
+	}
+	if !inOrganization(organizationId, user.OrganizationId) {
+		return utils.ResponseError{
+			Code:    http.StatusForbidden,
+			Message: consts.ErrAccessDenied,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+// TestSuperAdminNeedsRolesManage has an OrgAdmin outside of organizations,
+// users:write:any reaches every user but must not reach a SuperAdmin
+func TestSuperAdminNeedsRolesManage(t *testing.T) {
+	userGateway := &fakeUserGateway{users: map[uint]models.UserCore{
+		testAdminId: {ID: testAdminId, Email: "admin@example.com", Role: models.RoleSuperAdmin},
+		testOwnerId: {ID: testOwnerId, Email: "orgadmin@example.com", Role: models.RoleOrgAdmin},
+	}}
+	// the fake gateways panic on any write, so a refused call writes nothing
+	userService := NewUserService(userGateway, &fakeTopicGateway{}, &fakeMosquittoGateway{}, nil, &fakeRoleService{})
+
+	calls := map[string]func() error{
+		"disable": func() error { return userService.SetDisabled(testAdminId, true, testOwnerId, models.RoleOrgAdmin) },
+		"delete":  func() error { return userService.Delete(testAdminId, testOwnerId, models.RoleOrgAdmin) },
+		"demote": func() error {
+			return userService.SetRole(testAdminId, models.RoleUser, testOwnerId, models.RoleOrgAdmin)
+		},
+	}
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			err := call()
+			if respErr, ok := err.(utils.ResponseError); !ok || respErr.Code != http.StatusForbidden ||
+				respErr.Message != consts.ErrPrivilegedRole {
+				t.Errorf("err = %v, want 403 %q", err, consts.ErrPrivilegedRole)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package http
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/services"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+const (
+	bundleFormatJson = "json"
+	bundleFormatCsv  = "csv"
+)
+
+// bundleCsvHeader are the columns of the csv bundle, every row is a user or a
+// topic by kind, the email of a topic row is its owner. Tags are separated by ;
+var bundleCsvHeader = []string{"kind", "email", "full_name", "role", "organization", "password", "name", "can_read", "can_write",
+	"description", "tags", "content_type", "qos", "retained", "contact"}
+
+type adminHandler struct {
+	loggers logger.Loggers
+	bundle  services.BundleService
+	message services.MessageService
+}
+
+func NewAdminHandler(
+	loggers logger.Loggers,
+	bundle services.BundleService,
+	message services.MessageService,
+) *adminHandler {
+	return &adminHandler{
+		loggers: loggers,
+		bundle:  bundle,
+		message: message,
+	}
+}
+
+func (h *adminHandler) SetupAdminRoutes(router *gin.Engine, requirePermission RequirePermission) {
+	adminGroup := router.Group("/admin")
+	{
+		adminGroup.POST("/import", requirePermission(models.PermissionUsersWriteAny, models.PermissionTopicsWriteAny), h.Import)
+		adminGroup.GET("/export", requirePermission(models.PermissionUsersReadAny, models.PermissionTopicsReadAny), h.Export)
+		adminGroup.DELETE("/retained", requirePermission(models.PermissionRetainedClearAny), h.ClearRetained)
+	}
+}
+
+func (h *adminHandler) Import(c *gin.Context) {
+	format := c.Query("format")
+	if format == "" {
+		format = bundleFormatJson
+		if strings.HasPrefix(c.ContentType(), "text/csv") {
+			format = bundleFormatCsv
+		}
+	}
+	dryRun := false
+	if dryRunStr := c.Query("dry_run"); dryRunStr != "" {
+		value, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			h.loggers.Err.Printf("%s", dryRunStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		dryRun = value
+	}
+
+	var bundle models.BundleCore
+	switch format {
+	case bundleFormatJson:
+		var input models.BundleHTTP
+		if err := c.ShouldBindJSON(&input); err != nil {
+			h.loggers.Err.Printf("%s", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		bundle = input.ToCore()
+	case bundleFormatCsv:
+		var err error
+		if bundle, err = readBundleCsv(c.Request.Body); err != nil {
+			h.loggers.Err.Printf("%s", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrUnknownBundleFormat})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	report, err := h.bundle.Import(bundle, dryRun, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	reportHttp := models.ImportReportHTTP{}
+	reportHttp.FromCore(report)
+	c.JSON(http.StatusOK, gin.H{"report": reportHttp})
+}
+
+func (h *adminHandler) Export(c *gin.Context) {
+	format := c.DefaultQuery("format", bundleFormatJson)
+	if format != bundleFormatJson && format != bundleFormatCsv {
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrUnknownBundleFormat})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	bundle, err := h.bundle.Export(userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if format == bundleFormatCsv {
+		c.Header("Content-Disposition", `attachment; filename="bundle.csv"`)
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err = writeBundleCsv(c.Writer, bundle); err != nil {
+			h.loggers.Err.Printf("%s", err.Error())
+		}
+		return
+	}
+
+	bundleHttp := models.BundleHTTP{}
+	bundleHttp.FromCore(bundle)
+	c.JSON(http.StatusOK, bundleHttp)
+}
+
+// readBundleCsv maps the columns by the header, so their order is free and
+// missing ones are empty. Row is the line of the record
+func readBundleCsv(r io.Reader) (models.BundleCore, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return models.BundleCore{}, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, found := columns["kind"]; !found {
+		return models.BundleCore{}, errors.New("csv header must have the kind column")
+	}
+
+	bundle := models.BundleCore{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return models.BundleCore{}, err
+		}
+		row, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			i, found := columns[name]
+			if !found || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		flag := func(name string) (bool, error) {
+			if value := field(name); value != "" {
+				return strconv.ParseBool(value)
+			}
+			return false, nil
+		}
+
+		switch field("kind") {
+		case models.BundleKindUser:
+			bundle.Users = append(bundle.Users, models.BundleUserCore{
+				Row:          row,
+				Email:        field("email"),
+				FullName:     field("full_name"),
+				Role:         models.Role(field("role")),
+				Organization: field("organization"),
+				Password:     field("password"),
+			})
+		case models.BundleKindTopic:
+			canRead, err := flag("can_read")
+			if err != nil {
+				return models.BundleCore{}, errors.New("line " + strconv.Itoa(row) + ": can_read: " + err.Error())
+			}
+			canWrite, err := flag("can_write")
+			if err != nil {
+				return models.BundleCore{}, errors.New("line " + strconv.Itoa(row) + ": can_write: " + err.Error())
+			}
+			topic := models.BundleTopicCore{
+				Row:         row,
+				Owner:       field("email"),
+				Name:        field("name"),
+				CanRead:     canRead,
+				CanWrite:    canWrite,
+				Description: field("description"),
+				ContentType: field("content_type"),
+				Contact:     field("contact"),
+			}
+			if tags := field("tags"); tags != "" {
+				topic.Tags = strings.Split(tags, ";")
+			}
+			if qos := field("qos"); qos != "" {
+				value, err := strconv.Atoi(qos)
+				if err != nil {
+					return models.BundleCore{}, errors.New("line " + strconv.Itoa(row) + ": qos: " + err.Error())
+				}
+				topic.Qos = &value
+			}
+			if field("retained") != "" {
+				retained, err := flag("retained")
+				if err != nil {
+					return models.BundleCore{}, errors.New("line " + strconv.Itoa(row) + ": retained: " + err.Error())
+				}
+				topic.Retained = &retained
+			}
+			bundle.Topics = append(bundle.Topics, topic)
+		default:
+			return models.BundleCore{}, errors.New("line " + strconv.Itoa(row) + ": kind must be user or topic")
+		}
+	}
+	return bundle, nil
+}
+
+func writeBundleCsv(w io.Writer, bundle models.BundleCore) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(bundleCsvHeader); err != nil {
+		return err
+	}
+	for _, user := range bundle.Users {
+		record := []string{models.BundleKindUser, user.Email, user.FullName, user.Role.String(), user.Organization,
+			"", "", "", "", "", "", "", "", "", ""}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	for _, topic := range bundle.Topics {
+		var qos, retained string
+		if topic.Qos != nil {
+			qos = strconv.Itoa(*topic.Qos)
+		}
+		if topic.Retained != nil {
+			retained = strconv.FormatBool(*topic.Retained)
+		}
+		record := []string{models.BundleKindTopic, topic.Owner, "", "", "", "", topic.Name,
+			strconv.FormatBool(topic.CanRead), strconv.FormatBool(topic.CanWrite),
+			topic.Description, strings.Join(topic.Tags, ";"), topic.ContentType, qos, retained, topic.Contact}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ClearRetained clears the retained messages on ?prefix= and below
+func (h *adminHandler) ClearRetained(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+
+	cleared, err := h.message.ClearRetainedUnder(c.Query("prefix"), userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message, "cleared": cleared})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "cleared": cleared})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cleared": cleared})
+}
@@ -6,7 +6,9 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/passwordpolicy"
 	"github.com/robboworld/mosquitto-broker/internal/services"
 	"github.com/robboworld/mosquitto-broker/pkg/logger"
 	"github.com/robboworld/mosquitto-broker/pkg/utils"
@@ -27,13 +29,25 @@ func NewAuthHandler(
 	}
 }
 
-func (h *authHandler) SetupAuthRoutes(router *gin.Engine) {
+func (h *authHandler) SetupAuthRoutes(router *gin.Engine, rateLimit RateLimit) {
 	authGroup := router.Group("/auth")
 	{
-		authGroup.POST("/sign-up", h.SignUp)
-		authGroup.POST("/sign-in", h.SignIn)
+		authGroup.POST("/sign-up", rateLimit("ip"), h.SignUp)
+		authGroup.POST("/sign-in", rateLimit("ip"), h.SignIn)
 		authGroup.POST("/refresh-token", h.RefreshToken)
+		authGroup.POST("/2fa/enroll", h.EnrollTwoFactor)
+		authGroup.POST("/2fa/confirm", rateLimit("ip"), h.ConfirmTwoFactor)
+		authGroup.POST("/2fa/verify", rateLimit("ip"), h.VerifyTwoFactor)
+		authGroup.POST("/2fa/disable", rateLimit("ip"), h.DisableTwoFactor)
+		authGroup.GET("/verify-email", rateLimit("ip"), h.VerifyEmail)
+		authGroup.POST("/resend-verification", rateLimit("ip"), h.ResendVerification)
+		authGroup.POST("/forgot-password", rateLimit("ip"), h.ForgotPassword)
+		authGroup.POST("/reset-password", rateLimit("ip"), h.ResetPassword)
+		authGroup.GET("/confirm-email-change", rateLimit("ip"), h.ConfirmEmailChange)
+		authGroup.GET("/oidc/login", rateLimit("ip"), h.OidcLogin)
+		authGroup.GET("/oidc/callback", rateLimit("ip"), h.OidcCallback)
 	}
+	router.GET("/.well-known/jwks.json", h.Jwks)
 }
 
 type SignUp struct {
@@ -61,6 +75,11 @@ func (h *authHandler) SignUp(c *gin.Context) {
 	err := h.auth.SignUp(newUser)
 	if err != nil {
 		h.loggers.Err.Printf("%s", err.Error())
+		var violations passwordpolicy.ViolationsError
+		if errors.As(err, &violations) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrWeakPassword, "violations": violations.Violations})
+			return
+		}
 		var respErr utils.ResponseError
 		if errors.As(err, &respErr) {
 			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
@@ -98,6 +117,14 @@ func (h *authHandler) SignIn(c *gin.Context) {
 		return
 	}
 
+	if tokens.Challenge != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"challenge_token": tokens.Challenge,
+			"two_factor":      tokens.ChallengeType,
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"access_token":  tokens.Access,
 		"refresh_token": tokens.Refresh,
@@ -132,3 +159,341 @@ func (h *authHandler) RefreshToken(c *gin.Context) {
 		"access_token": accessToken,
 	})
 }
+
+func (h *authHandler) Jwks(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.auth.Jwks())
+}
+
+// twoFactorClient returns the session user id, api keys cannot manage 2fa
+func (h *authHandler) twoFactorClient(c *gin.Context) (uint, bool) {
+	if _, isApiKey := c.Get(consts.KeyScopes); isApiKey {
+		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
+		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
+		return 0, false
+	}
+	return c.Value(consts.KeyId).(uint), true
+}
+
+type EnrollTwoFactor struct {
+	ChallengeToken string `json:"challenge_token"`
+}
+
+func (h *authHandler) EnrollTwoFactor(c *gin.Context) {
+	var input EnrollTwoFactor
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId, ok := h.twoFactorClient(c)
+	if !ok {
+		return
+	}
+
+	secret, uri, err := h.auth.EnrollTwoFactor(userId, input.ChallengeToken)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": uri,
+	})
+}
+
+type ConfirmTwoFactor struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+func (h *authHandler) ConfirmTwoFactor(c *gin.Context) {
+	var input ConfirmTwoFactor
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId, ok := h.twoFactorClient(c)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, tokens, err := h.auth.ConfirmTwoFactor(userId, input.ChallengeToken, input.Code)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	response := gin.H{"recovery_codes": recoveryCodes}
+	if tokens.Access != "" {
+		response["access_token"] = tokens.Access
+		response["refresh_token"] = tokens.Refresh
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+type VerifyTwoFactor struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+func (h *authHandler) VerifyTwoFactor(c *gin.Context) {
+	var input VerifyTwoFactor
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := h.auth.VerifyTwoFactor(input.ChallengeToken, input.Code, input.RecoveryCode)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  tokens.Access,
+		"refresh_token": tokens.Refresh,
+	})
+}
+
+type DisableTwoFactor struct {
+	Code string `json:"code"`
+}
+
+func (h *authHandler) DisableTwoFactor(c *gin.Context) {
+	var input DisableTwoFactor
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId, ok := h.twoFactorClient(c)
+	if !ok {
+		return
+	}
+	if userId == 0 {
+		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
+		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
+		return
+	}
+
+	err := h.auth.DisableTwoFactor(userId, input.Code)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *authHandler) VerifyEmail(c *gin.Context) {
+	err := h.auth.VerifyEmail(c.Query("token"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *authHandler) ConfirmEmailChange(c *gin.Context) {
+	err := h.auth.ConfirmEmailChange(c.Query("token"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+type ResendVerification struct {
+	Email string `json:"email"`
+}
+
+func (h *authHandler) ResendVerification(c *gin.Context) {
+	var input ResendVerification
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.auth.ResendVerification(input.Email)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+type ForgotPassword struct {
+	Email string `json:"email"`
+}
+
+func (h *authHandler) ForgotPassword(c *gin.Context) {
+	var input ForgotPassword
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.auth.ForgotPassword(input.Email)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+type ResetPassword struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (h *authHandler) ResetPassword(c *gin.Context) {
+	var input ResetPassword
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.auth.ResetPassword(input.Token, input.Password)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var violations passwordpolicy.ViolationsError
+		if errors.As(err, &violations) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrWeakPassword, "violations": violations.Violations})
+			return
+		}
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// the flow cookie binds the callback to the browser that started the login
+const oidcFlowCookie = "oidc_flow"
+
+func (h *authHandler) OidcLogin(c *gin.Context) {
+	authURL, flowToken, err := h.auth.OidcLogin()
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcFlowCookie, flowToken, int(services.OidcFlowTTL.Seconds()), "/auth/oidc", "", isSecure(c), true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+func (h *authHandler) OidcCallback(c *gin.Context) {
+	if providerErr := c.Query("error"); providerErr != "" {
+		h.loggers.Err.Printf("%s: %s %s", consts.ErrOidcFailed, providerErr, c.Query("error_description"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": consts.ErrOidcFailed + ": " + providerErr})
+		return
+	}
+
+	flowToken, _ := c.Cookie(oidcFlowCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcFlowCookie, "", -1, "/auth/oidc", "", isSecure(c), true)
+
+	tokens, err := h.auth.OidcCallback(c.Query("code"), c.Query("state"), flowToken)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if tokens.Challenge != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"challenge_token": tokens.Challenge,
+			"two_factor":      tokens.ChallengeType,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  tokens.Access,
+		"refresh_token": tokens.Refresh,
+	})
+}
+
+func isSecure(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
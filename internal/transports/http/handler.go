@@ -1,15 +1,22 @@
 package http
 
 import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
 	"github.com/robboworld/mosquitto-broker/internal/services"
 	"github.com/robboworld/mosquitto-broker/pkg/logger"
 )
 
 type Handlers struct {
-	AuthHandler      *authHandler
-	UserHandler      *userHandler
-	MosquittoHandler *mosquittoHandler
-	TopicHandler     *topicHandler
+	AuthHandler           *authHandler
+	UserHandler           *userHandler
+	MosquittoHandler      *mosquittoHandler
+	TopicHandler          *topicHandler
+	ServiceAccountHandler *serviceAccountHandler
+	RoleHandler           *roleHandler
+	OrganizationHandler   *organizationHandler
+	AdminHandler          *adminHandler
 }
 
 func NewHandlers(
@@ -18,11 +25,30 @@ func NewHandlers(
 	userService services.UserService,
 	mosquittoService services.MosquittoService,
 	topicService services.TopicService,
+	serviceAccountService services.ServiceAccountService,
+	roleService services.RoleService,
+	quotaService services.QuotaService,
+	organizationService services.OrganizationService,
+	bundleService services.BundleService,
+	contractService services.ContractService,
+	messageService services.MessageService,
 ) Handlers {
 	return Handlers{
-		AuthHandler:      NewAuthHandler(loggers, authService),
-		UserHandler:      NewUserHandler(loggers, userService),
-		MosquittoHandler: NewMosquittoHandler(loggers, mosquittoService),
-		TopicHandler:     NewTopicHandler(loggers, topicService),
+		AuthHandler:           NewAuthHandler(loggers, authService),
+		UserHandler:           NewUserHandler(loggers, userService, authService, quotaService),
+		MosquittoHandler:      NewMosquittoHandler(loggers, mosquittoService),
+		TopicHandler:          NewTopicHandler(loggers, topicService, contractService, messageService),
+		ServiceAccountHandler: NewServiceAccountHandler(loggers, serviceAccountService),
+		RoleHandler:           NewRoleHandler(loggers, roleService),
+		OrganizationHandler:   NewOrganizationHandler(loggers, organizationService),
+		AdminHandler:          NewAdminHandler(loggers, bundleService, messageService),
 	}
 }
+
+// RequirePermission builds a middleware that aborts with 403 unless the caller
+// has every permission, for api keys the scopes must cover them as well
+type RequirePermission func(permissions ...models.Permission) gin.HandlerFunc
+
+// RateLimit builds a per client ip middleware with the rate_limit.<name> limits,
+// it aborts with 429 and a Retry-After header when the bucket is empty
+type RateLimit func(name string) gin.HandlerFunc
@@ -28,10 +28,10 @@ func NewMosquittoHandler(
 	}
 }
 
-func (h *mosquittoHandler) SetupMosquittoRoutes(router *gin.Engine) {
+func (h *mosquittoHandler) SetupMosquittoRoutes(router *gin.Engine, requirePermission RequirePermission) {
 	mosquittoGroup := router.Group("/mosquitto")
 	{
-		mosquittoGroup.POST("/launch", h.Launch)
+		mosquittoGroup.POST("/launch", requirePermission(models.PermissionBrokerControl), h.Launch)
 	}
 }
 
@@ -41,13 +41,6 @@ type MosquittoConfig struct {
 
 func (h *mosquittoHandler) Launch(c *gin.Context) {
 	userId := c.Value(consts.KeyId).(uint)
-	role := c.Value(consts.KeyRole).(models.Role)
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
-		return
-	}
 
 	var input MosquittoConfig
 	if err := c.ShouldBind(&input); err != nil {
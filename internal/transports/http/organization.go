@@ -0,0 +1,131 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/services"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type organizationHandler struct {
+	loggers      logger.Loggers
+	organization services.OrganizationService
+}
+
+func NewOrganizationHandler(
+	loggers logger.Loggers,
+	organization services.OrganizationService,
+) *organizationHandler {
+	return &organizationHandler{
+		loggers:      loggers,
+		organization: organization,
+	}
+}
+
+func (h *organizationHandler) SetupOrganizationRoutes(router *gin.Engine, requirePermission RequirePermission) {
+	organizationGroup := router.Group("/organization", requirePermission(models.PermissionOrganizationsManage))
+	{
+		organizationGroup.POST("/", h.Create)
+		organizationGroup.GET("/", h.GetAll)
+		organizationGroup.PUT("/user/:id", h.SetUserOrganization)
+	}
+}
+
+type NewOrganization struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+func (h *organizationHandler) Create(c *gin.Context) {
+	var input NewOrganization
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	organization := models.OrganizationCore{
+		Name: input.Name,
+		Slug: input.Slug,
+	}
+
+	newOrganization, err := h.organization.Create(organization, userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	organizationHttp := models.OrganizationHTTP{}
+	organizationHttp.FromCore(newOrganization)
+	c.JSON(http.StatusOK, gin.H{"organization": organizationHttp})
+}
+
+func (h *organizationHandler) GetAll(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+
+	organizations, err := h.organization.GetAll(userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organizations": models.FromOrganizationsCore(organizations)})
+}
+
+type SetUserOrganization struct {
+	// OrganizationId null takes the user out of organizations
+	OrganizationId *uint `json:"organization_id"`
+}
+
+func (h *organizationHandler) SetUserOrganization(c *gin.Context) {
+	var input SetUserOrganization
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.organization.SetUserOrganization(uint(atoi), input.OrganizationId, userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/services"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type roleHandler struct {
+	loggers logger.Loggers
+	role    services.RoleService
+}
+
+func NewRoleHandler(
+	loggers logger.Loggers,
+	role services.RoleService,
+) *roleHandler {
+	return &roleHandler{
+		loggers: loggers,
+		role:    role,
+	}
+}
+
+func (h *roleHandler) SetupRoleRoutes(router *gin.Engine, requirePermission RequirePermission) {
+	roleGroup := router.Group("/role", requirePermission(models.PermissionRolesManage))
+	{
+		roleGroup.GET("/", h.GetAll)
+		roleGroup.PUT("/:role", h.SetPermissions)
+	}
+}
+
+func (h *roleHandler) GetAll(c *gin.Context) {
+	rolePermissions, err := h.role.GetAll()
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	permissions := []string{}
+	for _, permission := range models.Permissions {
+		permissions = append(permissions, permission.String())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"roles":       models.FromRolePermissionsCore(rolePermissions),
+		"permissions": permissions,
+	})
+}
+
+type RolePermissions struct {
+	Permissions []string `json:"permissions"`
+}
+
+func (h *roleHandler) SetPermissions(c *gin.Context) {
+	var input RolePermissions
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var permissions []models.Permission
+	for _, permission := range input.Permissions {
+		permissions = append(permissions, models.Permission(permission))
+	}
+
+	err := h.role.SetPermissions(models.Role(c.Param("role")), permissions)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,236 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/robboworld/mosquitto-broker/internal/consts"
+	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/services"
+	"github.com/robboworld/mosquitto-broker/pkg/logger"
+	"github.com/robboworld/mosquitto-broker/pkg/utils"
+)
+
+type serviceAccountHandler struct {
+	loggers        logger.Loggers
+	serviceAccount services.ServiceAccountService
+}
+
+func NewServiceAccountHandler(
+	loggers logger.Loggers,
+	serviceAccount services.ServiceAccountService,
+) *serviceAccountHandler {
+	return &serviceAccountHandler{
+		loggers:        loggers,
+		serviceAccount: serviceAccount,
+	}
+}
+
+func (h *serviceAccountHandler) SetupServiceAccountRoutes(router *gin.Engine, requirePermission RequirePermission) {
+	serviceAccountGroup := router.Group("/service-account", requirePermission(models.PermissionServiceAccountsManage))
+	{
+		serviceAccountGroup.POST("/", h.Create)
+		serviceAccountGroup.GET("/", h.GetAll)
+		serviceAccountGroup.DELETE("/:id", h.Delete)
+		serviceAccountGroup.POST("/:id/key", h.CreateKey)
+		serviceAccountGroup.GET("/:id/key", h.GetKeys)
+		serviceAccountGroup.DELETE("/:id/key/:keyId", h.DeleteKey)
+	}
+}
+
+type NewServiceAccount struct {
+	Name string `json:"name"`
+}
+
+func (h *serviceAccountHandler) Create(c *gin.Context) {
+	var input NewServiceAccount
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	serviceAccount := models.ServiceAccountCore{
+		Name: input.Name,
+	}
+
+	newServiceAccount, err := h.serviceAccount.Create(serviceAccount, userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	serviceAccountHttp := models.ServiceAccountHTTP{}
+	serviceAccountHttp.FromCore(newServiceAccount)
+	c.JSON(http.StatusOK, gin.H{"service_account": serviceAccountHttp})
+}
+
+func (h *serviceAccountHandler) GetAll(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	serviceAccounts, err := h.serviceAccount.GetAll(userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"service_accounts": models.FromServiceAccountsCore(serviceAccounts)})
+}
+
+func (h *serviceAccountHandler) Delete(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.serviceAccount.Delete(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+type NewApiKey struct {
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is the key lifetime in seconds, 0 means the key never expires
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func (h *serviceAccountHandler) CreateKey(c *gin.Context) {
+	var input NewApiKey
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	apiKey := models.ApiKeyCore{
+		ServiceAccountId: uint(atoi),
+	}
+	for _, scope := range input.Scopes {
+		apiKey.Scopes = append(apiKey.Scopes, models.Scope(scope))
+	}
+	if input.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(input.ExpiresIn) * time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	key, newApiKey, err := h.serviceAccount.CreateKey(apiKey, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	apiKeyHttp := models.ApiKeyHTTP{}
+	apiKeyHttp.FromCore(newApiKey)
+	c.JSON(http.StatusOK, gin.H{
+		"api_key": apiKeyHttp,
+		"key":     key,
+	})
+}
+
+func (h *serviceAccountHandler) GetKeys(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	apiKeys, err := h.serviceAccount.GetKeys(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": models.FromApiKeysCore(apiKeys)})
+}
+
+func (h *serviceAccountHandler) DeleteKey(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+	keyId, err := strconv.Atoi(c.Param("keyId"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.serviceAccount.DeleteKey(uint(atoi), uint(keyId), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
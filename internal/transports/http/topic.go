@@ -1,9 +1,11 @@
 package http
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -14,29 +16,50 @@ import (
 	"github.com/robboworld/mosquitto-broker/pkg/utils"
 )
 
+// streamKeepAlive is the interval of ping events, proxies close idle connections
+const streamKeepAlive = 15 * time.Second
+
 type topicHandler struct {
-	loggers logger.Loggers
-	topic   services.TopicService
+	loggers  logger.Loggers
+	topic    services.TopicService
+	contract services.ContractService
+	message  services.MessageService
 }
 
 func NewTopicHandler(
 	loggers logger.Loggers,
 	topic services.TopicService,
+	contract services.ContractService,
+	message services.MessageService,
 ) *topicHandler {
 	return &topicHandler{
-		loggers: loggers,
-		topic:   topic,
+		loggers:  loggers,
+		topic:    topic,
+		contract: contract,
+		message:  message,
 	}
 }
 
-func (h *topicHandler) SetupTopicRoutes(router *gin.Engine) {
+func (h *topicHandler) SetupTopicRoutes(router *gin.Engine, requirePermission RequirePermission) {
 	topicGroup := router.Group("/topic")
 	{
-		topicGroup.POST("/", h.Create)
-		topicGroup.GET("/:id", h.GetById)
-		topicGroup.GET("/", h.GetAll)
-		topicGroup.PUT("/", h.UpdatePermissions)
-		topicGroup.DELETE("/:id", h.Delete)
+		topicGroup.POST("/", requirePermission(models.PermissionTopicsWrite), h.Create)
+		topicGroup.GET("/tags", requirePermission(models.PermissionTopicsRead), h.GetTags)
+		topicGroup.GET("/:id", requirePermission(models.PermissionTopicsRead), h.GetById)
+		topicGroup.GET("/", requirePermission(models.PermissionTopicsRead), h.GetAll)
+		topicGroup.PUT("/", requirePermission(models.PermissionTopicsWrite), h.UpdatePermissions)
+		topicGroup.PATCH("/:id", requirePermission(models.PermissionTopicsWrite), h.Rename)
+		topicGroup.PUT("/:id/metadata", requirePermission(models.PermissionTopicsWrite), h.UpdateMetadata)
+		topicGroup.DELETE("/:id", requirePermission(models.PermissionTopicsWrite), h.Delete)
+		topicGroup.PUT("/:id/schema", requirePermission(models.PermissionTopicsWrite), h.SetSchema)
+		topicGroup.GET("/:id/schema", requirePermission(models.PermissionTopicsRead), h.GetSchema)
+		topicGroup.DELETE("/:id/schema", requirePermission(models.PermissionTopicsWrite), h.DeleteSchema)
+		topicGroup.GET("/:id/violations", requirePermission(models.PermissionTopicsRead), h.GetViolations)
+		topicGroup.POST("/:id/publish", requirePermission(models.PermissionTopicsWrite), h.Publish)
+		topicGroup.GET("/:id/stream", requirePermission(models.PermissionTopicsRead), h.Stream)
+		topicGroup.GET("/:id/retained", requirePermission(models.PermissionTopicsRead), h.GetRetained)
+		topicGroup.GET("/:id/retained/message", requirePermission(models.PermissionTopicsRead), h.GetRetainedMessage)
+		topicGroup.DELETE("/:id/retained", requirePermission(models.PermissionTopicsWrite), h.ClearRetained)
 	}
 }
 
@@ -44,6 +67,41 @@ type NewTopic struct {
 	Name     string `json:"name"`
 	CanRead  bool   `json:"can_read"`
 	CanWrite bool   `json:"can_write"`
+	// UserId is the owner, the caller when omitted
+	UserId *uint `json:"user_id"`
+	TopicMetadata
+}
+
+type TopicMetadata struct {
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	ContentType string   `json:"content_type"`
+	Qos         *int     `json:"qos"`
+	Retained    *bool    `json:"retained"`
+	Contact     string   `json:"contact"`
+}
+
+func (t *TopicMetadata) apply(topic *models.TopicCore) {
+	topic.Description = t.Description
+	topic.SetTags(t.Tags)
+	topic.ContentType = t.ContentType
+	topic.Qos = t.Qos
+	topic.Retained = t.Retained
+	topic.Contact = t.Contact
+}
+
+type TopicSchema struct {
+	Schema json.RawMessage `json:"schema" binding:"required"`
+}
+
+type TopicPublish struct {
+	// Topic is required when the topic name has wildcards
+	Topic           string                    `json:"topic"`
+	Payload         string                    `json:"payload"`
+	PayloadEncoding string                    `json:"payload_encoding"`
+	Qos             int                       `json:"qos"`
+	Retain          bool                      `json:"retain"`
+	UserProperties  []models.UserPropertyHTTP `json:"user_properties"`
 }
 
 func (h *topicHandler) Create(c *gin.Context) {
@@ -57,21 +115,18 @@ func (h *topicHandler) Create(c *gin.Context) {
 	userId := c.Value(consts.KeyId).(uint)
 	role := c.Value(consts.KeyRole).(models.Role)
 
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
-		return
-	}
-
 	topic := models.TopicCore{
 		Name:     input.Name,
 		CanRead:  input.CanRead,
 		CanWrite: input.CanWrite,
 		UserId:   userId,
 	}
+	if input.UserId != nil {
+		topic.UserId = *input.UserId
+	}
+	input.TopicMetadata.apply(&topic)
 
-	newTopic, err := h.topic.Create(topic, userId)
+	newTopic, err := h.topic.Create(topic, userId, role)
 	if err != nil {
 		h.loggers.Err.Printf("%s", err.Error())
 		var respErr utils.ResponseError
@@ -92,13 +147,6 @@ func (h *topicHandler) GetById(c *gin.Context) {
 	userId := c.Value(consts.KeyId).(uint)
 	role := c.Value(consts.KeyRole).(models.Role)
 
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
-		return
-	}
-
 	id := c.Param("id")
 	atoi, err := strconv.Atoi(id)
 	if err != nil {
@@ -128,13 +176,6 @@ func (h *topicHandler) GetAll(c *gin.Context) {
 	userId := c.Value(consts.KeyId).(uint)
 	role := c.Value(consts.KeyRole).(models.Role)
 
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
-		return
-	}
-
 	var page, pageSize *int
 	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
 		if pageSizeValue, err := strconv.Atoi(pageSizeStr); err == nil {
@@ -156,7 +197,40 @@ func (h *topicHandler) GetAll(c *gin.Context) {
 		}
 	}
 
-	topics, countRows, err := h.topic.GetAll(page, pageSize, userId, role)
+	filter := models.TopicFilter{
+		NamePrefix:   c.Query("name_prefix"),
+		NameContains: c.Query("search"),
+		Tags:         c.QueryArray("tag"),
+		ContentType:  c.Query("content_type"),
+		Permission:   c.Query("permission"),
+	}
+	if ownerStr := c.Query("owner_id"); ownerStr != "" {
+		ownerId, err := strconv.Atoi(ownerStr)
+		if err != nil {
+			h.loggers.Err.Printf("%s", ownerStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+		owner := uint(ownerId)
+		filter.UserId = &owner
+	}
+	for param, value := range map[string]**time.Time{
+		"created_from": &filter.CreatedFrom,
+		"created_to":   &filter.CreatedTo,
+	} {
+		if timeStr := c.Query(param); timeStr != "" {
+			parsed, err := time.Parse(time.RFC3339, timeStr)
+			if err != nil {
+				h.loggers.Err.Printf("%s", timeStr)
+				c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrInvalidTime})
+				return
+			}
+			*value = &parsed
+		}
+	}
+
+	topics, pagination, err := h.topic.GetAll(filter, c.Query("sort"), c.Query("order"),
+		page, pageSize, c.Query("cursor"), userId, role)
 	if err != nil {
 		h.loggers.Err.Printf("%s", err.Error())
 		var respErr utils.ResponseError
@@ -169,9 +243,12 @@ func (h *topicHandler) GetAll(c *gin.Context) {
 	}
 
 	topicsHttp := models.FromTopicsCore(topics)
+	paginationHttp := models.PaginationHTTP{}
+	paginationHttp.FromCore(pagination)
 	c.JSON(http.StatusOK, gin.H{
 		"topics":     topicsHttp,
-		"count_rows": countRows,
+		"count_rows": pagination.Total,
+		"pagination": paginationHttp,
 	})
 }
 
@@ -192,13 +269,6 @@ func (h *topicHandler) UpdatePermissions(c *gin.Context) {
 	userId := c.Value(consts.KeyId).(uint)
 	role := c.Value(consts.KeyRole).(models.Role)
 
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
-		return
-	}
-
 	atoi, err := strconv.Atoi(input.ID)
 	if err != nil {
 		h.loggers.Err.Printf("%s", err.Error())
@@ -229,17 +299,108 @@ func (h *topicHandler) UpdatePermissions(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"topic": topicHttp})
 }
 
-func (h *topicHandler) Delete(c *gin.Context) {
+type RenameTopic struct {
+	Name string `json:"name" binding:"required"`
+}
+
+func (h *topicHandler) Rename(c *gin.Context) {
+	var input RenameTopic
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	renamedTopic, err := h.topic.Rename(uint(atoi), input.Name, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	topicHttp := models.TopicHTTP{}
+	topicHttp.FromCore(renamedTopic)
+	c.JSON(http.StatusOK, gin.H{"topic": topicHttp})
+}
+
+func (h *topicHandler) UpdateMetadata(c *gin.Context) {
+	var input TopicMetadata
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	userId := c.Value(consts.KeyId).(uint)
 	role := c.Value(consts.KeyRole).(models.Role)
 
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	topic := models.TopicCore{ID: uint(atoi)}
+	input.apply(&topic)
+
+	updatedTopic, err := h.topic.UpdateMetadata(topic, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	topicHttp := models.TopicHTTP{}
+	topicHttp.FromCore(updatedTopic)
+	c.JSON(http.StatusOK, gin.H{"topic": topicHttp})
+}
+
+func (h *topicHandler) GetTags(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	tags, err := h.topic.GetTags(userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"tags": models.FromTopicTagsCore(tags)})
+}
+
+func (h *topicHandler) Delete(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
 	id := c.Param("id")
 	atoi, err := strconv.Atoi(id)
 	if err != nil {
@@ -262,3 +423,395 @@ func (h *topicHandler) Delete(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
+
+func (h *topicHandler) SetSchema(c *gin.Context) {
+	var input TopicSchema
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	contract, err := h.contract.SetSchema(uint(atoi), string(input.Schema), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	contractHttp := models.TopicContractHTTP{}
+	contractHttp.FromCore(contract)
+	c.JSON(http.StatusOK, gin.H{"contract": contractHttp})
+}
+
+func (h *topicHandler) GetSchema(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	contract, err := h.contract.GetSchema(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	contractHttp := models.TopicContractHTTP{}
+	contractHttp.FromCore(contract)
+	c.JSON(http.StatusOK, gin.H{"contract": contractHttp})
+}
+
+func (h *topicHandler) DeleteSchema(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.contract.DeleteSchema(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *topicHandler) GetViolations(c *gin.Context) {
+	var page, pageSize *int
+	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
+		if pageSizeValue, err := strconv.Atoi(pageSizeStr); err == nil {
+			pageSize = &pageSizeValue
+		} else {
+			h.loggers.Err.Printf("%s", pageSizeStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+	}
+
+	if pageStr := c.Query("page"); pageStr != "" {
+		if pageValue, err := strconv.Atoi(pageStr); err == nil {
+			page = &pageValue
+		} else {
+			h.loggers.Err.Printf("%s", pageStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	contract, violations, countRows, err := h.contract.GetViolations(uint(atoi), page, pageSize, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	contractHttp := models.TopicContractHTTP{}
+	contractHttp.FromCore(contract)
+	c.JSON(http.StatusOK, gin.H{
+		"contract":   contractHttp,
+		"violations": models.FromTopicViolationsCore(violations),
+		"count_rows": countRows,
+	})
+}
+
+func (h *topicHandler) Publish(c *gin.Context) {
+	var input TopicPublish
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	payload, err := models.DecodePayload(input.Payload, input.PayloadEncoding)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	message := models.PublishCore{
+		Topic:   input.Topic,
+		Payload: payload,
+		Qos:     input.Qos,
+		Retain:  input.Retain,
+	}
+	for _, property := range input.UserProperties {
+		message.UserProperties = append(message.UserProperties, models.UserPropertyCore{
+			Key:   property.Key,
+			Value: property.Value,
+		})
+	}
+
+	result, err := h.message.Publish(uint(atoi), message, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	resultHttp := models.PublishResultHTTP{}
+	resultHttp.FromCore(result)
+	c.JSON(http.StatusOK, gin.H{"result": resultHttp})
+}
+
+// Stream sends the messages of the topic as server-sent events: subscribed once,
+// then message for every message, dropped with the count of messages the
+// client was too slow for, and ping while nothing happens. The access is checked
+// again on every ping and the stream ends with closed once it is lost or the
+// token expires
+func (h *topicHandler) Stream(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	stream, err := h.message.Stream(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	defer stream.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("subscribed", gin.H{"filter": stream.Filter})
+	c.Writer.Flush()
+
+	// a nil channel never fires for credentials that do not expire
+	var expired <-chan time.Time
+	if expiresAt, ok := c.Get(consts.KeyExpiresAt); ok {
+		expired = time.After(time.Until(expiresAt.(time.Time)))
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-expired:
+			message := consts.ErrTokenExpired
+			if _, isApiKey := c.Get(consts.KeyScopes); isApiKey {
+				message = consts.ErrApiKeyExpired
+			}
+			c.SSEvent("closed", gin.H{"error": message})
+			c.Writer.Flush()
+			return
+		case message := <-stream.Messages:
+			if dropped := stream.Dropped(); dropped > 0 {
+				c.SSEvent("dropped", gin.H{"count": dropped})
+			}
+			messageHttp := models.MessageHTTP{}
+			messageHttp.FromCore(message)
+			c.SSEvent("message", messageHttp)
+		case <-keepAlive.C:
+			if err = stream.Check(); err != nil {
+				h.loggers.Err.Printf("%s", err.Error())
+				message := err.Error()
+				var respErr utils.ResponseError
+				if errors.As(err, &respErr) {
+					message = respErr.Message
+				}
+				c.SSEvent("closed", gin.H{"error": message})
+				c.Writer.Flush()
+				return
+			}
+			if dropped := stream.Dropped(); dropped > 0 {
+				c.SSEvent("dropped", gin.H{"count": dropped})
+			}
+			c.SSEvent("ping", gin.H{"time": time.Now().Format(time.RFC3339)})
+		}
+		c.Writer.Flush()
+	}
+}
+
+func (h *topicHandler) GetRetained(c *gin.Context) {
+	var page, pageSize *int
+	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
+		if pageSizeValue, err := strconv.Atoi(pageSizeStr); err == nil {
+			pageSize = &pageSizeValue
+		} else {
+			h.loggers.Err.Printf("%s", pageSizeStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+	}
+
+	if pageStr := c.Query("page"); pageStr != "" {
+		if pageValue, err := strconv.Atoi(pageStr); err == nil {
+			page = &pageValue
+		} else {
+			h.loggers.Err.Printf("%s", pageStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	messages, countRows, truncated, err := h.message.GetRetained(uint(atoi), page, pageSize, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages":   models.FromRetainedMessagesCore(messages),
+		"count_rows": countRows,
+		"truncated":  truncated,
+	})
+}
+
+func (h *topicHandler) GetRetainedMessage(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	message, err := h.message.GetRetainedMessage(uint(atoi), c.Query("topic"), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	messageHttp := models.RetainedMessageHTTP{}
+	messageHttp.FromCore(message)
+	c.JSON(http.StatusOK, gin.H{"message": messageHttp})
+}
+
+func (h *topicHandler) ClearRetained(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	id := c.Param("id")
+	atoi, err := strconv.Atoi(id)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.message.ClearRetained(uint(atoi), c.Query("topic"), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -3,11 +3,13 @@ package http
 import (
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/robboworld/mosquitto-broker/internal/consts"
 	"github.com/robboworld/mosquitto-broker/internal/models"
+	"github.com/robboworld/mosquitto-broker/internal/passwordpolicy"
 	"github.com/robboworld/mosquitto-broker/internal/services"
 	"github.com/robboworld/mosquitto-broker/pkg/logger"
 	"github.com/robboworld/mosquitto-broker/pkg/utils"
@@ -16,22 +18,40 @@ import (
 type userHandler struct {
 	loggers logger.Loggers
 	user    services.UserService
+	auth    services.AuthService
+	quota   services.QuotaService
 }
 
 func NewUserHandler(
 	loggers logger.Loggers,
 	user services.UserService,
+	auth services.AuthService,
+	quota services.QuotaService,
 ) *userHandler {
 	return &userHandler{
 		loggers: loggers,
 		user:    user,
+		auth:    auth,
+		quota:   quota,
 	}
 }
 
-func (h *userHandler) SetupUserRoutes(router *gin.Engine) {
+func (h *userHandler) SetupUserRoutes(router *gin.Engine, requirePermission RequirePermission) {
 	userGroup := router.Group("/user")
 	{
-		userGroup.GET("/me", h.Me)
+		userGroup.GET("/me", requirePermission(models.PermissionProfileRead), h.Me)
+		userGroup.PATCH("/me", requirePermission(models.PermissionProfileWrite), h.UpdateMe)
+		userGroup.POST("/me/email", requirePermission(models.PermissionProfileWrite), h.ChangeEmail)
+		userGroup.PUT("/password", requirePermission(models.PermissionProfileWrite), h.ChangePassword)
+		userGroup.DELETE("/me", requirePermission(models.PermissionProfileWrite), h.DeleteMe)
+		userGroup.POST("/me/delete-request", requirePermission(models.PermissionProfileWrite), h.RequestDeletion)
+		userGroup.GET("/", requirePermission(models.PermissionUsersReadAny), h.GetAll)
+		userGroup.GET("/:id", requirePermission(models.PermissionUsersReadAny), h.GetById)
+		userGroup.PUT("/:id/role", requirePermission(models.PermissionUsersWriteAny), h.SetRole)
+		userGroup.PUT("/:id/quota", requirePermission(models.PermissionUsersWriteAny), h.SetQuota)
+		userGroup.POST("/:id/disable", requirePermission(models.PermissionUsersWriteAny), h.Disable)
+		userGroup.POST("/:id/enable", requirePermission(models.PermissionUsersWriteAny), h.Enable)
+		userGroup.DELETE("/:id", requirePermission(models.PermissionUsersWriteAny), h.Delete)
 	}
 }
 
@@ -39,14 +59,59 @@ func (h *userHandler) Me(c *gin.Context) {
 	userId := c.Value(consts.KeyId).(uint)
 	role := c.Value(consts.KeyRole).(models.Role)
 
-	accessRoles := []models.Role{models.RoleUser, models.RoleSuperAdmin}
-	if !utils.DoesHaveRole(role, accessRoles) {
-		h.loggers.Err.Printf("%s", consts.ErrAccessDenied)
-		c.JSON(http.StatusForbidden, gin.H{"error": consts.ErrAccessDenied})
+	user, err := h.user.GetById(userId, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	user, err := h.user.GetById(userId, userId, role)
+	quota, usage, err := h.quota.Get(userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	userHttp := models.UserHTTP{}
+	userHttp.FromCore(user)
+	quotaHttp := models.QuotaHTTP{}
+	quotaHttp.FromCore(quota, usage)
+	c.JSON(http.StatusOK, gin.H{"user": userHttp, "quota": quotaHttp})
+}
+
+type UpdateMe struct {
+	FullName *string `json:"full_name"`
+}
+
+func (h *userHandler) UpdateMe(c *gin.Context) {
+	var input UpdateMe
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	var user models.UserCore
+	var err error
+	if input.FullName != nil {
+		user, err = h.user.UpdateProfile(userId, *input.FullName)
+	} else {
+		user, err = h.user.GetById(userId, userId, role)
+	}
 	if err != nil {
 		h.loggers.Err.Printf("%s", err.Error())
 		var respErr utils.ResponseError
@@ -62,3 +127,355 @@ func (h *userHandler) Me(c *gin.Context) {
 	userHttp.FromCore(user)
 	c.JSON(http.StatusOK, gin.H{"user": userHttp})
 }
+
+type ChangeEmail struct {
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+func (h *userHandler) ChangeEmail(c *gin.Context) {
+	var input ChangeEmail
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	err := h.auth.RequestEmailChange(userId, input.Password, input.Email)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "confirmation sent"})
+}
+
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+	RevokeSessions  bool   `json:"revoke_sessions"`
+}
+
+func (h *userHandler) ChangePassword(c *gin.Context) {
+	var input ChangePassword
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	tokens, err := h.auth.ChangePassword(userId, input.CurrentPassword, input.NewPassword, input.RevokeSessions)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var violations passwordpolicy.ViolationsError
+		if errors.As(err, &violations) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrWeakPassword, "violations": violations.Violations})
+			return
+		}
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if tokens.Access != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"access_token":  tokens.Access,
+			"refresh_token": tokens.Refresh,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *userHandler) GetAll(c *gin.Context) {
+	var page, pageSize *int
+	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
+		if pageSizeValue, err := strconv.Atoi(pageSizeStr); err == nil {
+			pageSize = &pageSizeValue
+		} else {
+			h.loggers.Err.Printf("%s", pageSizeStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+	}
+
+	if pageStr := c.Query("page"); pageStr != "" {
+		if pageValue, err := strconv.Atoi(pageStr); err == nil {
+			page = &pageValue
+		} else {
+			h.loggers.Err.Printf("%s", pageStr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+			return
+		}
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	users, countRows, err := h.user.GetAll(page, pageSize, c.Query("search"), userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	usersHttp := models.FromUsersCore(users)
+	c.JSON(http.StatusOK, gin.H{
+		"users":      usersHttp,
+		"count_rows": countRows,
+	})
+}
+
+func (h *userHandler) GetById(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	user, err := h.user.GetById(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	topics, err := h.user.GetTopics(user.ID)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	userHttp := models.UserHTTP{}
+	userHttp.FromCore(user)
+	c.JSON(http.StatusOK, gin.H{
+		"user":   userHttp,
+		"topics": models.FromTopicsCore(topics),
+	})
+}
+
+type SetUserRole struct {
+	Role string `json:"role"`
+}
+
+func (h *userHandler) SetRole(c *gin.Context) {
+	var input SetUserRole
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.user.SetRole(uint(atoi), models.Role(input.Role), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// SetQuota replaces the override of the user, null fields fall back to the role quota
+func (h *userHandler) SetQuota(c *gin.Context) {
+	var input models.QuotaOverrideHTTP
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.quota.SetOverride(input.ToCore(uint(atoi)), userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	quota, usage, err := h.quota.Get(uint(atoi))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	quotaHttp := models.QuotaHTTP{}
+	quotaHttp.FromCore(quota, usage)
+	c.JSON(http.StatusOK, gin.H{"quota": quotaHttp})
+}
+
+func (h *userHandler) Disable(c *gin.Context) {
+	h.setDisabled(c, true)
+}
+
+func (h *userHandler) Enable(c *gin.Context) {
+	h.setDisabled(c, false)
+}
+
+func (h *userHandler) setDisabled(c *gin.Context, disabled bool) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.user.SetDisabled(uint(atoi), disabled, userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *userHandler) Delete(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+	role := c.Value(consts.KeyRole).(models.Role)
+
+	atoi, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": consts.ErrAtoi})
+		return
+	}
+
+	err = h.user.Delete(uint(atoi), userId, role)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+type DeleteMe struct {
+	Password string `json:"password"`
+	// Token is mailed by POST /user/me/delete-request, for accounts without a known password
+	Token string `json:"token"`
+}
+
+func (h *userHandler) DeleteMe(c *gin.Context) {
+	var input DeleteMe
+	if err := c.ShouldBindJSON(&input); err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.Value(consts.KeyId).(uint)
+
+	err := h.user.DeleteMe(userId, input.Password, input.Token)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *userHandler) RequestDeletion(c *gin.Context) {
+	userId := c.Value(consts.KeyId).(uint)
+
+	err := h.auth.RequestAccountDeletion(userId)
+	if err != nil {
+		h.loggers.Err.Printf("%s", err.Error())
+		var respErr utils.ResponseError
+		if errors.As(err, &respErr) {
+			c.JSON(int(respErr.Code), gin.H{"error": respErr.Message})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
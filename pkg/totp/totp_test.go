@@ -0,0 +1,128 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the sha1 key of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestValidateRfcVectors uses the last 6 digits of the 8 digit RFC 6238 vectors
+func TestValidateRfcVectors(t *testing.T) {
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, c := range cases {
+		step, ok := Validate(rfcSecret, c.code, time.Unix(c.unix, 0), 0)
+		if !ok {
+			t.Errorf("%d: code %s refused", c.unix, c.code)
+			continue
+		}
+		if step != c.unix/Period {
+			t.Errorf("%d: step = %d, want %d", c.unix, step, c.unix/Period)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code := "005924" // the step of now
+
+	cases := []struct {
+		name   string
+		offset time.Duration
+		skew   int
+		ok     bool
+	}{
+		{"same step", 0, 0, true},
+		{"previous step without skew", Period * time.Second, 0, false},
+		{"previous step with skew", Period * time.Second, 1, true},
+		{"next step with skew", -Period * time.Second, 1, true},
+		{"two steps with skew 1", 2 * Period * time.Second, 1, false},
+		{"two steps with skew 2", 2 * Period * time.Second, 2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, code, now.Add(c.offset), c.skew)
+			if ok != c.ok {
+				t.Fatalf("ok = %v, want %v", ok, c.ok)
+			}
+			// the matched step is the one of the code, not of the time
+			if ok && step != now.Unix()/Period {
+				t.Errorf("step = %d, want %d", step, now.Unix()/Period)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	cases := []struct {
+		name   string
+		secret string
+		code   string
+	}{
+		{"short code", rfcSecret, "05924"},
+		{"long code", rfcSecret, "0005924"},
+		{"8 digits", rfcSecret, "89005924"},
+		{"empty code", rfcSecret, ""},
+		{"invalid secret", "not base32!", "005924"},
+		{"other secret", "JBSWY3DPEHPK3PXP", "005924"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, ok := Validate(c.secret, c.code, now, 1); ok {
+				t.Error("code accepted")
+			}
+		})
+	}
+
+	// the secret is accepted in lowercase and with spaces around
+	if _, ok := Validate(" "+strings.ToLower(rfcSecret)+" ", "005924", now, 0); !ok {
+		t.Error("lowercase secret refused")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != secretSize {
+		t.Fatalf("secret %q decodes to %d bytes, err = %v", secret, len(key), err)
+	}
+	other, _ := GenerateSecret()
+	if other == secret {
+		t.Error("two secrets are the same")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Mosquitto Broker", "user@example.com", rfcSecret)
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/Mosquitto Broker:user@example.com" {
+		t.Errorf("unexpected uri %s", uri)
+	}
+	query := parsed.Query()
+	for key, value := range map[string]string{
+		"secret": rfcSecret, "issuer": "Mosquitto Broker", "algorithm": "SHA1", "digits": "6", "period": "30",
+	} {
+		if query.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, query.Get(key), value)
+		}
+	}
+}